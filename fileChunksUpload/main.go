@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -8,7 +13,11 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"example.com/my/verifier"
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,6 +26,29 @@ const maxChunkSize = 1 * 1024 * 1024 * 1024 // 1 GB in bytes
 const uploadDir = "./uploads"
 const combinedDir = "./combined"
 
+// ownersDir has a file per user listing the files they uploaded.
+const ownersDir = "./owners"
+
+// The scopes OAuth tokens and API keys need for uploading and for listing
+// their user's files.
+const (
+	scopeFilesWrite = "files:write"
+	scopeFilesRead  = "files:read"
+)
+
+// ownersMu keeps appends to the owner files from interleaving.
+var ownersMu sync.Mutex
+
+// tokenVerifier checks uploaders against sessionAuth.
+var tokenVerifier *verifier.Verifier
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func main() {
 	router := gin.Default()
     router.Use(func(c *gin.Context) {
@@ -30,136 +62,286 @@ func main() {
 		c.Next()
 	})
 
-	router.POST("/upload", handleUploadAndCombineChunks)
+	// Without AUTH_URL there would be no way to tell who is uploading
+	authURL := os.Getenv("AUTH_URL")
+	if authURL == "" {
+		log.Fatal("AUTH_URL is not set, it must point to sessionAuth")
+	}
+	cfg := verifier.FromBaseURL(authURL, getenv("AUTH_AUDIENCE", "chatroom"), os.Getenv("AUTH_INTROSPECTION_SECRET"))
+	cfg.Issuer = getenv("AUTH_ISSUER", cfg.Issuer)
+	tokenVerifier = verifier.New(cfg)
+
+	router.POST("/upload", requireUser(scopeFilesWrite), handleUploadAndCombineChunks)
  
 	router.GET("/file", handleGetFile)
+	router.GET("/files", requireUser(scopeFilesRead), handleListFiles)
 
 	if err := router.Run(":8070"); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// requireUser rejects requests without a valid sessionAuth access token that
+// was granted the scope, and stores the user ID as "userID".
+func requireUser(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, err := tokenVerifier.VerifyRequest(c.Request)
+		if err != nil {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if !identity.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+			return
+		}
+		c.Set("userID", identity.Subject)
+		c.Next()
+	}
+}
+
+// handleUploadAndCombineChunks stores the uploaded file. Every upload gets its
+// own directory for its chunks, so concurrent uploads don't mix.
 func handleUploadAndCombineChunks(c *gin.Context) {
-	// Get a list of chunk files in the upload directory
-	chunkFiles, err := filepath.Glob(filepath.Join(uploadDir, "*"))
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+		return
+	}
+	chunkDir, err := os.MkdirTemp(uploadDir, "upload-")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list chunk files"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
 		return
 	}
+	defer os.RemoveAll(chunkDir)
 
-	if len(chunkFiles) > 0 {
-		// If chunk files exist, combine them
-		handleCombineChunks(c)
-	} else {
-		// Otherwise, handle file upload
-		handleUploadChunk(c)
-		// After uploading, initiate chunk combining
-		handleCombineChunks(c)
+	originalFilename, ok := handleUploadChunk(c, chunkDir)
+	if !ok {
+		return
+	}
+	storedFilename, ok := handleCombineChunks(c, chunkDir, originalFilename)
+	if !ok {
+		return
 	}
+	// A file nobody owns would be left out of its uploader's data export
+	if err := recordOwner(c.GetString("userID"), storedFilename); err != nil {
+		log.Printf("Failed to record the owner of %s: %v", storedFilename, err)
+		os.Remove(filepath.Join(combinedDir, storedFilename))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file owner"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully!", "filename": storedFilename})
 }
 
-func handleUploadChunk(c *gin.Context) {
+// handleUploadChunk saves the uploaded file into chunkDir and returns its
+// name. It responds with the error itself when that fails.
+func handleUploadChunk(c *gin.Context, chunkDir string) (string, bool) {
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File upload failed"})
-		return
+		return "", false
 	}
 	defer file.Close()
 
-	originalFilename := header.Filename
-
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
-		return
+	// Only the name counts, a path could point outside of our directories
+	originalFilename := filepath.Base(filepath.Clean("/" + header.Filename))
+	if originalFilename == "/" || originalFilename == "." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+		return "", false
 	}
 
-	chunkPath := filepath.Join(uploadDir, originalFilename)
+	chunkPath := filepath.Join(chunkDir, "chunk_0")
 	out, err := os.Create(chunkPath)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chunk file"})
-		return
+		return "", false
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, file)
+	n, err := io.Copy(out, io.LimitReader(file, maxChunkSize+1))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk data"})
-		return
+		return "", false
 	}
-
-	//c.JSON(http.StatusOK, gin.H{"message": "Chunk uploaded successfully"})
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully!", "filename": originalFilename})
+	if n > maxChunkSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return "", false
+	}
+	return originalFilename, true
 }
 
-func handleCombineChunks(c *gin.Context) {
-	chunkFiles, err := filepath.Glob(filepath.Join(uploadDir, "*"))
+// handleCombineChunks joins the chunks in chunkDir, in the order of their
+// index, into a new file and returns the name it was stored under. The file is
+// written under a temporary name first, so it is never served half written.
+func handleCombineChunks(c *gin.Context, chunkDir, filename string) (string, bool) {
+	chunkFiles, err := filepath.Glob(filepath.Join(chunkDir, "chunk_*"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list chunk files"})
-		return
+		return "", false
+	}
+	if len(chunkFiles) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "No chunks found"})
+		return "", false
 	}
 
 	sort.Slice(chunkFiles, func(i, j int) bool {
 		return extractIndex(chunkFiles[i]) < extractIndex(chunkFiles[j])
 	})
 
-	var originalFilename string
-	if len(chunkFiles) > 0 {
-		originalFilename = filepath.Base(chunkFiles[0])
-	} else {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "No chunks found"})
-		return
-	}
-
 	if err := os.MkdirAll(combinedDir, 0755); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create combined directory"})
-		return
+		return "", false
 	}
 
-	combinedPath := filepath.Join(combinedDir, originalFilename)
-	combinedFile, err := os.Create(combinedPath)
+	combinedFile, err := os.CreateTemp(combinedDir, ".upload-*")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create combined file"})
-		return
+		return "", false
 	}
+	defer os.Remove(combinedFile.Name())
 	defer combinedFile.Close()
 
 	for _, chunkFile := range chunkFiles {
-		chunkData, err := os.ReadFile(chunkFile)
+		chunk, err := os.Open(chunkFile)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chunk data"})
-			return
+			return "", false
 		}
-		if _, err := combinedFile.Write(chunkData); err != nil {
+		_, err = io.Copy(combinedFile, chunk)
+		chunk.Close()
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write combined data"})
-			return
+			return "", false
+		}
+	}
+	if err := combinedFile.Chmod(0644); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write combined data"})
+		return "", false
+	}
+	if err := combinedFile.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write combined data"})
+		return "", false
+	}
+	stored, err := linkUnusedName(combinedFile.Name(), filename)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save combined file"})
+		return "", false
+	}
+	return stored, true
+}
+
+// linkUnusedName gives the file at path a name in combinedDir and returns it.
+// Files are never replaced, anyone could otherwise overwrite the files of
+// others, such as their avatars. When the name is taken a random suffix is
+// added to it.
+func linkUnusedName(path, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	name := filename
+	for i := 0; i < 10; i++ {
+		err := os.Link(path, filepath.Join(combinedDir, name))
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
 		}
+		name = strings.TrimSuffix(filename, ext) + "-" + hex.EncodeToString(suffix) + ext
 	}
+	return "", errors.New("no unused filename found")
+}
 
-	if err := deleteChunkFiles(chunkFiles); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chunk files"})
-		return
+// ownedFile is a line of an owner file.
+type ownedFile struct {
+	Filename   string    `json:"filename"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ownerFile returns the file listing the uploads of the user. User IDs come
+// from sessionAuth, but are checked anyway since they become a file name.
+func ownerFile(userID string) (string, error) {
+	if userID == "" || strings.ContainsAny(userID, `/\`) || strings.HasPrefix(userID, ".") {
+		return "", errors.New("invalid user ID")
 	}
+	return filepath.Join(ownersDir, userID+".jsonl"), nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Chunks combined and saved successfully"})
+// recordOwner adds the file to the uploads of the user.
+func recordOwner(userID, filename string) error {
+	path, err := ownerFile(userID)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(ownedFile{Filename: filename, UploadedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	if err := os.MkdirAll(ownersDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func deleteChunkFiles(files []string) error {
-	for _, file := range files {
-		if err := os.Remove(file); err != nil {
-			return err
+// handleListFiles lists the files the user uploaded, oldest first.
+func handleListFiles(c *gin.Context) {
+	files := []ownedFile{}
+	path, err := ownerFile(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user"})
+		return
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusOK, gin.H{"files": files})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var file ownedFile
+		// A line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &file); err != nil {
+			continue
 		}
+		files = append(files, file)
 	}
-	return nil
+	if err := scanner.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"files": files})
 }
 
+// extractIndex returns the index of a chunk named chunk_<index>. Other names
+// sort first.
 func extractIndex(filename string) int {
-	base := filepath.Base(filename)
-	indexStr := base[len("chunk_"):]
-	index, _ := strconv.Atoi(indexStr)
+	indexStr, ok := strings.CutPrefix(filepath.Base(filename), "chunk_")
+	if !ok {
+		return -1
+	}
+	index, err := strconv.Atoi(indexStr)
+	if err != nil {
+		return -1
+	}
 	return index
 }
 
-
 func handleGetFile(c *gin.Context) {
 	filename := c.Query("filename")
 	if filename == "" {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"example.com/my/verifier"
+	"github.com/gin-gonic/gin"
+)
+
+// identityKey is the context key the verified caller is stored under.
+const identityKey = "identity"
+
+// Scopes of OAuth tokens and API keys that the chat service checks.
+const (
+	scopeChatRead  = "chat:read"
+	scopeChatWrite = "chat:write"
+)
+
+// tokenVerifier checks callers against sessionAuth.
+var tokenVerifier *verifier.Verifier
+
+// initAuth sets up the verifier. Without AUTH_URL the service doesn't start,
+// there would be no way to tell who is calling.
+func initAuth() {
+	authURL := getenv("AUTH_URL", "")
+	if authURL == "" {
+		log.Fatal("AUTH_URL is not set, it must point to sessionAuth")
+	}
+	cfg := verifier.FromBaseURL(authURL, getenv("AUTH_AUDIENCE", "chatroom"), getenv("AUTH_INTROSPECTION_SECRET", ""))
+	cfg.Issuer = getenv("AUTH_ISSUER", cfg.Issuer)
+	tokenVerifier = verifier.New(cfg)
+}
+
+// authenticate rejects requests without a valid access token. Browsers can't
+// set headers on WebSocket requests, so /ws clients pass access_token instead.
+func authenticate(c *gin.Context) {
+	identity, err := tokenVerifier.VerifyRequest(c.Request)
+	if err != nil {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set(identityKey, identity)
+	c.Next()
+}
+
+// callerID returns who is making the request, the subject of the verified
+// token. It is empty for requests that didn't pass authenticate.
+func callerID(c *gin.Context) string {
+	if value, ok := c.Get(identityKey); ok {
+		return value.(*verifier.Identity).Subject
+	}
+	return ""
+}
+
+// callerHasScope reports whether the caller's token was granted the scope.
+// Tokens of our own logins have every scope.
+func callerHasScope(c *gin.Context, scope string) bool {
+	if value, ok := c.Get(identityKey); ok {
+		return value.(*verifier.Identity).HasScope(scope)
+	}
+	return false
+}
+
+// requireScope rejects callers whose token wasn't granted the scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !callerHasScope(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// conversationPrefix marks room names that belong to a private conversation.
+const conversationPrefix = "dm_"
+
+// Conversation kinds. Direct conversations are between exactly two users and
+// have a deterministic ID, group conversations have a generated one.
+const (
+	conversationDirect = "direct"
+	conversationGroup  = "group"
+)
+
+// maxGroupMembers limits the size of a group conversation.
+const maxGroupMembers = 50
+
+type ConversationMessage struct {
+	Sender    string    `json:"sender" bson:"sender"`
+	SenderID  string    `json:"senderid" bson:"senderid"`
+	Content   string    `json:"content" bson:"content"`
+	Type      string    `json:"type" bson:"type"`
+	Time      string    `json:"time" bson:"time"`
+	CreatedAt time.Time `json:"createdat" bson:"createdat"`
+}
+
+type Conversation struct {
+	ID          string               `json:"id" bson:"id"`
+	Kind        string               `json:"kind" bson:"kind"`
+	Name        string               `json:"name,omitempty" bson:"name,omitempty"`
+	Members     []string             `json:"members" bson:"members"`
+	CreatedAt   time.Time            `json:"createdat" bson:"createdat"`
+	LastMessage *ConversationMessage `json:"lastmessage,omitempty" bson:"lastmessage,omitempty"`
+}
+
+// conversationID returns the room name shared by two users. It is the same
+// whichever of the two asks for it.
+func conversationID(a, b string) string {
+	members := []string{a, b}
+	sort.Strings(members)
+	sum := sha256.Sum256([]byte(members[0] + "\x00" + members[1]))
+	return conversationPrefix + hex.EncodeToString(sum[:16])
+}
+
+func isConversation(roomName string) bool {
+	return strings.HasPrefix(roomName, conversationPrefix)
+}
+
+// getOrCreateRoom returns the hub room with the given name, starting it if it
+// is not running yet. The room's settings are loaded before taking hub.mu, so
+// a slow query doesn't hold up every other room.
+func getOrCreateRoom(name string) *Room {
+	hub.mu.Lock()
+	room, ok := hub.rooms[name]
+	hub.mu.Unlock()
+	if ok {
+		return room
+	}
+
+	room = NewRoom(name)
+	if !isConversation(name) {
+		if doc, err := findRoom(name); err == nil {
+			room.slowMode = time.Duration(doc.Settings.SlowModeSeconds) * time.Second
+		}
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	// Someone else may have started the room in the meantime
+	if running, ok := hub.rooms[name]; ok {
+		return running
+	}
+	hub.rooms[name] = room
+	go room.Run()
+	return room
+}
+
+// ensureConversation makes sure the conversation between the two users exists
+// in MongoDB and has a running room in the hub.
+func ensureConversation(senderID, recipientID string) (string, error) {
+	id, err := saveDirectConversation(senderID, recipientID)
+	if err != nil {
+		return "", err
+	}
+	getOrCreateRoom(id)
+	return id, nil
+}
+
+// saveDirectConversation creates the conversation between the two users in
+// MongoDB unless it exists, and returns its ID.
+func saveDirectConversation(senderID, recipientID string) (string, error) {
+	id := conversationID(senderID, recipientID)
+	members := []string{senderID, recipientID}
+	sort.Strings(members)
+
+	_, err := conversationsCol.UpdateOne(ctx,
+		bson.M{"id": id},
+		bson.M{"$setOnInsert": bson.M{"id": id, "kind": conversationDirect, "members": members, "createdat": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// migrateConversations moves the private rooms that used to be kept in the
+// specificrooms and specificclients collections into conversations, together
+// with their messages. Rooms of two users become their direct conversation,
+// other rooms a group. Moved rooms are marked, so each is only moved once.
+// It also makes conversation IDs unique.
+func migrateConversations() error {
+	legacyRooms := mongoClient.Database("chat_app").Collection("specificrooms")
+	legacyClients := mongoClient.Database("chat_app").Collection("specificclients")
+
+	cursor, err := legacyRooms.Find(ctx, bson.M{"migratedto": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var legacy struct {
+			ID   interface{} `bson:"_id"`
+			Name string      `bson:"name"`
+		}
+		if err := cursor.Decode(&legacy); err != nil {
+			return err
+		}
+
+		values, err := legacyClients.Distinct(ctx, "client_id", bson.M{"room": legacy.Name})
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, value := range values {
+			if id, ok := value.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		members := uniqueMembers(ids)
+
+		var id string
+		switch {
+		case legacy.Name == "" || len(members) == 0:
+			// Nobody to give the messages to
+		case len(members) == 2:
+			id, err = saveDirectConversation(members[0], members[1])
+			if err != nil {
+				return err
+			}
+		default:
+			token, err := randomToken()
+			if err != nil {
+				return err
+			}
+			id = conversationPrefix + token
+			_, err = conversationsCol.InsertOne(ctx, Conversation{
+				ID:        id,
+				Kind:      conversationGroup,
+				Name:      legacy.Name,
+				Members:   members,
+				CreatedAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if id != "" {
+			if _, err := recieveMessagesCol.UpdateMany(ctx, bson.M{"roomname": legacy.Name}, bson.M{"$set": bson.M{"roomname": id}}); err != nil {
+				return err
+			}
+			log.Printf("Moved private room '%s' to conversation '%s'", legacy.Name, id)
+		}
+		if _, err := legacyRooms.UpdateOne(ctx, bson.M{"_id": legacy.ID}, bson.M{"$set": bson.M{"migratedto": id}}); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	_, err = conversationsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// touchConversation records msg as the latest message of the conversation.
+func touchConversation(id string, msg ConversationMessage) {
+	_, err := conversationsCol.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"lastmessage": msg}})
+	if err != nil {
+		log.Printf("Failed to update conversation '%s': %v", id, err)
+	}
+}
+
+func unreadCount(conversation, clientID string) (int64, error) {
+	filter := bson.M{"roomname": conversation, "senderid": bson.M{"$ne": clientID}}
+
+	var read bson.M
+	err := conversationReadsCol.FindOne(ctx, bson.M{"conversation": conversation, "client_id": clientID}).Decode(&read)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+	if err == nil {
+		filter["createdat"] = bson.M{"$gt": read["lastread"]}
+	}
+	return recieveMessagesCol.CountDocuments(ctx, filter)
+}
+
+func openConversation(c *gin.Context) {
+	senderID := callerID(c)
+	recipientID := c.Query("recipient_id")
+	if senderID == "" || recipientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID and recipient ID are required"})
+		return
+	}
+	if senderID == recipientID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot start a conversation with yourself"})
+		return
+	}
+
+	id, err := ensureConversation(senderID, recipientID)
+	if err != nil {
+		log.Printf("Failed to create conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversation": id})
+}
+
+func listConversations(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "lastmessage.createdat", Value: -1}, {Key: "createdat", Value: -1}})
+	cursor, err := conversationsCol.Find(ctx, bson.M{"members": clientID}, opts)
+	if err != nil {
+		log.Printf("Error fetching conversations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversations"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	type conversationSummary struct {
+		Conversation
+		With   string `json:"with"`
+		Unread int64  `json:"unread"`
+	}
+
+	conversations := []conversationSummary{}
+	for cursor.Next(ctx) {
+		var conv Conversation
+		if err := cursor.Decode(&conv); err != nil {
+			log.Printf("Failed to decode conversation: %v", err)
+			continue
+		}
+
+		summary := conversationSummary{Conversation: conv}
+		if conv.Kind != conversationGroup {
+			for _, member := range conv.Members {
+				if member != clientID {
+					summary.With = member
+				}
+			}
+		}
+		summary.Unread, err = unreadCount(conv.ID, clientID)
+		if err != nil {
+			log.Printf("Failed to count unread messages in '%s': %v", conv.ID, err)
+		}
+		conversations = append(conversations, summary)
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Printf("Cursor error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cursor error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
+}
+
+func markConversationRead(c *gin.Context) {
+	conversation := c.Param("id")
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	err := conversationsCol.FindOne(ctx, bson.M{"id": conversation, "members": clientID}).Err()
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to query conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+
+	_, err = conversationReadsCol.UpdateOne(ctx,
+		bson.M{"conversation": conversation, "client_id": clientID},
+		bson.M{"$set": bson.M{"lastread": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Failed to mark conversation read: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark conversation read"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation marked as read"})
+}
+
+// uniqueMembers drops empty and repeated IDs, keeping the first occurrence.
+func uniqueMembers(ids []string) []string {
+	seen := make(map[string]bool)
+	var members []string
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+	return members
+}
+
+func createGroupConversation(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	var req struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	members := uniqueMembers(append([]string{clientID}, req.Members...))
+	if len(members) < 3 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A group needs at least two other members"})
+		return
+	}
+	if len(members) > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many members"})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+	conv := Conversation{
+		ID:        conversationPrefix + token,
+		Kind:      conversationGroup,
+		Name:      strings.TrimSpace(req.Name),
+		Members:   members,
+		CreatedAt: time.Now(),
+	}
+	if _, err := conversationsCol.InsertOne(ctx, conv); err != nil {
+		log.Printf("Failed to insert conversation into MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+		return
+	}
+
+	getOrCreateRoom(conv.ID)
+
+	c.JSON(http.StatusOK, gin.H{"conversation": conv})
+}
+
+func addConversationMembers(c *gin.Context) {
+	conversation := c.Param("id")
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	var req struct {
+		Members []string `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	members := uniqueMembers(req.Members)
+	if len(members) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Members are required"})
+		return
+	}
+
+	var conv Conversation
+	err := conversationsCol.FindOne(ctx, bson.M{"id": conversation, "members": clientID}).Decode(&conv)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+	if conv.Kind != conversationGroup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Members can only be added to group conversations"})
+		return
+	}
+	if len(uniqueMembers(append(conv.Members, members...))) > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many members"})
+		return
+	}
+
+	_, err = conversationsCol.UpdateOne(ctx, bson.M{"id": conversation}, bson.M{"$addToSet": bson.M{"members": bson.M{"$each": members}}})
+	if err != nil {
+		log.Printf("Failed to update conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add members"})
+		return
+	}
+	existing := make(map[string]bool)
+	for _, member := range conv.Members {
+		existing[member] = true
+	}
+	for _, member := range members {
+		if !existing[member] {
+			recordRoomEvent(conversation, "membership", member, member+" was added by "+clientID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Members added"})
+}
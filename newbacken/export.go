@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportVersion is written into the header of every export so that the
+// format can change without breaking old archives.
+const exportVersion = 1
+
+const (
+	maxImportSize  = 100 << 20 // 100 MB
+	importBatchLen = 500
+)
+
+// eventTypes are the message types written by the server rather than users.
+var eventTypes = map[string]bool{"membership": true, "topic": true, "system": true}
+
+// ExportHeader is the first line of a JSON Lines export.
+type ExportHeader struct {
+	Kind         string        `json:"kind"`
+	Version      int           `json:"version"`
+	ExportedAt   time.Time     `json:"exportedat"`
+	Room         *RoomDoc      `json:"room,omitempty"`
+	Conversation *Conversation `json:"conversation,omitempty"`
+	Members      []string      `json:"members"`
+}
+
+// exportRecord turns a stored message into an export line. Every field of the
+// document is kept, including edits and reactions, except the room it was
+// stored under, which an import replaces.
+func exportRecord(doc bson.M) bson.M {
+	record := bson.M{}
+	for key, value := range doc {
+		switch key {
+		case "_id", "roomname":
+			continue
+		}
+		if dt, ok := value.(primitive.DateTime); ok {
+			value = dt.Time()
+		}
+		record[key] = value
+	}
+	if _, ok := record["createdat"]; !ok {
+		if id, ok := doc["_id"].(primitive.ObjectID); ok {
+			record["createdat"] = id.Timestamp()
+		}
+	}
+
+	record["kind"] = "message"
+	if msgType, _ := doc["type"].(string); eventTypes[msgType] {
+		record["kind"] = "event"
+	}
+	return record
+}
+
+func exportHeader(roomID string) (*ExportHeader, error) {
+	header := &ExportHeader{Kind: "room", Version: exportVersion, ExportedAt: time.Now()}
+
+	if isConversation(roomID) {
+		var conv Conversation
+		if err := conversationsCol.FindOne(ctx, bson.M{"id": roomID}).Decode(&conv); err != nil {
+			return nil, err
+		}
+		header.Conversation = &conv
+		header.Members = conv.Members
+		return header, nil
+	}
+
+	room, err := findRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	header.Room = room
+
+	members, err := membersCol.Distinct(ctx, "client_id", bson.M{"room": roomID})
+	if err != nil {
+		return nil, err
+	}
+	header.Members = []string{}
+	for _, member := range members {
+		if id, ok := member.(string); ok {
+			header.Members = append(header.Members, id)
+		}
+	}
+	return header, nil
+}
+
+func exportRoom(c *gin.Context) {
+	roomID := c.Param("id")
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "html" && format != "md" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be jsonl, html or md"})
+		return
+	}
+	// An export is the whole history, so it needs the same rights as reading it
+	if !authorizeRoomRead(c, roomID) {
+		return
+	}
+
+	header, err := exportHeader(roomID)
+	if err != nil {
+		log.Printf("Failed to export room '%s': %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export room"})
+		return
+	}
+
+	cursor, err := recieveMessagesCol.Find(ctx, bson.M{"roomname": roomID}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		log.Printf("Failed to find messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export room"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	contentTypes := map[string]string{
+		"jsonl": "application/x-ndjson",
+		"html":  "text/html; charset=utf-8",
+		"md":    "text/markdown; charset=utf-8",
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=room-%s.%s", roomID, format))
+	c.Header("Content-Type", contentTypes[format])
+	c.Status(http.StatusOK)
+
+	switch format {
+	case "jsonl":
+		err = writeJSONLines(c.Writer, header, cursor)
+	default:
+		err = writeTranscript(c.Writer, format, header, cursor)
+	}
+	if err != nil {
+		// The status is already sent, all we can do is stop writing
+		log.Printf("Failed to export room '%s': %v", roomID, err)
+	}
+}
+
+func writeJSONLines(w io.Writer, header *ExportHeader, cursor *mongo.Cursor) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := enc.Encode(exportRecord(doc)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+type transcriptLine struct {
+	Time    string
+	Sender  string
+	Content string
+	Event   bool
+}
+
+var htmlTranscript = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.time { color: #888; font-size: small; }
+.event { color: #666; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Topic}}<p><strong>Topic:</strong> {{.Topic}}</p>{{end}}
+<p class="time">Exported {{.ExportedAt}}</p>
+{{range .Lines}}{{if .Event}}<p class="event"><span class="time">{{.Time}}</span> {{.Content}}</p>
+{{else}}<p><span class="time">{{.Time}}</span> <strong>{{.Sender}}</strong>: {{.Content}}</p>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// writeTranscript writes a human readable transcript in HTML or Markdown.
+func writeTranscript(w io.Writer, format string, header *ExportHeader, cursor *mongo.Cursor) error {
+	title, topic := "Conversation", ""
+	if header.Room != nil {
+		title, topic = header.Room.Name, header.Room.Topic
+	} else if header.Conversation != nil && header.Conversation.Name != "" {
+		title = header.Conversation.Name
+	}
+
+	var lines []transcriptLine
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		record := exportRecord(doc)
+		line := transcriptLine{Event: record["kind"] == "event"}
+		line.Sender, _ = record["sender"].(string)
+		line.Content, _ = record["content"].(string)
+		line.Time, _ = record["time"].(string)
+		if createdAt, ok := record["createdat"].(time.Time); ok {
+			line.Time = createdAt.Format(time.RFC3339)
+		}
+		lines = append(lines, line)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	exportedAt := header.ExportedAt.Format(time.RFC3339)
+	if format == "html" {
+		return htmlTranscript.Execute(w, gin.H{"Title": title, "Topic": topic, "ExportedAt": exportedAt, "Lines": lines})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	if topic != "" {
+		fmt.Fprintf(&b, "> %s\n\n", topic)
+	}
+	fmt.Fprintf(&b, "_Exported %s_\n\n", exportedAt)
+	for _, line := range lines {
+		if line.Event {
+			fmt.Fprintf(&b, "- `%s` _%s_\n", line.Time, line.Content)
+		} else {
+			fmt.Fprintf(&b, "- `%s` **%s**: %s\n", line.Time, line.Sender, line.Content)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// importID returns a new ObjectID that carries the original time of the
+// message, so that imported history sorts and expires like the original.
+func importID(createdAt time.Time) primitive.ObjectID {
+	id := primitive.NewObjectID()
+	binary.BigEndian.PutUint32(id[0:4], uint32(createdAt.Unix()))
+	return id
+}
+
+// importRecord turns an export line back into a message of the given room.
+// Anyone can write an export file, so the messages are attributed to the
+// importing client and flagged as imported rather than trusting senderid.
+func importRecord(line map[string]interface{}, roomID, clientID string) bson.M {
+	doc := bson.M{}
+	for key, value := range line {
+		switch key {
+		case "kind", "_id", "roomname", "senderid", "imported":
+			continue
+		}
+		doc[key] = value
+	}
+	doc["senderid"] = clientID
+	doc["imported"] = true
+
+	createdAt := time.Now()
+	if value, ok := line["createdat"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			createdAt = t
+		}
+	}
+	doc["createdat"] = createdAt
+	doc["_id"] = importID(createdAt)
+	doc["roomname"] = roomID
+	return doc
+}
+
+// importRoom loads a JSON Lines export into a new room owned by the caller.
+func importRoom(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	reader := bufio.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize))
+	firstLine, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read import"})
+		return
+	}
+	var header ExportHeader
+	if err := json.Unmarshal(bytes.TrimSpace(firstLine), &header); err != nil || header.Kind != "room" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Import must start with a room header"})
+		return
+	}
+	if header.Version > exportVersion {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported export version %d", header.Version)})
+		return
+	}
+
+	room := RoomDoc{Visibility: visibilityPrivate}
+	if header.Room != nil {
+		room = *header.Room
+	} else if header.Conversation != nil {
+		room.Name = header.Conversation.Name
+	}
+	if name := strings.TrimSpace(c.Query("name")); name != "" {
+		room.Name = name
+	}
+	if visibility := c.Query("visibility"); visibility != "" {
+		room.Visibility = visibility
+	}
+	if room.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
+		return
+	}
+	room.Visibility = room.roomVisibility()
+	room.Avatar = ""
+	room.CreatedBy = clientID
+	room.CreatedAt = time.Now()
+	if err := validateRoom(room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room.ID, err = randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+	if _, err := roomsCol.InsertOne(ctx, room); err != nil {
+		log.Printf("Failed to insert room into MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+	// A failed import removes the room again, rather than leaving behind a
+	// room with part of the history
+	abandon := func(status int, message string) {
+		removeImportedRoom(room.ID)
+		c.JSON(status, gin.H{"error": message})
+	}
+	if _, err := addMember(room.ID, clientID, "owner"); err != nil {
+		log.Printf("Failed to add member: %v", err)
+		abandon(http.StatusInternalServerError, "Failed to create room")
+		return
+	}
+
+	var imported int
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := recieveMessagesCol.InsertMany(ctx, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for lineNo := 2; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record map[string]interface{}
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				abandon(http.StatusBadRequest, fmt.Sprintf("Invalid record on line %d", lineNo))
+				return
+			}
+			batch = append(batch, importRecord(record, room.ID, clientID))
+			if len(batch) == importBatchLen {
+				if err := flush(); err != nil {
+					log.Printf("Failed to import messages: %v", err)
+					abandon(http.StatusInternalServerError, "Failed to import messages")
+					return
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			abandon(http.StatusBadRequest, "Failed to read import")
+			return
+		}
+	}
+	if err := flush(); err != nil {
+		log.Printf("Failed to import messages: %v", err)
+		abandon(http.StatusInternalServerError, "Failed to import messages")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room, "imported": imported})
+}
+
+// removeImportedRoom deletes a room whose import failed, with its members
+// and the messages imported so far.
+func removeImportedRoom(roomID string) {
+	if _, err := recieveMessagesCol.DeleteMany(ctx, bson.M{"roomname": roomID}); err != nil {
+		log.Printf("Failed to remove messages of room '%s': %v", roomID, err)
+	}
+	if _, err := membersCol.DeleteMany(ctx, bson.M{"room": roomID}); err != nil {
+		log.Printf("Failed to remove members of room '%s': %v", roomID, err)
+	}
+	if _, err := roomsCol.DeleteOne(ctx, bson.M{"id": roomID}); err != nil {
+		log.Printf("Failed to remove room '%s': %v", roomID, err)
+	}
+}
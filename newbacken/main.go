@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
-	//"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
 	"sync"
 	"time"
 
@@ -42,6 +42,10 @@ type Client struct {
 	conn *websocket.Conn
 	send chan []byte
 	room *Room
+
+	// readOnly clients connected with a token that lacks chat:write, such as
+	// an API key for a bot that only listens.
+	readOnly bool
 }
 
 type Room struct {
@@ -50,7 +54,11 @@ type Room struct {
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan []byte
+	stop       chan struct{}
 	mu         sync.Mutex // Mutex for synchronization
+
+	slowMode time.Duration        // minimum time between two messages of a client
+	lastSent map[string]time.Time // when each client last sent a message
 }
 
 type Hub struct {
@@ -64,10 +72,25 @@ var (
 	ctx         = context.TODO()
 	roomsCol    *mongo.Collection
 	clientsCol  *mongo.Collection
-	roomsCol2   *mongo.Collection
-	clientsCol2 *mongo.Collection
+
+	recieveMessagesCol   *mongo.Collection
+	conversationsCol     *mongo.Collection
+	conversationReadsCol *mongo.Collection
+	membersCol           *mongo.Collection
+	invitesCol           *mongo.Collection
+	messagesCol          *mongo.Collection
+	purgesCol            *mongo.Collection
+	legalHoldsCol        *mongo.Collection
 )
 
+// getenv returns the value of the environment variable or fallback if unset.
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func initMongoDB() {
 	var err error
 	mongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
@@ -76,9 +99,21 @@ func initMongoDB() {
 	}
 	roomsCol = mongoClient.Database("chat_app").Collection("rooms")
 	clientsCol = mongoClient.Database("chat_app").Collection("clients")
-	roomsCol2 = mongoClient.Database("chat_app").Collection("specificrooms")
-	clientsCol2 = mongoClient.Database("chat_app").Collection("specificclients")
+	recieveMessagesCol = mongoClient.Database("chat_app").Collection("recievemessages")
+	conversationsCol = mongoClient.Database("chat_app").Collection("conversations")
+	conversationReadsCol = mongoClient.Database("chat_app").Collection("conversationreads")
+	membersCol = mongoClient.Database("chat_app").Collection("members")
+	invitesCol = mongoClient.Database("chat_app").Collection("invites")
+	messagesCol = mongoClient.Database("chat_app").Collection("messages")
+	purgesCol = mongoClient.Database("chat_app").Collection("purges")
+	legalHoldsCol = mongoClient.Database("chat_app").Collection("legalholds")
 
+	if err := migrateRooms(); err != nil {
+		log.Fatalf("Failed to migrate rooms: %v", err)
+	}
+	if err := migrateConversations(); err != nil {
+		log.Fatalf("Failed to migrate conversations: %v", err)
+	}
 }
 
 func NewRoom(name string) *Room {
@@ -88,6 +123,8 @@ func NewRoom(name string) *Room {
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan []byte),
+		stop:       make(chan struct{}),
+		lastSent:   make(map[string]time.Time),
 	}
 }
 
@@ -126,6 +163,20 @@ func (r *Room) Run() {
 					}
 				}()
 			}
+			r.mu.Unlock()
+
+		case <-r.stop:
+			r.mu.Lock()
+			for client := range r.clients {
+				delete(r.clients, client)
+				close(client.send)
+				if client.conn != nil {
+					client.conn.Close()
+				}
+			}
+			r.mu.Unlock()
+			log.Printf("Room '%s' closed", r.name)
+			return
 
 		case msg := <-r.broadcast:
 			r.mu.Lock()
@@ -146,6 +197,26 @@ func (r *Room) Run() {
 	}
 }
 
+// join registers the client with the room. It returns false if the room was
+// stopped because it got deleted, then nobody is left to receive it.
+func (r *Room) join(client *Client) bool {
+	select {
+	case r.register <- client:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// leave unregisters the client, unless the room was stopped, which already
+// disconnected everyone.
+func (r *Room) leave(client *Client) {
+	select {
+	case r.unregister <- client:
+	case <-r.stop:
+	}
+}
+
 func (c *Client) readPump() {
 	log.Printf("readpump ####")
 	for {
@@ -154,16 +225,16 @@ func (c *Client) readPump() {
 			log.Printf("Error reading message: %v", err)
 			break
 		}
-		log.Printf("raw message recieved is:%s", string(message))
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf("Error unmarshalling message: %v", err)
 			continue
 		}
+		if c.readOnly {
+			c.notify("error", "This token can't send messages")
+			continue
+		}
 
-		log.Printf("Content: %s, Sender: %s, Room Name: %s, receipeint id: %s", msg.Content, msg.Sender, msg.RoomName, msg.RecipientID)
-		parts := strings.SplitN(string(msg.Content), ":", 3)
-		log.Printf("Parts after splitting: %v", parts)
 		//var recipientID=""
 		//var recipientID, msgContent string
 		// if len(parts) == 3 && parts[0] == "to" {
@@ -179,17 +250,43 @@ func (c *Client) readPump() {
 		// }
 		log.Printf("recipientid is: %s", msg.RecipientID)
 
-		msg.Time = time.Now().Format("02-01-2006T03:04:05.000PM07:00")
+		now := time.Now()
+		msg.Time = now.Format("02-01-2006T03:04:05.000PM07:00")
+
+		// A message addressed to a single user goes to the private
+		// conversation between the two, which is created on first use.
+		direct := msg.RecipientID != "" && msg.RecipientID != "all"
+		if direct {
+			if msg.RecipientID == c.id {
+				log.Printf("Ignoring direct message from '%s' to themselves", c.id)
+				continue
+			}
+			msg.RoomName, err = ensureConversation(c.id, msg.RecipientID)
+			if err != nil {
+				log.Printf("Failed to create conversation: %v", err)
+				continue
+			}
+		} else {
+			// Everything else goes to the room this socket joined, whose
+			// access was checked, whatever room the message names
+			msg.RoomName = c.room.name
+			if wait := c.room.slowModeWait(c.id, now); wait > 0 {
+				c.notify("error", fmt.Sprintf("Slow mode is on, wait %d seconds before sending again", int(wait.Seconds()+0.5)))
+				continue
+			}
+		}
 
 		// Save the message to MongoDB
-		_, err = mongoClient.Database("chat_app").Collection("recievemessages").InsertOne(context.TODO(), bson.M{
+		_, err = recieveMessagesCol.InsertOne(context.TODO(), bson.M{
 			"roomname": msg.RoomName,
 			"sender":   msg.Sender,
+			"senderid": c.id,
 			"content":  msg.Content,
 			// "clientID":    clientID,
 			"recipientid": msg.RecipientID,
 			"type":        msg.Type,
 			"time":        msg.Time,
+			"createdat":   now,
 		})
 		if err != nil {
 			log.Printf("Failed to insert message into MongoDB: %v", err)
@@ -204,13 +301,29 @@ func (c *Client) readPump() {
 			"RecipientID": msg.RecipientID,
 			"Type":        msg.Type,
 			"Time":        msg.Time,
+			"SenderID":    c.id,
+			"Profile":     profileFor(c.id),
 		})
 		if err != nil {
 			log.Printf("Error marshalling message: %v", err)
 			continue
 		}
 
-		if msg.RecipientID != "all" {
+		if isConversation(msg.RoomName) {
+			touchConversation(msg.RoomName, ConversationMessage{
+				Sender:    msg.Sender,
+				SenderID:  c.id,
+				Content:   msg.Content,
+				Type:      msg.Type,
+				Time:      msg.Time,
+				CreatedAt: now,
+			})
+		}
+
+		if direct {
+			room := getOrCreateRoom(msg.RoomName)
+			broadcastToRoom(room, jsonMessage)
+		} else if msg.RecipientID != "all" {
 			// for client := range c.room.clients {
 			//     if client.id == msg.RecipientID {
 			//         log.Printf("Recipient found: %s", client.id)
@@ -270,110 +383,26 @@ func (c *Client) writePump() {
 	log.Printf("writepump ####")
 	for message := range c.send {
 		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		log.Printf("message to write:%s", message)
 		if err != nil {
 			log.Println(err)
 			break
 		}
 	}
 }
+// createRoomAndAddUsers is kept for older clients; the room name it used to
+// take is ignored in favour of the conversation shared by the two users.
 func createRoomAndAddUsers(c *gin.Context) {
-	roomName := c.Query("room_name")
-	senderID := c.Query("sender_id")
+	senderID := callerID(c)
 	clientID := c.Query("recipient_id")
-
-	// Check if both users are present in the same room
-	var senderDocs []bson.M
-	cursor, err := clientsCol2.Find(ctx, bson.M{"client_id": senderID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query MongoDB for sender"})
-		return
-	}
-	if err = cursor.All(ctx, &senderDocs); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode sender documents"})
+	if senderID == "" || clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sender ID and recipient ID are required"})
 		return
 	}
 
-	var recipientDocs []bson.M
-	cursor, err = clientsCol2.Find(ctx, bson.M{"client_id": clientID})
+	roomName, err := ensureConversation(senderID, clientID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query MongoDB for recipient"})
-		return
-	}
-	if err = cursor.All(ctx, &recipientDocs); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode recipient documents"})
-		return
-	}
-
-	// Check if both users are present in the same room
-	foundCommonRoom := false
-	var commonRoom string
-	for _, sender := range senderDocs {
-		senderRoomName := sender["room"].(string)
-		for _, recipient := range recipientDocs {
-			recipientRoomName := recipient["room"].(string)
-			if senderRoomName == recipientRoomName {
-				foundCommonRoom = true
-				commonRoom = senderRoomName
-				break
-			}
-		}
-		if foundCommonRoom {
-			break
-		}
-	}
-
-	if foundCommonRoom {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Room already exists with both users", "room": commonRoom})
-		return
-	}
-
-	hub.mu.Lock()
-	defer hub.mu.Unlock()
-
-	// Check if the room already exists in the hub
-	room, ok := hub.rooms[roomName]
-	if !ok {
-		// Room doesn't exist in the hub, create a new one
-		room = NewRoom(roomName)
-		hub.rooms[roomName] = room
-		go room.Run()
-
-		// Insert the room into MongoDB
-		_, err := roomsCol2.InsertOne(ctx, bson.M{"name": roomName})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert room into MongoDB"})
-			return
-		}
-	}
-
-	// Register sender
-	senderClient := &Client{
-		id:   senderID,
-		room: room,
-		send: make(chan []byte, 256),
-	}
-	room.register <- senderClient
-
-	// Insert the sender into MongoDB
-	_, err = clientsCol2.InsertOne(ctx, bson.M{"room": roomName, "client_id": senderID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert sender into MongoDB"})
-		return
-	}
-
-	// Register client
-	client := &Client{
-		id:   clientID,
-		room: room,
-		send: make(chan []byte, 256),
-	}
-	room.register <- client
-
-	// Insert the client into MongoDB
-	_, err = clientsCol2.InsertOne(ctx, bson.M{"room": roomName, "client_id": clientID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert client into MongoDB"})
+		log.Printf("Failed to create conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
 		return
 	}
 
@@ -382,6 +411,10 @@ func createRoomAndAddUsers(c *gin.Context) {
 
 func broadcastToRoom(room *Room, message []byte) {
 	log.Printf("broadcastmessage:")
+	// The room closes the send channels of clients that leave while holding
+	// its lock, so holding it here too keeps us from sending to one of them
+	room.mu.Lock()
+	defer room.mu.Unlock()
 	for client := range room.clients {
 		log.Printf("Broadcasting message to client ID: %s", client.id)
 		select {
@@ -400,36 +433,95 @@ func createRoomAndUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
 		return
 	}
+	// The prefix is reserved, a room with it would take over a conversation
+	if isConversation(roomName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Room names can't start with " + conversationPrefix})
+		return
+	}
 
-	clientID := c.Query("id")
+	clientID := callerID(c)
 	if clientID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
 		return
 	}
 
-	hub.mu.Lock()
-	defer hub.mu.Unlock()
+	visibility := c.DefaultQuery("visibility", visibilityPublic)
+	if !validVisibility(visibility) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Visibility must be public, private or invite"})
+		return
+	}
 
-	// Check if the room already exists in the hub
-	room, ok := hub.rooms[roomName]
-	if !ok {
-		// Room doesn't exist in the hub, create a new one
-		room = NewRoom(roomName)
-		hub.rooms[roomName] = room
-		go room.Run()
-
-		// Insert the room into MongoDB if it doesn't exist
-		_, err := roomsCol.InsertOne(ctx, bson.M{"name": roomName})
+	// Check if the room already exists in MongoDB
+	existing, err := findRoom(roomName)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Failed to query MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve room"})
+		return
+	}
+
+	role := "member"
+	if existing == nil {
+		// Room doesn't exist yet, create it with the caller as its owner
+		role = "owner"
+		_, err = roomsCol.InsertOne(ctx, RoomDoc{
+			ID:         roomName,
+			Name:       roomName,
+			Visibility: visibility,
+			CreatedBy:  clientID,
+			CreatedAt:  time.Now(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			// Someone else created it just now, so join it like any other
+			role = "member"
+			existing, err = findRoom(roomName)
+		}
 		if err != nil {
 			log.Printf("Failed to insert room into MongoDB: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
 			return
 		}
 	}
+	if existing != nil && existing.roomVisibility() != visibilityPublic {
+		// Private and invite-only rooms need membership or an invitation
+		member, err := isMember(roomName, clientID)
+		if err != nil {
+			log.Printf("Failed to query MongoDB: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+			return
+		}
+		if !member {
+			token := c.Query("invite")
+			if token == "" {
+				c.JSON(http.StatusForbidden, gin.H{"error": "This room requires an invitation"})
+				return
+			}
+			if _, err := useInvite(token, roomName); err != nil {
+				if err == errInviteInvalid {
+					c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				} else {
+					log.Printf("Failed to use invitation: %v", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify invitation"})
+				}
+				return
+			}
+		}
+	}
+
+	room := getOrCreateRoom(roomName)
+
+	joined, err := addMember(roomName, clientID, role)
+	if err != nil {
+		log.Printf("Failed to add member: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register client"})
+		return
+	}
+	if joined {
+		recordRoomEvent(roomName, "membership", clientID, clientID+" joined the room")
+	}
 
 	// Check if the client already exists in the database
 	var existingClient bson.M
-	err := clientsCol.FindOne(ctx, bson.M{"room": roomName, "client_id": clientID}).Decode(&existingClient)
+	err = clientsCol.FindOne(ctx, bson.M{"room": roomName, "client_id": clientID}).Decode(&existingClient)
 	if err != nil && err != mongo.ErrNoDocuments {
 		log.Printf("Failed to query MongoDB: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
@@ -447,7 +539,10 @@ func createRoomAndUser(c *gin.Context) {
 		room: room,
 		send: make(chan []byte, 256),
 	}
-	room.register <- client
+	if !room.join(client) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
 
 	// Insert the client into MongoDB
 	_, err = clientsCol.InsertOne(ctx, bson.M{"room": roomName, "client_id": clientID})
@@ -468,27 +563,35 @@ func serveWs(c *gin.Context) {
 		return
 	}
 
-	clientID := c.Query("id")
+	clientID := callerID(c)
 	if clientID == "" {
 		log.Printf("Client ID is required")
 		return
 	}
+	if !callerHasScope(c, scopeChatRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token lacks the chat:read scope"})
+		return
+	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	allowed, err := canAccessRoom(roomName, clientID)
 	if err != nil {
-		log.Printf("Failed to upgrade connection to WebSocket: %v", err)
+		log.Printf("Failed to verify access to room '%s': %v", roomName, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if !allowed {
+		log.Printf("User '%s' may not join room '%s'", clientID, roomName)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
 		return
 	}
 
-	hub.mu.Lock()
-	room, ok := hub.rooms[roomName]
-	if !ok {
-		log.Printf("Room '%s' not found", roomName)
-		//conn.Close()
-		hub.mu.Unlock()
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection to WebSocket: %v", err)
 		return
 	}
-	hub.mu.Unlock()
+
+	room := getOrCreateRoom(roomName)
 
 	// clientExists := false
 	// for client := range room.clients {
@@ -509,9 +612,15 @@ func serveWs(c *gin.Context) {
 		conn: conn,
 		send: make(chan []byte, 256),
 		room: room,
+
+		readOnly: !callerHasScope(c, scopeChatWrite),
 	}
 
-	room.register <- client
+	if !room.join(client) {
+		log.Printf("Room '%s' was deleted while '%s' was joining", roomName, clientID)
+		conn.Close()
+		return
+	}
 
 	go client.writePump()
 	go client.readPump()
@@ -519,28 +628,47 @@ func serveWs(c *gin.Context) {
 
 func listRooms(c *gin.Context) {
 	log.Printf("listroom @@@@@")
-	cursor, err := roomsCol.Find(ctx, bson.M{})
+
+	// Private rooms are only listed for their members
+	visible := []bson.M{{"visibility": bson.M{"$ne": visibilityPrivate}}}
+	if clientID := callerID(c); clientID != "" {
+		memberOf, err := membersCol.Distinct(ctx, "room", bson.M{"client_id": clientID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rooms"})
+			return
+		}
+		visible = append(visible, bson.M{"id": bson.M{"$in": memberOf}})
+	}
+
+	cursor, err := roomsCol.Find(ctx, bson.M{"$or": visible})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rooms"})
 		return
 	}
 	defer cursor.Close(ctx)
 
+	// rooms holds the IDs used to join, details the metadata shown to users
 	var rooms []string
+	details := []RoomDoc{}
 	for cursor.Next(ctx) {
-		var room bson.M
+		var room RoomDoc
 		if err := cursor.Decode(&room); err != nil {
 			log.Printf("Failed to decode room: %v", err)
 			continue
 		}
-		rooms = append(rooms, room["name"].(string))
+		rooms = append(rooms, room.ID)
+		details = append(details, room)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
+	c.JSON(http.StatusOK, gin.H{"rooms": rooms, "details": details})
 }
 func listSpecificRooms(c *gin.Context) {
 	log.Printf("listroom @@@@@")
-	cursor, err := roomsCol2.Find(ctx, bson.M{})
+	filter := bson.M{}
+	if clientID := callerID(c); clientID != "" {
+		filter = bson.M{"members": clientID}
+	}
+	cursor, err := conversationsCol.Find(ctx, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rooms"})
 		return
@@ -549,12 +677,12 @@ func listSpecificRooms(c *gin.Context) {
 
 	var rooms []string
 	for cursor.Next(ctx) {
-		var room bson.M
-		if err := cursor.Decode(&room); err != nil {
+		var conv Conversation
+		if err := cursor.Decode(&conv); err != nil {
 			log.Printf("Failed to decode room: %v", err)
 			continue
 		}
-		rooms = append(rooms, room["name"].(string))
+		rooms = append(rooms, conv.ID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
@@ -568,6 +696,10 @@ func getClientsInRoom(c *gin.Context) {
 		return
 	}
 
+	if !authorizeRoomRead(c, roomName) {
+		return
+	}
+
 	// Fetch clients associated with the room from MongoDB
 	cursor, err := clientsCol.Find(ctx, bson.M{"room": roomName})
 	if err != nil {
@@ -604,33 +736,23 @@ func getSpecificClientsInRoom(c *gin.Context) {
 		return
 	}
 
-	// Fetch clients associated with the room from MongoDB
-	cursor, err := clientsCol2.Find(ctx, bson.M{"room": roomName})
-	if err != nil {
-		log.Printf("Error fetching clients: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve clients"})
+	if !authorizeRoomRead(c, roomName) {
 		return
 	}
-	defer cursor.Close(ctx)
 
-	var clientIDs []string
-	for cursor.Next(ctx) {
-		var client bson.M
-		if err := cursor.Decode(&client); err != nil {
-			log.Printf("Failed to decode client: %v", err)
-			continue
-		}
-		clientID := client["client_id"].(string)
-		clientIDs = append(clientIDs, clientID)
+	var conv Conversation
+	err := conversationsCol.FindOne(ctx, bson.M{"id": roomName}).Decode(&conv)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
 	}
-
-	if err := cursor.Err(); err != nil {
-		log.Printf("Cursor error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cursor error"})
+	if err != nil {
+		log.Printf("Error fetching clients: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve clients"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"clients": clientIDs})
+	c.JSON(http.StatusOK, gin.H{"clients": conv.Members})
 }
 func deleteUserFromRoom(c *gin.Context) {
 	roomName := c.Query("room")
@@ -639,39 +761,56 @@ func deleteUserFromRoom(c *gin.Context) {
 		return
 	}
 
-	clientID := c.Query("id")
+	clientID := callerID(c)
 	if clientID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
 		return
 	}
 	// roomName := "room1"
 	// clientID := "user1"
-	hub.mu.Lock()
-	defer hub.mu.Unlock()
+	res, err := membersCol.DeleteOne(ctx, bson.M{"room": roomName, "client_id": clientID})
+	if err != nil {
+		log.Printf("Failed to delete member from MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user from room"})
+		return
+	}
+	wasMember := res.DeletedCount > 0
 
+	hub.mu.Lock()
 	room, ok := hub.rooms[roomName]
-	if !ok {
+	if !ok && !wasMember {
+		hub.mu.Unlock()
 		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
 		return
 	}
 
-	clientExists := false
 	var clientToRemove *Client
-	for client := range room.clients {
-		if client.id == clientID {
-			clientExists = true
-			clientToRemove = client
-			break
+	if ok {
+		room.mu.Lock()
+		for client := range room.clients {
+			if client.id == clientID {
+				clientToRemove = client
+				break
+			}
 		}
+		room.mu.Unlock()
 	}
 
-	if !clientExists {
+	if clientToRemove == nil && !wasMember {
+		hub.mu.Unlock()
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found in room"})
 		return
 	}
 
 	// Unregister the client from the room
-	room.unregister <- clientToRemove
+	if clientToRemove != nil {
+		room.leave(clientToRemove)
+	}
+	hub.mu.Unlock()
+
+	if wasMember {
+		recordRoomEvent(roomName, "membership", clientID, clientID+" left the room")
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted from room"})
 }
@@ -682,12 +821,11 @@ func saveMessage(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	log.Printf("message to be saved is: %s", msg)
 
 	msg.Time = time.Now().Format("02-01-2006T03:04:05.000PM07:00")
 
 	// message.RecipientID = "all"
-	_, err := mongoClient.Database("chat_app").Collection("messages").InsertOne(context.Background(), msg)
+	_, err := messagesCol.InsertOne(context.Background(), msg)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to save message"})
 		return
@@ -696,6 +834,9 @@ func saveMessage(c *gin.Context) {
 }
 func getMessageByRecipientID(c *gin.Context) {
 	roomname := c.Param("roomName")
+	if !authorizeRoomRead(c, roomname) {
+		return
+	}
 
 	// Define filter to match recipient ID
 	filter := bson.M{"roomname": roomname}
@@ -711,13 +852,15 @@ func getMessageByRecipientID(c *gin.Context) {
 
 	// Define struct to match the message format
 	type Message struct {
-		ID          string `bson:"_id,omitempty"`
-		Sender      string `bson:"sender"`
-		Content     string `bson:"content"`
-		RoomName    string `bson:"roomname"`
-		Time        string `bson:"time"`
-		RecipientID string `bson:"recipientid"`
-		Type        string `bson:"type"`
+		ID          string   `bson:"_id,omitempty"`
+		Sender      string   `bson:"sender"`
+		Content     string   `bson:"content"`
+		RoomName    string   `bson:"roomname"`
+		Time        string   `bson:"time"`
+		RecipientID string   `bson:"recipientid"`
+		Type        string   `bson:"type"`
+		SenderID    string   `bson:"senderid"`
+		Profile     *Profile `bson:"-"`
 	}
 
 	// Iterate through cursor and decode documents into Message struct
@@ -728,6 +871,7 @@ func getMessageByRecipientID(c *gin.Context) {
 			log.Printf("Error decoding message: %v", err)
 			continue
 		}
+		message.Profile = profileFor(message.SenderID)
 
 		// Log the message
 		// log.Printf("Message received: %v", message)
@@ -736,13 +880,16 @@ func getMessageByRecipientID(c *gin.Context) {
 		messages = append(messages, message)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "purged": purgeInfo(roomname)})
 }
 
 
 func getMessageByType(c *gin.Context) {
 	messageType := c.Param("Type")
 	roomName := c.Param("roomName")
+	if !authorizeRoomRead(c, roomName) {
+		return
+	}
 
 	// Define filter to match message type and room name
 	filter := bson.M{"type": messageType, "roomname": roomName}
@@ -776,10 +923,12 @@ func getMessageByType(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "purged": purgeInfo(roomName)})
 }
 func main() {
+	initAuth()
 	initMongoDB()
+	go runRetentionJanitor()
 
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
@@ -792,18 +941,43 @@ func main() {
 		}
 		c.Next()
 	})
+	r.Use(authenticate)
+	// Everything that changes rooms or messages needs chat:write, the
+	// WebSocket checks it per message instead
+	writeAccess := requireScope(scopeChatWrite)
 
-	r.POST("/create", createRoomAndUser) // New API for room and user creation
-	r.GET("/ws", serveWs)                // Existing API for sending and receiving data
+	r.POST("/create", writeAccess, createRoomAndUser) // New API for room and user creation
+	r.GET("/ws", serveWs)                             // Existing API for sending and receiving data
 	r.GET("/rooms", listRooms)
 	r.GET("/clients", getClientsInRoom)
-	r.DELETE("/deleteuser", deleteUserFromRoom)
+	r.DELETE("/deleteuser", writeAccess, deleteUserFromRoom)
 	r.GET("/recievemessages/:roomName", getMessageByRecipientID)
 	r.GET("/recieveType/:roomName/:Type", getMessageByType)
-	r.POST("/recievemessages", saveMessage)
-	r.POST("/createaddspecificuser", createRoomAndAddUsers)
+	r.POST("/recievemessages", writeAccess, saveMessage)
+	r.POST("/createaddspecificuser", writeAccess, createRoomAndAddUsers)
 	r.GET("/getspecificuserroom", listSpecificRooms)
 	r.GET("/getspecificuerclients", getSpecificClientsInRoom)
+	r.GET("/conversations", listConversations)
+	r.POST("/conversations", writeAccess, openConversation)
+	r.POST("/conversations/:id/read", markConversationRead)
+	r.POST("/conversations/group", writeAccess, createGroupConversation)
+	r.POST("/conversations/:id/members", writeAccess, addConversationMembers)
+	r.POST("/rooms/members", writeAccess, addRoomMember)
+	r.POST("/rooms/invites", writeAccess, createInvite)
+	r.GET("/invites/:token", getInvite)
+	r.POST("/invites/:token", writeAccess, acceptInvite)
+	r.DELETE("/invites/:token", writeAccess, revokeInvite)
+	r.POST("/rooms", writeAccess, createRoom)
+	r.GET("/rooms/:id", getRoom)
+	r.PATCH("/rooms/:id", writeAccess, updateRoom)
+	r.DELETE("/rooms/:id", writeAccess, deleteRoom)
+	r.POST("/rooms/:id/avatar", writeAccess, uploadRoomAvatar)
+	r.GET("/rooms/:id/export", exportRoom)
+	r.POST("/rooms/import", writeAccess, importRoom)
+	r.GET("/retention/:room", getRetention)
+	r.GET("/legalholds", requireAdmin, listLegalHolds)
+	r.PUT("/legalholds/:room", requireAdmin, placeLegalHold)
+	r.DELETE("/legalholds/:room", requireAdmin, releaseLegalHold)
 	log.Println("WebSocket server started on :8000")
 	if err := r.Run(":8000"); err != nil {
 		log.Fatalf("ListenAndServe: %v", err)
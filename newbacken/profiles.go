@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	profileCacheTTL      = 5 * time.Minute
+	profileFailureTTL    = time.Minute // how long a failed lookup isn't retried
+	profileLookupTimeout = 2 * time.Second
+)
+
+// Profile is the public profile sessionAuth keeps for a user, attached to
+// messages so clients can show names and avatars.
+type Profile struct {
+	ID          string `json:"id"`
+	Firstname   string `json:"firstname"`
+	Lastname    string `json:"lastname"`
+	DisplayName string `json:"displayname"`
+	Status      string `json:"status"`
+	Timezone    string `json:"timezone"`
+	AvatarURL   string `json:"avatarurl"`
+}
+
+type cachedProfile struct {
+	profile *Profile
+	expires time.Time
+}
+
+// profiles caches profiles by user ID, so that sending a message doesn't
+// need a request to sessionAuth every time.
+var profiles = struct {
+	mu      sync.Mutex
+	entries map[string]cachedProfile
+}{entries: make(map[string]cachedProfile)}
+
+// profileFor returns the user's profile, or nil when AUTH_URL is unset or
+// sessionAuth doesn't know the user. Lookups that fail are cached for a
+// while too, so a sessionAuth outage doesn't slow down every message.
+func profileFor(userID string) *Profile {
+	authURL := strings.TrimRight(getenv("AUTH_URL", ""), "/")
+	if authURL == "" || userID == "" {
+		return nil
+	}
+	now := time.Now()
+	profiles.mu.Lock()
+	entry, ok := profiles.entries[userID]
+	profiles.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.profile
+	}
+
+	profile, err := fetchProfile(authURL, userID)
+	expires := now.Add(profileCacheTTL)
+	if err != nil {
+		log.Printf("Failed to fetch the profile of '%s': %v", userID, err)
+		// Keep showing what we had rather than nothing
+		profile, expires = entry.profile, now.Add(profileFailureTTL)
+	}
+	profiles.mu.Lock()
+	profiles.entries[userID] = cachedProfile{profile: profile, expires: expires}
+	profiles.mu.Unlock()
+	return profile
+}
+
+func fetchProfile(authURL, userID string) (*Profile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), profileLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authURL+"/users/"+url.PathEscape(userID)+"/profile", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sessionAuth responded with %s", resp.Status)
+	}
+	var profile Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
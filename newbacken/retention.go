@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Global retention, used for rooms that don't set their own and for
+// conversations. Zero keeps messages forever.
+var (
+	retentionDays     = getenvInt("RETENTION_DAYS", 0)
+	retentionMessages = getenvInt("RETENTION_MESSAGES", 0)
+	retentionInterval = getenvDuration("RETENTION_INTERVAL", time.Hour)
+
+	// adminToken guards the legal hold endpoints. They are disabled if unset.
+	adminToken = getenv("ADMIN_TOKEN", "")
+)
+
+// RetentionPolicy says which messages of a room may be deleted.
+type RetentionPolicy struct {
+	Days     int `json:"days"`
+	Messages int `json:"messages"`
+}
+
+// PurgeRecord remembers that old messages of a room were deleted, so that the
+// history endpoints can tell clients why history ends where it does.
+type PurgeRecord struct {
+	Room         string    `json:"room" bson:"room"`
+	PurgedBefore time.Time `json:"purgedbefore" bson:"purgedbefore"`
+	Purged       int64     `json:"purged" bson:"purged"`
+	LastPurgeAt  time.Time `json:"lastpurgeat" bson:"lastpurgeat"`
+}
+
+type LegalHold struct {
+	Room      string    `json:"room" bson:"room"`
+	Reason    string    `json:"reason" bson:"reason"`
+	CreatedAt time.Time `json:"createdat" bson:"createdat"`
+}
+
+func getenvInt(key string, fallback int) int {
+	value := getenv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := getenv(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// retentionPolicy returns the policy of a room: its own settings if it has
+// any, the global policy otherwise.
+func retentionPolicy(roomName string) RetentionPolicy {
+	policy := RetentionPolicy{Days: retentionDays, Messages: retentionMessages}
+	if room, err := findRoom(roomName); err == nil {
+		if room.Settings.RetentionDays > 0 || room.Settings.RetentionMessages > 0 {
+			policy = RetentionPolicy{Days: room.Settings.RetentionDays, Messages: room.Settings.RetentionMessages}
+		}
+	}
+	return policy
+}
+
+func onLegalHold(roomName string) (bool, error) {
+	err := legalHoldsCol.FindOne(ctx, bson.M{"room": roomName}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runRetentionJanitor periodically deletes messages that fall outside their
+// room's retention policy. Rooms on legal hold are left alone.
+func runRetentionJanitor() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		for _, col := range []*mongo.Collection{recieveMessagesCol, messagesCol} {
+			if err := purgeCollection(col); err != nil {
+				log.Printf("Retention run on '%s' failed: %v", col.Name(), err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func purgeCollection(col *mongo.Collection) error {
+	rooms, err := col.Distinct(ctx, "roomname", bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, value := range rooms {
+		roomName, ok := value.(string)
+		if !ok {
+			continue
+		}
+		held, err := onLegalHold(roomName)
+		if err != nil {
+			return err
+		}
+		if held {
+			continue
+		}
+		if err := purgeRoom(col, roomName, retentionPolicy(roomName)); err != nil {
+			log.Printf("Failed to apply retention to '%s': %v", roomName, err)
+		}
+	}
+	return nil
+}
+
+// purgeRoom deletes the messages of a room that the policy doesn't keep. The
+// ObjectIDs carry the insert time, so older messages without a createdat
+// field are covered too.
+func purgeRoom(col *mongo.Collection, roomName string, policy RetentionPolicy) error {
+	var cutoff primitive.ObjectID
+
+	if policy.Days > 0 {
+		cutoff = primitive.NewObjectIDFromTimestamp(time.Now().AddDate(0, 0, -policy.Days))
+	}
+	if policy.Messages > 0 {
+		// The oldest message that is still kept
+		var oldestKept struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(int64(policy.Messages - 1))
+		err := col.FindOne(ctx, bson.M{"roomname": roomName}, opts).Decode(&oldestKept)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err == nil && bytes.Compare(oldestKept.ID[:], cutoff[:]) > 0 {
+			cutoff = oldestKept.ID
+		}
+	}
+	if cutoff.IsZero() {
+		return nil
+	}
+
+	res, err := col.DeleteMany(ctx, bson.M{"roomname": roomName, "_id": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return nil
+	}
+	log.Printf("Deleted %d messages from '%s' in '%s'", res.DeletedCount, roomName, col.Name())
+
+	_, err = purgesCol.UpdateOne(ctx,
+		bson.M{"room": roomName},
+		bson.M{
+			"$max": bson.M{"purgedbefore": cutoff.Timestamp()},
+			"$inc": bson.M{"purged": res.DeletedCount},
+			"$set": bson.M{"lastpurgeat": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// purgeInfo returns what the history endpoints report about deleted
+// messages, or nil if nothing was ever purged from the room.
+func purgeInfo(roomName string) *PurgeRecord {
+	var record PurgeRecord
+	if err := purgesCol.FindOne(ctx, bson.M{"room": roomName}).Decode(&record); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to look up purges of '%s': %v", roomName, err)
+		}
+		return nil
+	}
+	return &record
+}
+
+// requireAdmin only lets requests with the admin token through. The token is
+// compared in constant time, so response times don't give it away.
+func requireAdmin(c *gin.Context) {
+	given := c.GetHeader("X-Admin-Token")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin token required"})
+		return
+	}
+	c.Next()
+}
+
+// getRetention shows how long the room's messages are kept, to the people
+// who can read them.
+func getRetention(c *gin.Context) {
+	roomName := c.Param("room")
+	if !authorizeRoomRead(c, roomName) {
+		return
+	}
+	held, err := onLegalHold(roomName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve legal hold"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"policy":    retentionPolicy(roomName),
+		"legalhold": held,
+		"purged":    purgeInfo(roomName),
+	})
+}
+
+func listLegalHolds(c *gin.Context) {
+	cursor, err := legalHoldsCol.Find(ctx, bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve legal holds"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	holds := []LegalHold{}
+	if err := cursor.All(ctx, &holds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode legal holds"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"legalholds": holds})
+}
+
+func placeLegalHold(c *gin.Context) {
+	roomName := c.Param("room")
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	_, err := legalHoldsCol.UpdateOne(ctx,
+		bson.M{"room": roomName},
+		bson.M{
+			"$set":         bson.M{"reason": req.Reason},
+			"$setOnInsert": bson.M{"room": roomName, "createdat": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Failed to place legal hold on '%s': %v", roomName, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to place legal hold"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Legal hold placed"})
+}
+
+func releaseLegalHold(c *gin.Context) {
+	res, err := legalHoldsCol.DeleteOne(ctx, bson.M{"room": c.Param("room")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release legal hold"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Legal hold not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Legal hold released"})
+}
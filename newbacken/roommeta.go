@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/my/verifier"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxRoomNameLength        = 100
+	maxRoomTopicLength       = 250
+	maxRoomDescriptionLength = 2000
+	maxAvatarSize            = 5 << 20 // 5 MB
+)
+
+// fileServiceURL is where the fileChunksUpload service listens.
+var fileServiceURL = getenv("FILE_SERVICE_URL", "http://localhost:8070")
+
+// RoomSettings are the per-room settings. Zero means the setting is off.
+type RoomSettings struct {
+	RetentionDays     int `json:"retentiondays" bson:"retentiondays"`         // delete messages older than this
+	RetentionMessages int `json:"retentionmessages" bson:"retentionmessages"` // keep only the newest messages
+	SlowModeSeconds   int `json:"slowmodeseconds" bson:"slowmodeseconds"`     // minimum time between messages of a client
+}
+
+func (s RoomSettings) validate() error {
+	if s.RetentionDays < 0 || s.RetentionMessages < 0 || s.SlowModeSeconds < 0 {
+		return fmt.Errorf("settings must not be negative")
+	}
+	return nil
+}
+
+// migrateRooms gives rooms created before rooms had IDs their name as ID.
+func migrateRooms() error {
+	_, err := roomsCol.UpdateMany(ctx,
+		bson.M{"id": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"id": "$name"}}}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = roomsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// slowModeWait applies the room's slow mode. It returns how long the client
+// still has to wait, or zero if the message may be sent now.
+func (r *Room) slowModeWait(clientID string, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.slowMode <= 0 {
+		return 0
+	}
+	if last, ok := r.lastSent[clientID]; ok {
+		if wait := r.slowMode - now.Sub(last); wait > 0 {
+			return wait
+		}
+	}
+	r.lastSent[clientID] = now
+	return 0
+}
+
+// notify sends a message from the server to this client only.
+func (c *Client) notify(msgType, content string) {
+	jsonMessage, err := json.Marshal(bson.M{
+		"Room":        c.room.name,
+		"Sender":      "system",
+		"Content":     content,
+		"RecipientID": c.id,
+		"Type":        msgType,
+		"Time":        time.Now().Format("02-01-2006T03:04:05.000PM07:00"),
+	})
+	if err != nil {
+		log.Printf("Error marshalling message: %v", err)
+		return
+	}
+	// The send channel is closed once the client left the room
+	c.room.mu.Lock()
+	defer c.room.mu.Unlock()
+	if !c.room.clients[c] {
+		return
+	}
+	select {
+	case c.send <- jsonMessage:
+	default:
+		log.Printf("Send channel for client ID %s is full or not being read from", c.id)
+	}
+}
+
+func memberRole(room, clientID string) (string, error) {
+	var member bson.M
+	err := membersCol.FindOne(ctx, bson.M{"room": room, "client_id": clientID}).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	role, _ := member["role"].(string)
+	return role, nil
+}
+
+// storeFile uploads the file to the file service on behalf of the caller,
+// whose access token is passed on, and returns its download URL.
+func storeFile(token, filename string, data []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fileServiceURL+"/upload", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("file service responded with %s", resp.Status)
+	}
+	// The file service may store the file under another name than asked for
+	var stored struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil || stored.Filename == "" {
+		return "", fmt.Errorf("file service didn't say where it stored the file")
+	}
+	return fileServiceURL + "/file?filename=" + url.QueryEscape(stored.Filename), nil
+}
+
+func createRoom(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	var req struct {
+		Name        string       `json:"name"`
+		Topic       string       `json:"topic"`
+		Description string       `json:"description"`
+		Visibility  string       `json:"visibility"`
+		Settings    RoomSettings `json:"settings"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room := RoomDoc{
+		Name:        strings.TrimSpace(req.Name),
+		Topic:       strings.TrimSpace(req.Topic),
+		Description: strings.TrimSpace(req.Description),
+		Visibility:  req.Visibility,
+		Settings:    req.Settings,
+		CreatedBy:   clientID,
+		CreatedAt:   time.Now(),
+	}
+	if room.Visibility == "" {
+		room.Visibility = visibilityPublic
+	}
+	if room.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
+		return
+	}
+	if err := validateRoom(room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+	room.ID = id
+
+	if _, err := roomsCol.InsertOne(ctx, room); err != nil {
+		log.Printf("Failed to insert room into MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+	if _, err := addMember(room.ID, clientID, "owner"); err != nil {
+		log.Printf("Failed to add member: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+
+	getOrCreateRoom(room.ID)
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+func validateRoom(room RoomDoc) error {
+	if len(room.Name) > maxRoomNameLength {
+		return fmt.Errorf("room name must be at most %d characters", maxRoomNameLength)
+	}
+	if len(room.Topic) > maxRoomTopicLength {
+		return fmt.Errorf("topic must be at most %d characters", maxRoomTopicLength)
+	}
+	if len(room.Description) > maxRoomDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxRoomDescriptionLength)
+	}
+	if !validVisibility(room.Visibility) {
+		return fmt.Errorf("visibility must be public, private or invite")
+	}
+	return room.Settings.validate()
+}
+
+func getRoom(c *gin.Context) {
+	roomID := c.Param("id")
+	clientID := callerID(c)
+
+	room, err := findRoom(roomID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve room"})
+		return
+	}
+
+	// Private rooms don't exist as far as non-members are concerned
+	if room.roomVisibility() == visibilityPrivate {
+		member, err := isMember(roomID, clientID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+			return
+		}
+		if !member {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+			return
+		}
+	}
+
+	members, err := membersCol.CountDocuments(ctx, bson.M{"room": roomID})
+	if err != nil {
+		log.Printf("Failed to count members of '%s': %v", roomID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"room": room, "members": members})
+}
+
+// updateRoom changes the room metadata. Any member may change the topic,
+// everything else is up to the owner.
+func updateRoom(c *gin.Context) {
+	roomID := c.Param("id")
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	var req struct {
+		Name        *string       `json:"name"`
+		Topic       *string       `json:"topic"`
+		Description *string       `json:"description"`
+		Visibility  *string       `json:"visibility"`
+		Settings    *RoomSettings `json:"settings"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room, err := findRoom(roomID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve room"})
+		return
+	}
+	role, err := memberRole(roomID, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if role == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only room members can change the room"})
+		return
+	}
+	if role != "owner" && (req.Name != nil || req.Description != nil || req.Visibility != nil || req.Settings != nil) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the room owner can change this"})
+		return
+	}
+
+	oldTopic := room.Topic
+	update := bson.M{}
+	if req.Name != nil {
+		room.Name = strings.TrimSpace(*req.Name)
+		if room.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Room name is required"})
+			return
+		}
+		update["name"] = room.Name
+	}
+	if req.Topic != nil {
+		room.Topic = strings.TrimSpace(*req.Topic)
+		update["topic"] = room.Topic
+	}
+	if req.Description != nil {
+		room.Description = strings.TrimSpace(*req.Description)
+		update["description"] = room.Description
+	}
+	if req.Visibility != nil {
+		room.Visibility = *req.Visibility
+		update["visibility"] = room.Visibility
+	}
+	if req.Settings != nil {
+		room.Settings = *req.Settings
+		update["settings"] = room.Settings
+	}
+	room.Visibility = room.roomVisibility()
+	if err := validateRoom(*room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(update) == 0 {
+		c.JSON(http.StatusOK, gin.H{"room": room})
+		return
+	}
+
+	if _, err := roomsCol.UpdateOne(ctx, bson.M{"id": roomID}, bson.M{"$set": update}); err != nil {
+		log.Printf("Failed to update room '%s': %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update room"})
+		return
+	}
+
+	if req.Settings != nil {
+		hub.mu.Lock()
+		if running, ok := hub.rooms[roomID]; ok {
+			running.mu.Lock()
+			running.slowMode = time.Duration(room.Settings.SlowModeSeconds) * time.Second
+			running.mu.Unlock()
+		}
+		hub.mu.Unlock()
+	}
+	if room.Topic != oldTopic {
+		content := fmt.Sprintf("%s changed the topic to %q", clientID, room.Topic)
+		if room.Topic == "" {
+			content = clientID + " cleared the topic"
+		}
+		recordRoomEvent(roomID, "topic", clientID, content)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+func deleteRoom(c *gin.Context) {
+	roomID := c.Param("id")
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	role, err := memberRole(roomID, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if role != "owner" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the room owner can delete the room"})
+		return
+	}
+
+	res, err := roomsCol.DeleteOne(ctx, bson.M{"id": roomID})
+	if err != nil {
+		log.Printf("Failed to delete room '%s' from MongoDB: %v", roomID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete room"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+	for _, col := range []*mongo.Collection{membersCol, clientsCol, invitesCol} {
+		if _, err := col.DeleteMany(ctx, bson.M{"room": roomID}); err != nil {
+			log.Printf("Failed to clean up room '%s': %v", roomID, err)
+		}
+	}
+
+	// Taking the room out of the hub first means nobody can find it anymore
+	// and only we close stop. The room's run loop then disconnects its
+	// clients, and anyone still holding the room sees stop closed.
+	hub.mu.Lock()
+	room, ok := hub.rooms[roomID]
+	delete(hub.rooms, roomID)
+	hub.mu.Unlock()
+	if ok {
+		close(room.stop)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Room deleted"})
+}
+
+func uploadRoomAvatar(c *gin.Context) {
+	roomID := c.Param("id")
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	role, err := memberRole(roomID, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if role != "owner" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the room owner can change the avatar"})
+		return
+	}
+
+	file, _, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar upload failed"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar upload failed"})
+		return
+	}
+	if len(data) > maxAvatarSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar is too large"})
+		return
+	}
+	contentType := http.DetectContentType(data)
+	extensions := map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp"}
+	ext, ok := extensions[contentType]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	filename := fmt.Sprintf("room-%s-%d%s", roomID, time.Now().UnixNano(), ext)
+	token, _ := verifier.TokenFromRequest(c.Request)
+	avatar, err := storeFile(token, filename, data)
+	if err != nil {
+		log.Printf("Failed to store avatar: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	res, err := roomsCol.UpdateOne(ctx, bson.M{"id": roomID}, bson.M{"$set": bson.M{"avatar": avatar}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update room"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"avatar": avatar})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Room visibility settings. Public rooms are listed and open to everyone.
+// Private rooms are only listed for their members, who can add others
+// directly or hand out invitations. Invite-only rooms are listed for
+// everyone but can only be joined with an invitation.
+const (
+	visibilityPublic     = "public"
+	visibilityPrivate    = "private"
+	visibilityInviteOnly = "invite"
+)
+
+var errInviteInvalid = errors.New("invitation is invalid, expired or used up")
+
+// RoomDoc is a room as stored in MongoDB. ID is what clients use to join and
+// what messages and members refer to; Name is only shown to users and can be
+// changed. Rooms created before the two were separated use their name as ID.
+type RoomDoc struct {
+	ID          string       `json:"id" bson:"id"`
+	Name        string       `json:"name" bson:"name"`
+	Topic       string       `json:"topic,omitempty" bson:"topic,omitempty"`
+	Description string       `json:"description,omitempty" bson:"description,omitempty"`
+	Avatar      string       `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	Visibility  string       `json:"visibility" bson:"visibility,omitempty"`
+	Settings    RoomSettings `json:"settings" bson:"settings"`
+	CreatedBy   string       `json:"createdby,omitempty" bson:"createdby,omitempty"`
+	CreatedAt   time.Time    `json:"createdat,omitempty" bson:"createdat,omitempty"`
+}
+
+type Invite struct {
+	Token     string     `json:"token" bson:"token"`
+	Room      string     `json:"room" bson:"room"`
+	CreatedBy string     `json:"createdby" bson:"createdby"`
+	CreatedAt time.Time  `json:"createdat" bson:"createdat"`
+	ExpiresAt *time.Time `json:"expiresat,omitempty" bson:"expiresat"`
+	MaxUses   int        `json:"maxuses" bson:"maxuses"`
+	Uses      int        `json:"uses" bson:"uses"`
+}
+
+func validVisibility(v string) bool {
+	return v == visibilityPublic || v == visibilityPrivate || v == visibilityInviteOnly
+}
+
+// roomVisibility treats rooms created before visibility existed as public.
+func (r RoomDoc) roomVisibility() string {
+	if r.Visibility == "" {
+		return visibilityPublic
+	}
+	return r.Visibility
+}
+
+func findRoom(id string) (*RoomDoc, error) {
+	var room RoomDoc
+	if err := roomsCol.FindOne(ctx, bson.M{"id": id}).Decode(&room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func isMember(room, clientID string) (bool, error) {
+	err := membersCol.FindOne(ctx, bson.M{"room": room, "client_id": clientID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// addMember records the client as a member of the room and reports whether
+// it was not one already.
+func addMember(room, clientID, role string) (bool, error) {
+	res, err := membersCol.UpdateOne(ctx,
+		bson.M{"room": room, "client_id": clientID},
+		bson.M{"$setOnInsert": bson.M{"room": room, "client_id": clientID, "role": role, "joinedat": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// canAccessRoom reports whether the client may connect to and read the room.
+// Conversations are restricted to their members, private and invite-only
+// rooms to theirs.
+func canAccessRoom(roomName, clientID string) (bool, error) {
+	if isConversation(roomName) {
+		err := conversationsCol.FindOne(ctx, bson.M{"id": roomName, "members": clientID}).Err()
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	room, err := findRoom(roomName)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if room.roomVisibility() == visibilityPublic {
+		return true, nil
+	}
+	return isMember(roomName, clientID)
+}
+
+// authorizeRoomRead responds with an error and returns false unless the
+// caller may read the room, the same check serveWs makes before joining.
+// Conversation IDs can be computed by anyone, so for those the caller has to
+// be in the member list.
+func authorizeRoomRead(c *gin.Context, roomName string) bool {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return false
+	}
+	if !callerHasScope(c, scopeChatRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token lacks the chat:read scope"})
+		return false
+	}
+	allowed, err := canAccessRoom(roomName, clientID)
+	if err != nil {
+		log.Printf("Failed to verify access to room '%s': %v", roomName, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this room"})
+		return false
+	}
+	return true
+}
+
+// recordRoomEvent stores a system event in the room history and sends it to
+// everyone connected to the room.
+func recordRoomEvent(roomName, eventType, clientID, content string) {
+	now := time.Now()
+	eventTime := now.Format("02-01-2006T03:04:05.000PM07:00")
+
+	_, err := recieveMessagesCol.InsertOne(ctx, bson.M{
+		"roomname":    roomName,
+		"sender":      "system",
+		"senderid":    clientID,
+		"content":     content,
+		"recipientid": "all",
+		"type":        eventType,
+		"time":        eventTime,
+		"createdat":   now,
+	})
+	if err != nil {
+		log.Printf("Failed to record %s event in '%s': %v", eventType, roomName, err)
+	}
+
+	jsonMessage, err := json.Marshal(bson.M{
+		"Room":        roomName,
+		"Sender":      "system",
+		"Content":     content,
+		"RecipientID": "all",
+		"Type":        eventType,
+		"Time":        eventTime,
+	})
+	if err != nil {
+		log.Printf("Error marshalling event: %v", err)
+		return
+	}
+
+	hub.mu.Lock()
+	room, ok := hub.rooms[roomName]
+	hub.mu.Unlock()
+	if ok {
+		broadcastToRoom(room, jsonMessage)
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// useInvite consumes one use of the invitation and returns the room it is for.
+// If room is not empty the invitation must be for that room.
+func useInvite(token, room string) (string, error) {
+	now := time.Now()
+	filter := bson.M{
+		"token": token,
+		"$and": []bson.M{
+			{"$or": []bson.M{{"expiresat": nil}, {"expiresat": bson.M{"$gt": now}}}},
+			{"$or": []bson.M{{"maxuses": 0}, {"$expr": bson.M{"$lt": []string{"$uses", "$maxuses"}}}}},
+		},
+	}
+	if room != "" {
+		filter["room"] = room
+	}
+
+	var invite Invite
+	err := invitesCol.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"uses": 1}}).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return "", errInviteInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	return invite.Room, nil
+}
+
+func createInvite(c *gin.Context) {
+	roomName := c.Query("room")
+	clientID := callerID(c)
+	if roomName == "" || clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Room name and client ID are required"})
+		return
+	}
+
+	var req struct {
+		ExpiresIn int `json:"expiresin"` // seconds, 0 for no expiry
+		MaxUses   int `json:"maxuses"`   // 0 for unlimited
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry and use limit must not be negative"})
+		return
+	}
+
+	if _, err := findRoom(roomName); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve room"})
+		}
+		return
+	}
+	member, err := isMember(roomName, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only room members can invite"})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+	invite := Invite{
+		Token:     token,
+		Room:      roomName,
+		CreatedBy: clientID,
+		CreatedAt: time.Now(),
+		MaxUses:   req.MaxUses,
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := invite.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	if _, err := invitesCol.InsertOne(ctx, invite); err != nil {
+		log.Printf("Failed to insert invitation into MongoDB: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invite": invite, "link": "/invites/" + token})
+}
+
+func getInvite(c *gin.Context) {
+	var invite Invite
+	err := invitesCol.FindOne(ctx, bson.M{"token": c.Param("token")}).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invitation"})
+		return
+	}
+
+	valid := (invite.ExpiresAt == nil || invite.ExpiresAt.After(time.Now())) &&
+		(invite.MaxUses == 0 || invite.Uses < invite.MaxUses)
+	c.JSON(http.StatusOK, gin.H{"room": invite.Room, "expiresat": invite.ExpiresAt, "valid": valid})
+}
+
+func acceptInvite(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	roomName, err := useInvite(c.Param("token"), "")
+	if err == errInviteInvalid {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to use invitation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+		return
+	}
+
+	joined, err := addMember(roomName, clientID, "member")
+	if err != nil {
+		log.Printf("Failed to add member: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+		return
+	}
+	if joined {
+		recordRoomEvent(roomName, "membership", clientID, clientID+" joined the room")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted", "room": roomName})
+}
+
+func revokeInvite(c *gin.Context) {
+	clientID := callerID(c)
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client ID is required"})
+		return
+	}
+
+	var invite Invite
+	err := invitesCol.FindOne(ctx, bson.M{"token": c.Param("token")}).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invitation"})
+		return
+	}
+	member, err := isMember(invite.Room, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only room members can revoke invitations"})
+		return
+	}
+
+	if _, err := invitesCol.DeleteOne(ctx, bson.M{"token": invite.Token}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// addRoomMember lets a member of a private room add someone else directly.
+func addRoomMember(c *gin.Context) {
+	roomName := c.Query("room")
+	clientID := callerID(c)
+	memberID := c.Query("member")
+	if roomName == "" || clientID == "" || memberID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Room name, client ID and member ID are required"})
+		return
+	}
+
+	room, err := findRoom(roomName)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve room"})
+		return
+	}
+	if room.roomVisibility() == visibilityInviteOnly {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invite-only rooms can only be joined with an invitation"})
+		return
+	}
+	member, err := isMember(roomName, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client"})
+		return
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only room members can add members"})
+		return
+	}
+
+	joined, err := addMember(roomName, memberID, "member")
+	if err != nil {
+		log.Printf("Failed to add member: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+		return
+	}
+	if joined {
+		recordRoomEvent(roomName, "membership", memberID, memberID+" was added by "+clientID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member added"})
+}
@@ -0,0 +1,89 @@
+// Package avatars turns uploaded pictures into square profile pictures.
+package avatars
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+)
+
+const (
+	// Size is the width and height of avatars. Smaller pictures keep their
+	// size, they are only cropped.
+	Size = 256
+	// MaxPixels limits the pictures that are decoded, a small file can
+	// claim to be a huge image.
+	MaxPixels = 40_000_000
+)
+
+var (
+	ErrUnsupported = errors.New("avatars: the picture must be a PNG, JPEG or GIF image")
+	ErrTooLarge    = errors.New("avatars: the picture has too many pixels")
+)
+
+// Process crops the middle square out of a PNG, JPEG or GIF picture, scales
+// it down to Size and returns it as PNG. Only the first frame of animated
+// GIFs is kept.
+func Process(data []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side)
+	src := image.NewRGBA(crop)
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	draw.Draw(src, crop, img, offset, draw.Src)
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, shrink(src, min(side, Size))); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// shrink scales the square src down to size by averaging the pixels each
+// destination pixel covers. RGBA is premultiplied, so averaging it keeps the
+// colors of transparent edges right.
+func shrink(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	if side == size {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				p[i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKeyPrefix starts every API key, so they can be told apart from other
+// tokens and spotted by secret scanners.
+const APIKeyPrefix = "cak_"
+
+// APIKey is a long-lived credential a user creates for scripts and bots. The
+// key itself is only shown once and stored hashed.
+type APIKey struct {
+	ID      string `json:"id" bson:"id"`
+	KeyHash string `json:"-" bson:"keyhash"`
+	UserID  string `json:"userid" bson:"userid"`
+	Name    string `json:"name" bson:"name"`
+	// Hint is the start of the key, so the user can tell which one it is.
+	Hint       string     `json:"hint" bson:"hint"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time  `json:"createdat" bson:"createdat"`
+	LastUsedAt *time.Time `json:"lastusedat,omitempty" bson:"lastusedat,omitempty"`
+	// ExpiresAt is nil for keys that don't expire.
+	ExpiresAt *time.Time `json:"expiresat,omitempty" bson:"expiresat,omitempty"`
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+// APIKeyStore keeps API keys, hashed. Lookups never return expired keys.
+type APIKeyStore interface {
+	Create(ctx context.Context, k *APIKey) error
+	FindByKey(ctx context.Context, key string) (*APIKey, error)
+	Touch(ctx context.Context, id string, at time.Time) error
+	ListByUser(ctx context.Context, userID string) ([]APIKey, error)
+	// Delete revokes a key of the user.
+	Delete(ctx context.Context, userID, id string) error
+	DeleteByUser(ctx context.Context, userID string) error
+}
+
+type mongoAPIKeyStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoAPIKeyStore returns a store backed by the collection. Expired keys
+// are removed by a TTL index.
+func NewMongoAPIKeyStore(col *mongo.Collection) (APIKeyStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "keyhash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoAPIKeyStore{col: col}, nil
+}
+
+// notExpired matches keys without an expiry and keys the TTL monitor hasn't
+// removed yet.
+func notExpired() bson.M {
+	return bson.M{"$not": bson.M{"$lte": time.Now()}}
+}
+
+func (m *mongoAPIKeyStore) Create(ctx context.Context, k *APIKey) error {
+	_, err := m.col.InsertOne(ctx, k)
+	return err
+}
+
+func (m *mongoAPIKeyStore) FindByKey(ctx context.Context, key string) (*APIKey, error) {
+	var k APIKey
+	err := m.col.FindOne(ctx, bson.M{"keyhash": HashToken(key), "expiresat": notExpired()}).Decode(&k)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (m *mongoAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	_, err := m.col.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"lastusedat": at}})
+	return err
+}
+
+func (m *mongoAPIKeyStore) ListByUser(ctx context.Context, userID string) ([]APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+	cursor, err := m.col.Find(ctx, bson.M{"userid": userID, "expiresat": notExpired()}, opts)
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *mongoAPIKeyStore) Delete(ctx context.Context, userID, id string) error {
+	res, err := m.col.DeleteOne(ctx, bson.M{"id": id, "userid": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (m *mongoAPIKeyStore) DeleteByUser(ctx context.Context, userID string) error {
+	_, err := m.col.DeleteMany(ctx, bson.M{"userid": userID})
+	return err
+}
+
+type memoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]APIKey
+}
+
+// NewMemoryAPIKeyStore returns a store that keeps API keys in memory.
+func NewMemoryAPIKeyStore() APIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (m *memoryAPIKeyStore) Create(ctx context.Context, k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[k.ID] = *k
+	return nil
+}
+
+func (m *memoryAPIKeyStore) FindByKey(ctx context.Context, key string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := HashToken(key)
+	for _, k := range m.keys {
+		if k.KeyHash == hash && !k.expired(time.Now()) {
+			return &k, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.keys[id]; ok {
+		k.LastUsedAt = &at
+		m.keys[id] = k
+	}
+	return nil
+}
+
+func (m *memoryAPIKeyStore) ListByUser(ctx context.Context, userID string) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []APIKey{}
+	for _, k := range m.keys {
+		if k.UserID == userID && !k.expired(time.Now()) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *memoryAPIKeyStore) Delete(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.keys[id]; !ok || k.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *memoryAPIKeyStore) DeleteByUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, k := range m.keys {
+		if k.UserID == userID {
+			delete(m.keys, id)
+		}
+	}
+	return nil
+}
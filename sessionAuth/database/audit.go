@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Types of audit events.
+const (
+	AuditRegistered      = "registered"
+	AuditLoginSucceeded  = "login_succeeded"
+	AuditLoginFailed     = "login_failed"
+	AuditLogout          = "logout"
+	AuditPasswordChanged = "password_changed"
+	AuditSessionRevoked  = "session_revoked"
+	AuditRoleChanged     = "role_changed"
+	AuditDataExported    = "data_exported"
+	AuditAccountDeleted  = "account_deleted"
+)
+
+// ValidAuditType reports whether t is one of the audit event types.
+func ValidAuditType(t string) bool {
+	switch t {
+	case AuditRegistered, AuditLoginSucceeded, AuditLoginFailed, AuditLogout,
+		AuditPasswordChanged, AuditSessionRevoked, AuditRoleChanged, AuditDataExported,
+		AuditAccountDeleted:
+		return true
+	}
+	return false
+}
+
+// AuditEvent records something security relevant that happened to an
+// account. Events are never changed or removed once written.
+type AuditEvent struct {
+	ID   string `json:"id" bson:"id"`
+	Type string `json:"type" bson:"type"`
+	// UserID is the account the event is about. It is empty for failed
+	// logins with an unknown email address.
+	UserID string `json:"userid,omitempty" bson:"userid,omitempty"`
+	// ActorID is who caused the event when it wasn't the user, such as the
+	// admin who changed their role.
+	ActorID   string `json:"actorid,omitempty" bson:"actorid,omitempty"`
+	Email     string `json:"email,omitempty" bson:"email,omitempty"`
+	IP        string `json:"ip" bson:"ip"`
+	UserAgent string `json:"useragent" bson:"useragent"`
+	RequestID string `json:"requestid" bson:"requestid"`
+	// Details says more about the event, such as why a login failed.
+	Details   map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt time.Time         `json:"createdat" bson:"createdat"`
+}
+
+// AuditFilter selects audit events. Empty fields match everything.
+type AuditFilter struct {
+	UserID string
+	Type   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) matches(e *AuditEvent) bool {
+	return (f.UserID == "" || e.UserID == f.UserID || e.ActorID == f.UserID) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Since.IsZero() || !e.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || e.CreatedAt.Before(f.Until))
+}
+
+// AuditStore is an append-only log of audit events.
+type AuditStore interface {
+	Append(ctx context.Context, e *AuditEvent) error
+	// List returns the matching events, newest first.
+	List(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+}
+
+type mongoAuditStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoAuditStore returns a store backed by the collection.
+func NewMongoAuditStore(col *mongo.Collection) (AuditStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "actorid", Value: 1}, {Key: "createdat", Value: -1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "createdat", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoAuditStore{col: col}, nil
+}
+
+func (m *mongoAuditStore) Append(ctx context.Context, e *AuditEvent) error {
+	_, err := m.col.InsertOne(ctx, e)
+	return err
+}
+
+func (m *mongoAuditStore) List(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	filter := bson.M{}
+	if f.UserID != "" {
+		filter["$or"] = bson.A{bson.M{"userid": f.UserID}, bson.M{"actorid": f.UserID}}
+	}
+	if f.Type != "" {
+		filter["type"] = f.Type
+	}
+	created := bson.M{}
+	if !f.Since.IsZero() {
+		created["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		created["$lt"] = f.Until
+	}
+	if len(created) > 0 {
+		filter["createdat"] = created
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}})
+	if f.Limit > 0 {
+		opts.SetLimit(int64(f.Limit))
+	}
+	cursor, err := m.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+type memoryAuditStore struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditStore returns a store that keeps audit events in memory.
+func NewMemoryAuditStore() AuditStore {
+	return &memoryAuditStore{}
+}
+
+func (m *memoryAuditStore) Append(ctx context.Context, e *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, *e)
+	return nil
+}
+
+func (m *memoryAuditStore) List(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []AuditEvent{}
+	// Events are appended in order, so walking backwards gives newest first
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(events) == f.Limit {
+			break
+		}
+		if f.matches(&m.events[i]) {
+			events = append(events, m.events[i])
+		}
+	}
+	return events, nil
+}
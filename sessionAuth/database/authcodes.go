@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found")
+	// ErrAuthorizationCodeUsed is returned along with the code when it was
+	// already exchanged, so the tokens issued for it can be revoked.
+	ErrAuthorizationCodeUsed = errors.New("authorization code already used")
+)
+
+// AuthorizationCode is handed to an OAuth client through the browser after
+// the user allowed it access, and exchanged by the client for tokens.
+type AuthorizationCode struct {
+	ID          string   `json:"id" bson:"id"`
+	CodeHash    string   `json:"-" bson:"codehash"`
+	ClientID    string   `json:"clientid" bson:"clientid"`
+	UserID      string   `json:"userid" bson:"userid"`
+	RedirectURI string   `json:"redirecturi" bson:"redirecturi"`
+	Scopes      []string `json:"scopes" bson:"scopes"`
+	// CodeChallenge is the S256 PKCE challenge the client sent.
+	CodeChallenge string `json:"-" bson:"codechallenge"`
+	// FamilyID is given to the refresh tokens issued for the code.
+	FamilyID  string     `json:"familyid" bson:"familyid"`
+	CreatedAt time.Time  `json:"createdat" bson:"createdat"`
+	ExpiresAt time.Time  `json:"expiresat" bson:"expiresat"`
+	UsedAt    *time.Time `json:"usedat,omitempty" bson:"usedat"`
+}
+
+// AuthorizationCodeStore keeps authorization codes, hashed.
+type AuthorizationCodeStore interface {
+	Create(ctx context.Context, code *AuthorizationCode) error
+	// Consume marks an unused, unexpired code as used and returns it. Two
+	// concurrent calls can't both succeed.
+	Consume(ctx context.Context, code string) (*AuthorizationCode, error)
+}
+
+type mongoAuthorizationCodeStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoAuthorizationCodeStore returns a store backed by the collection.
+// Expired codes are removed by a TTL index.
+func NewMongoAuthorizationCodeStore(col *mongo.Collection) (AuthorizationCodeStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "codehash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoAuthorizationCodeStore{col: col}, nil
+}
+
+func (m *mongoAuthorizationCodeStore) Create(ctx context.Context, code *AuthorizationCode) error {
+	_, err := m.col.InsertOne(ctx, code)
+	return err
+}
+
+func (m *mongoAuthorizationCodeStore) Consume(ctx context.Context, code string) (*AuthorizationCode, error) {
+	now := time.Now()
+	hash := HashToken(code)
+	var c AuthorizationCode
+	err := m.col.FindOneAndUpdate(ctx,
+		bson.M{"codehash": hash, "usedat": nil, "expiresat": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"usedat": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&c)
+	if err == nil {
+		return &c, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if err := m.col.FindOne(ctx, bson.M{"codehash": hash, "expiresat": bson.M{"$gt": now}}).Decode(&c); err == nil {
+		return &c, ErrAuthorizationCodeUsed
+	}
+	return nil, ErrAuthorizationCodeNotFound
+}
+
+type memoryAuthorizationCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]AuthorizationCode
+}
+
+// NewMemoryAuthorizationCodeStore returns a store that keeps codes in memory.
+func NewMemoryAuthorizationCodeStore() AuthorizationCodeStore {
+	return &memoryAuthorizationCodeStore{codes: make(map[string]AuthorizationCode)}
+}
+
+func (m *memoryAuthorizationCodeStore) Create(ctx context.Context, code *AuthorizationCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code.CodeHash] = *code
+	return nil
+}
+
+func (m *memoryAuthorizationCodeStore) Consume(ctx context.Context, code string) (*AuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	c, ok := m.codes[HashToken(code)]
+	if !ok || !c.ExpiresAt.After(now) {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	if c.UsedAt != nil {
+		return &c, ErrAuthorizationCodeUsed
+	}
+	c.UsedAt = &now
+	m.codes[c.CodeHash] = c
+	return &c, nil
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeletedUserName replaces the name of deleted users on their chat messages.
+const DeletedUserName = "Deleted user"
+
+// ChatMessage is a message as the chat service stores it.
+type ChatMessage struct {
+	RoomName    string    `json:"roomname" bson:"roomname"`
+	Sender      string    `json:"sender" bson:"sender"`
+	Content     string    `json:"content" bson:"content"`
+	RecipientID string    `json:"recipientid" bson:"recipientid"`
+	Type        string    `json:"type" bson:"type"`
+	Time        string    `json:"time" bson:"time"`
+	CreatedAt   time.Time `json:"createdat,omitempty" bson:"createdat,omitempty"`
+}
+
+// ChatRoom is the part of a chat room a data export needs.
+type ChatRoom struct {
+	ID     string `json:"id" bson:"id"`
+	Name   string `json:"name" bson:"name"`
+	Avatar string `json:"avatar,omitempty" bson:"avatar,omitempty"`
+}
+
+// ChatStore reaches into the data of the chat service, which runs on the same
+// MongoDB server.
+type ChatStore interface {
+	// AnonymizeUser removes a deleted user from the chat service. Their
+	// messages stay, so conversations still make sense to the other people
+	// in them, but are attributed to an ID that can't be traced back.
+	AnonymizeUser(ctx context.Context, userID string) error
+	// MessagesBySender calls fn with every message the user sent, oldest
+	// first, and stops at the first error fn returns.
+	MessagesBySender(ctx context.Context, userID string, fn func(*ChatMessage) error) error
+	// RoomsCreatedBy returns the rooms the user created.
+	RoomsCreatedBy(ctx context.Context, userID string) ([]ChatRoom, error)
+}
+
+type mongoChatStore struct {
+	db *mongo.Database
+}
+
+// NewMongoChatStore returns a store working on the chat service's database.
+func NewMongoChatStore(db *mongo.Database) ChatStore {
+	return &mongoChatStore{db: db}
+}
+
+func (m *mongoChatStore) AnonymizeUser(ctx context.Context, userID string) error {
+	anonymous := "deleted-" + uuid.New().String()
+
+	messages := m.db.Collection("recievemessages")
+	if _, err := messages.UpdateMany(ctx, bson.M{"senderid": userID}, bson.M{"$set": bson.M{"senderid": anonymous, "sender": DeletedUserName}}); err != nil {
+		return err
+	}
+	if _, err := messages.UpdateMany(ctx, bson.M{"recipientid": userID}, bson.M{"$set": bson.M{"recipientid": anonymous}}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection("conversations").UpdateMany(ctx, bson.M{"members": userID}, bson.M{"$set": bson.M{"members.$": anonymous}}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection("rooms").UpdateMany(ctx, bson.M{"createdby": userID}, bson.M{"$set": bson.M{"createdby": anonymous}}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection("invites").DeleteMany(ctx, bson.M{"createdby": userID}); err != nil {
+		return err
+	}
+	for _, name := range []string{"members", "clients", "conversationreads"} {
+		if _, err := m.db.Collection(name).DeleteMany(ctx, bson.M{"client_id": userID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mongoChatStore) MessagesBySender(ctx context.Context, userID string, fn func(*ChatMessage) error) error {
+	// Older messages have no creation time, but their ObjectIDs are in order
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := m.db.Collection("recievemessages").Find(ctx, bson.M{"senderid": userID}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var msg ChatMessage
+		if err := cursor.Decode(&msg); err != nil {
+			return err
+		}
+		if err := fn(&msg); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *mongoChatStore) RoomsCreatedBy(ctx context.Context, userID string) ([]ChatRoom, error) {
+	cursor, err := m.db.Collection("rooms").Find(ctx, bson.M{"createdby": userID})
+	if err != nil {
+		return nil, err
+	}
+	rooms := []ChatRoom{}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+type memoryChatStore struct{}
+
+// NewMemoryChatStore returns a store for setups without the chat service,
+// where there is nothing to clean up or export.
+func NewMemoryChatStore() ChatStore {
+	return memoryChatStore{}
+}
+
+func (memoryChatStore) AnonymizeUser(ctx context.Context, userID string) error {
+	return nil
+}
+
+func (memoryChatStore) MessagesBySender(ctx context.Context, userID string, fn func(*ChatMessage) error) error {
+	return nil
+}
+
+func (memoryChatStore) RoomsCreatedBy(ctx context.Context, userID string) ([]ChatRoom, error) {
+	return []ChatRoom{}, nil
+}
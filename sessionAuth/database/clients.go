@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+
+// OAuth grant types a client can be allowed to use.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OAuthClient is an application registered to get tokens from sessionAuth.
+type OAuthClient struct {
+	ID string `json:"id" bson:"id"`
+	// SecretHash is empty for public clients, such as single page and mobile
+	// apps, which can't keep a secret.
+	SecretHash   string   `json:"-" bson:"secrethash,omitempty"`
+	Name         string   `json:"name" bson:"name"`
+	RedirectURIs []string `json:"redirect_uris" bson:"redirecturis"`
+	// Scopes are the scopes the client may ask for.
+	Scopes     []string `json:"scopes" bson:"scopes"`
+	GrantTypes []string `json:"grant_types" bson:"granttypes"`
+	// FirstParty clients are our own apps, users aren't asked for consent.
+	FirstParty bool      `json:"first_party" bson:"firstparty"`
+	CreatedBy  string    `json:"createdby" bson:"createdby"`
+	CreatedAt  time.Time `json:"createdat" bson:"createdat"`
+}
+
+// Public reports whether the client has no secret.
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AllowsGrant reports whether the client may use the grant type.
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientStore keeps the registered OAuth clients.
+type ClientStore interface {
+	Create(ctx context.Context, c *OAuthClient) error
+	Get(ctx context.Context, id string) (*OAuthClient, error)
+	List(ctx context.Context) ([]OAuthClient, error)
+	Delete(ctx context.Context, id string) error
+}
+
+type mongoClientStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoClientStore returns a store backed by the collection.
+func NewMongoClientStore(col *mongo.Collection) (ClientStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoClientStore{col: col}, nil
+}
+
+func (m *mongoClientStore) Create(ctx context.Context, c *OAuthClient) error {
+	_, err := m.col.InsertOne(ctx, c)
+	return err
+}
+
+func (m *mongoClientStore) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	var c OAuthClient
+	err := m.col.FindOne(ctx, bson.M{"id": id}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (m *mongoClientStore) List(ctx context.Context) ([]OAuthClient, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}})
+	cursor, err := m.col.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	clients := []OAuthClient{}
+	if err := cursor.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (m *mongoClientStore) Delete(ctx context.Context, id string) error {
+	res, err := m.col.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+type memoryClientStore struct {
+	mu      sync.Mutex
+	clients map[string]OAuthClient
+}
+
+// NewMemoryClientStore returns a store that keeps clients in memory.
+func NewMemoryClientStore() ClientStore {
+	return &memoryClientStore{clients: make(map[string]OAuthClient)}
+}
+
+func (m *memoryClientStore) Create(ctx context.Context, c *OAuthClient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[c.ID] = *c
+	return nil
+}
+
+func (m *memoryClientStore) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.clients[id]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return &c, nil
+}
+
+func (m *memoryClientStore) List(ctx context.Context) ([]OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := make([]OAuthClient, 0, len(m.clients))
+	for _, c := range m.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt.Before(clients[j].CreatedAt) })
+	return clients, nil
+}
+
+func (m *memoryClientStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[id]; !ok {
+		return ErrClientNotFound
+	}
+	delete(m.clients, id)
+	return nil
+}
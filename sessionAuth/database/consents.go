@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrConsentNotFound = errors.New("consent not found")
+
+// Consent records the scopes a user allowed an OAuth client, so they aren't
+// asked again every time.
+type Consent struct {
+	UserID    string    `json:"userid" bson:"userid"`
+	ClientID  string    `json:"clientid" bson:"clientid"`
+	Scopes    []string  `json:"scopes" bson:"scopes"`
+	GrantedAt time.Time `json:"grantedat" bson:"grantedat"`
+}
+
+// ConsentStore keeps one consent per user and client.
+type ConsentStore interface {
+	Get(ctx context.Context, userID, clientID string) (*Consent, error)
+	// Save creates or replaces the consent of the user for the client.
+	Save(ctx context.Context, c *Consent) error
+	List(ctx context.Context, userID string) ([]Consent, error)
+	Delete(ctx context.Context, userID, clientID string) error
+	// DeleteByClient removes every consent for a client that is removed.
+	DeleteByClient(ctx context.Context, clientID string) error
+	// DeleteByUser removes every consent of a user whose account is deleted.
+	DeleteByUser(ctx context.Context, userID string) (int64, error)
+}
+
+type mongoConsentStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoConsentStore returns a store backed by the collection.
+func NewMongoConsentStore(col *mongo.Collection) (ConsentStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "clientid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "clientid", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoConsentStore{col: col}, nil
+}
+
+func (m *mongoConsentStore) Get(ctx context.Context, userID, clientID string) (*Consent, error) {
+	var c Consent
+	err := m.col.FindOne(ctx, bson.M{"userid": userID, "clientid": clientID}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrConsentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (m *mongoConsentStore) Save(ctx context.Context, c *Consent) error {
+	_, err := m.col.ReplaceOne(ctx, bson.M{"userid": c.UserID, "clientid": c.ClientID}, c, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *mongoConsentStore) List(ctx context.Context, userID string) ([]Consent, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "grantedat", Value: -1}})
+	cursor, err := m.col.Find(ctx, bson.M{"userid": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	consents := []Consent{}
+	if err := cursor.All(ctx, &consents); err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
+
+func (m *mongoConsentStore) Delete(ctx context.Context, userID, clientID string) error {
+	res, err := m.col.DeleteOne(ctx, bson.M{"userid": userID, "clientid": clientID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrConsentNotFound
+	}
+	return nil
+}
+
+func (m *mongoConsentStore) DeleteByClient(ctx context.Context, clientID string) error {
+	_, err := m.col.DeleteMany(ctx, bson.M{"clientid": clientID})
+	return err
+}
+
+func (m *mongoConsentStore) DeleteByUser(ctx context.Context, userID string) (int64, error) {
+	res, err := m.col.DeleteMany(ctx, bson.M{"userid": userID})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+type memoryConsentStore struct {
+	mu       sync.Mutex
+	consents map[[2]string]Consent
+}
+
+// NewMemoryConsentStore returns a store that keeps consents in memory.
+func NewMemoryConsentStore() ConsentStore {
+	return &memoryConsentStore{consents: make(map[[2]string]Consent)}
+}
+
+func (m *memoryConsentStore) Get(ctx context.Context, userID, clientID string) (*Consent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.consents[[2]string{userID, clientID}]
+	if !ok {
+		return nil, ErrConsentNotFound
+	}
+	return &c, nil
+}
+
+func (m *memoryConsentStore) Save(ctx context.Context, c *Consent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consents[[2]string{c.UserID, c.ClientID}] = *c
+	return nil
+}
+
+func (m *memoryConsentStore) List(ctx context.Context, userID string) ([]Consent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	consents := []Consent{}
+	for _, c := range m.consents {
+		if c.UserID == userID {
+			consents = append(consents, c)
+		}
+	}
+	sort.Slice(consents, func(i, j int) bool { return consents[i].GrantedAt.After(consents[j].GrantedAt) })
+	return consents, nil
+}
+
+func (m *memoryConsentStore) Delete(ctx context.Context, userID, clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{userID, clientID}
+	if _, ok := m.consents[key]; !ok {
+		return ErrConsentNotFound
+	}
+	delete(m.consents, key)
+	return nil
+}
+
+func (m *memoryConsentStore) DeleteByClient(ctx context.Context, clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, c := range m.consents {
+		if c.ClientID == clientID {
+			delete(m.consents, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryConsentStore) DeleteByUser(ctx context.Context, userID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for key, c := range m.consents {
+		if c.UserID == userID {
+			delete(m.consents, key)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -1,3 +1,7 @@
+// Package database persists everything sessionAuth stores. Each store has a
+// MongoDB implementation and one that keeps its data in memory. The memory
+// ones lose everything on restart and aren't shared between instances, so
+// they are for tests and single instance development setups.
 package database
 
 import (
@@ -8,19 +12,108 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 var Client *mongo.Client
-var UserCollection *mongo.Collection
-func ConnectDB() error{
+
+// Config says where sessionAuth keeps its data.
+type Config struct{
+	URI string
+	Name string
+	// ChatName is the database of the chat service, for cleaning up after
+	// deleted users and exporting their messages
+	ChatName string
+}
+
+// Stores holds everything sessionAuth persists.
+type Stores struct{
+	Users UserRepository
+	Sessions SessionStore
+	RefreshTokens RefreshTokenStore
+	OneTimeTokens OneTimeTokenStore
+	LoginAttempts LoginAttemptStore
+	Clients ClientStore
+	AuthorizationCodes AuthorizationCodeStore
+	Consents ConsentStore
+	APIKeys APIKeyStore
+	Audit AuditStore
+	Exports ExportStore
+	Chat ChatStore
+}
+
+func ConnectDB(cfg Config) (*Stores,error){
 	ctx,cancel:=context.WithTimeout(context.Background(),10*time.Second)
 	defer cancel()
-	clientOptions:=options.Client().ApplyURI("mongodb://localhost:27017")
+	clientOptions:=options.Client().ApplyURI(cfg.URI)
 	client,err:=mongo.Connect(ctx,clientOptions)
 	if err!=nil{
-		return err
+		return nil,err
 	}
 	err=client.Ping(ctx,nil)
 	if err!=nil{
-		return err
+		return nil,err
+	}
+	Client=client
+	db:=client.Database(cfg.Name)
+	stores:=&Stores{Chat:NewMongoChatStore(client.Database(cfg.ChatName))}
+	stores.Users,err=NewMongoUserRepository(db.Collection("users"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.Sessions,err=NewMongoSessionStore(db.Collection("sessions"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.RefreshTokens,err=NewMongoRefreshTokenStore(db.Collection("refresh_tokens"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.OneTimeTokens,err=NewMongoOneTimeTokenStore(db.Collection("one_time_tokens"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.LoginAttempts,err=NewMongoLoginAttemptStore(db.Collection("login_attempts"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.Clients,err=NewMongoClientStore(db.Collection("oauth_clients"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.AuthorizationCodes,err=NewMongoAuthorizationCodeStore(db.Collection("oauth_codes"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.Consents,err=NewMongoConsentStore(db.Collection("oauth_consents"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.APIKeys,err=NewMongoAPIKeyStore(db.Collection("api_keys"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.Audit,err=NewMongoAuditStore(db.Collection("audit_events"))
+	if err!=nil{
+		return nil,err
+	}
+	stores.Exports,err=NewMongoExportStore(db.Collection("exports"))
+	if err!=nil{
+		return nil,err
+	}
+	return stores,nil
+}
+
+// NewMemoryStores returns stores that keep everything in memory.
+func NewMemoryStores() *Stores{
+	return &Stores{
+		Users:NewMemoryUserRepository(),
+		Sessions:NewMemorySessionStore(),
+		RefreshTokens:NewMemoryRefreshTokenStore(),
+		OneTimeTokens:NewMemoryOneTimeTokenStore(),
+		LoginAttempts:NewMemoryLoginAttemptStore(),
+		Clients:NewMemoryClientStore(),
+		AuthorizationCodes:NewMemoryAuthorizationCodeStore(),
+		Consents:NewMemoryConsentStore(),
+		APIKeys:NewMemoryAPIKeyStore(),
+		Audit:NewMemoryAuditStore(),
+		Exports:NewMemoryExportStore(),
+		Chat:NewMemoryChatStore(),
 	}
-	UserCollection=client.Database("my_db").Collection("users")
-	return nil
-}
\ No newline at end of file
+}
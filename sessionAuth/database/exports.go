@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrExportNotFound = errors.New("export not found")
+
+// Statuses of a data export.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is an archive of a user's personal data. It is built in the
+// background and can be downloaded until it expires.
+type Export struct {
+	ID     string `json:"id" bson:"id"`
+	UserID string `json:"userid" bson:"userid"`
+	Status string `json:"status" bson:"status"`
+	// Size is the size of the archive in bytes once it is ready
+	Size        int64      `json:"size,omitempty" bson:"size,omitempty"`
+	CreatedAt   time.Time  `json:"createdat" bson:"createdat"`
+	CompletedAt *time.Time `json:"completedat,omitempty" bson:"completedat,omitempty"`
+	ExpiresAt   time.Time  `json:"expiresat" bson:"expiresat"`
+}
+
+// ExportStore keeps the latest export of each user. The archives themselves
+// are files, so expired exports aren't removed by the store but listed for
+// whoever deletes the files.
+type ExportStore interface {
+	Get(ctx context.Context, userID string) (*Export, error)
+	// Save creates or replaces the export of the user.
+	Save(ctx context.Context, e *Export) error
+	// Delete removes the export of the user if it is still the one with
+	// the ID, and not one that replaced it.
+	Delete(ctx context.Context, userID, id string) error
+	// ListExpired returns the exports that expired before the time.
+	ListExpired(ctx context.Context, before time.Time) ([]Export, error)
+}
+
+type mongoExportStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoExportStore returns a store backed by the collection.
+func NewMongoExportStore(col *mongo.Collection) (ExportStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoExportStore{col: col}, nil
+}
+
+func (m *mongoExportStore) Get(ctx context.Context, userID string) (*Export, error) {
+	var e Export
+	err := m.col.FindOne(ctx, bson.M{"userid": userID}).Decode(&e)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (m *mongoExportStore) Save(ctx context.Context, e *Export) error {
+	_, err := m.col.ReplaceOne(ctx, bson.M{"userid": e.UserID}, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *mongoExportStore) Delete(ctx context.Context, userID, id string) error {
+	_, err := m.col.DeleteOne(ctx, bson.M{"userid": userID, "id": id})
+	return err
+}
+
+func (m *mongoExportStore) ListExpired(ctx context.Context, before time.Time) ([]Export, error) {
+	cursor, err := m.col.Find(ctx, bson.M{"expiresat": bson.M{"$lt": before}})
+	if err != nil {
+		return nil, err
+	}
+	exports := []Export{}
+	if err := cursor.All(ctx, &exports); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+type memoryExportStore struct {
+	mu      sync.Mutex
+	exports map[string]Export
+}
+
+// NewMemoryExportStore returns a store that keeps exports in memory.
+func NewMemoryExportStore() ExportStore {
+	return &memoryExportStore{exports: make(map[string]Export)}
+}
+
+func (m *memoryExportStore) Get(ctx context.Context, userID string) (*Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.exports[userID]
+	if !ok {
+		return nil, ErrExportNotFound
+	}
+	return &e, nil
+}
+
+func (m *memoryExportStore) Save(ctx context.Context, e *Export) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exports[e.UserID] = *e
+	return nil
+}
+
+func (m *memoryExportStore) Delete(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exports[userID].ID == id {
+		delete(m.exports, userID)
+	}
+	return nil
+}
+
+func (m *memoryExportStore) ListExpired(ctx context.Context, before time.Time) ([]Export, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exports := []Export{}
+	for _, e := range m.exports {
+		if e.ExpiresAt.Before(before) {
+			exports = append(exports, e)
+		}
+	}
+	return exports, nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// loginAttemptMemory is how long failed logins are remembered after the last
+// one.
+const loginAttemptMemory = 24 * time.Hour
+
+// LoginAttempt counts the failed logins for an account or a client address.
+// Key is "email:<address>" or "ip:<address>".
+type LoginAttempt struct {
+	Key         string    `json:"key" bson:"key"`
+	Failures    int       `json:"failures" bson:"failures"`
+	LastFailure time.Time `json:"lastfailure" bson:"lastfailure"`
+	LockedUntil time.Time `json:"lockeduntil" bson:"lockeduntil"`
+	ExpiresAt   time.Time `json:"-" bson:"expiresat"`
+}
+
+// LoginAttemptStore keeps failed login counters. Counters are forgotten a day
+// after the last failure.
+type LoginAttemptStore interface {
+	// Get returns the counter for key, which has no failures if there is none.
+	Get(ctx context.Context, key string) (*LoginAttempt, error)
+	// RecordFailure adds a failure and returns the updated counter.
+	RecordFailure(ctx context.Context, key string, at time.Time) (*LoginAttempt, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+	// ListLocked returns the counters that are locked at the given time.
+	ListLocked(ctx context.Context, at time.Time) ([]LoginAttempt, error)
+}
+
+type mongoLoginAttemptStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoLoginAttemptStore returns a store backed by the collection.
+func NewMongoLoginAttemptStore(col *mongo.Collection) (LoginAttemptStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "lockeduntil", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoLoginAttemptStore{col: col}, nil
+}
+
+func (m *mongoLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempt, error) {
+	var a LoginAttempt
+	err := m.col.FindOne(ctx, bson.M{"key": key, "expiresat": bson.M{"$gt": time.Now()}}).Decode(&a)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &LoginAttempt{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (m *mongoLoginAttemptStore) RecordFailure(ctx context.Context, key string, at time.Time) (*LoginAttempt, error) {
+	update := bson.M{
+		"$inc":         bson.M{"failures": 1},
+		"$set":         bson.M{"lastfailure": at, "expiresat": at.Add(loginAttemptMemory)},
+		"$setOnInsert": bson.M{"lockeduntil": time.Time{}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var a LoginAttempt
+	if err := m.col.FindOneAndUpdate(ctx, bson.M{"key": key}, update, opts).Decode(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (m *mongoLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := m.col.UpdateOne(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{"lockeduntil": until}})
+	return err
+}
+
+func (m *mongoLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := m.col.DeleteOne(ctx, bson.M{"key": key})
+	return err
+}
+
+func (m *mongoLoginAttemptStore) ListLocked(ctx context.Context, at time.Time) ([]LoginAttempt, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "lockeduntil", Value: -1}})
+	cursor, err := m.col.Find(ctx, bson.M{"lockeduntil": bson.M{"$gt": at}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	attempts := []LoginAttempt{}
+	if err := cursor.All(ctx, &attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+type memoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+// NewMemoryLoginAttemptStore returns a store that keeps counters in memory.
+func NewMemoryLoginAttemptStore() LoginAttemptStore {
+	return &memoryLoginAttemptStore{attempts: make(map[string]LoginAttempt)}
+}
+
+func (m *memoryLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attempts[key]
+	if !ok || !a.ExpiresAt.After(time.Now()) {
+		return &LoginAttempt{Key: key}, nil
+	}
+	return &a, nil
+}
+
+func (m *memoryLoginAttemptStore) RecordFailure(ctx context.Context, key string, at time.Time) (*LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attempts[key]
+	if !ok || !a.ExpiresAt.After(at) {
+		a = LoginAttempt{Key: key}
+	}
+	a.Failures++
+	a.LastFailure = at
+	a.ExpiresAt = at.Add(loginAttemptMemory)
+	m.attempts[key] = a
+	return &a, nil
+}
+
+func (m *memoryLoginAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.attempts[key]; ok {
+		a.LockedUntil = until
+		m.attempts[key] = a
+	}
+	return nil
+}
+
+func (m *memoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+func (m *memoryLoginAttemptStore) ListLocked(ctx context.Context, at time.Time) ([]LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempts := []LoginAttempt{}
+	for _, a := range m.attempts {
+		if a.LockedUntil.After(at) {
+			attempts = append(attempts, a)
+		}
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].LockedUntil.After(attempts[j].LockedUntil)
+	})
+	return attempts, nil
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrOneTimeTokenNotFound = errors.New("token not found")
+
+// Purposes of one-time tokens. A token can only be used for what it was
+// issued for.
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+	PurposeLoginChallenge    = "login_challenge"
+	PurposeEmailChange       = "email_change"
+	PurposeMagicLink         = "magic_link"
+)
+
+// OneTimeToken is a secret sent to a user, usually by email, that can be used
+// once before it expires.
+type OneTimeToken struct {
+	ID        string `json:"id" bson:"id"`
+	TokenHash string `json:"-" bson:"tokenhash"`
+	Purpose   string `json:"purpose" bson:"purpose"`
+	UserID    string `json:"userid" bson:"userid"`
+	// Email is the new address of an email change.
+	Email string `json:"email,omitempty" bson:"email,omitempty"`
+	// NonceHash binds a magic link to the browser that asked for it.
+	NonceHash string     `json:"-" bson:"noncehash,omitempty"`
+	CreatedAt time.Time  `json:"createdat" bson:"createdat"`
+	ExpiresAt time.Time  `json:"expiresat" bson:"expiresat"`
+	UsedAt    *time.Time `json:"usedat,omitempty" bson:"usedat"`
+}
+
+// OneTimeTokenStore keeps one-time tokens, hashed.
+type OneTimeTokenStore interface {
+	Create(ctx context.Context, t *OneTimeToken) error
+	// Find returns an unused, unexpired token with the purpose without using
+	// it up.
+	Find(ctx context.Context, purpose, token string) (*OneTimeToken, error)
+	// Consume marks an unused, unexpired token with the purpose as used and
+	// returns it. Two concurrent calls can't both succeed.
+	Consume(ctx context.Context, purpose, token string) (*OneTimeToken, error)
+	// DeleteByUser removes the user's tokens for the purpose, so that only
+	// the most recently sent one works.
+	DeleteByUser(ctx context.Context, userID, purpose string) error
+}
+
+type mongoOneTimeTokenStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoOneTimeTokenStore returns a store backed by the collection. Expired
+// tokens are removed by a TTL index.
+func NewMongoOneTimeTokenStore(col *mongo.Collection) (OneTimeTokenStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenhash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoOneTimeTokenStore{col: col}, nil
+}
+
+func (m *mongoOneTimeTokenStore) Create(ctx context.Context, t *OneTimeToken) error {
+	_, err := m.col.InsertOne(ctx, t)
+	return err
+}
+
+func (m *mongoOneTimeTokenStore) Find(ctx context.Context, purpose, token string) (*OneTimeToken, error) {
+	filter := bson.M{
+		"tokenhash": HashToken(token),
+		"purpose":   purpose,
+		"usedat":    nil,
+		"expiresat": bson.M{"$gt": time.Now()},
+	}
+	var t OneTimeToken
+	err := m.col.FindOne(ctx, filter).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrOneTimeTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (m *mongoOneTimeTokenStore) Consume(ctx context.Context, purpose, token string) (*OneTimeToken, error) {
+	now := time.Now()
+	filter := bson.M{
+		"tokenhash": HashToken(token),
+		"purpose":   purpose,
+		"usedat":    nil,
+		"expiresat": bson.M{"$gt": now},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var t OneTimeToken
+	err := m.col.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"usedat": now}}, opts).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrOneTimeTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (m *mongoOneTimeTokenStore) DeleteByUser(ctx context.Context, userID, purpose string) error {
+	_, err := m.col.DeleteMany(ctx, bson.M{"userid": userID, "purpose": purpose})
+	return err
+}
+
+type memoryOneTimeTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]OneTimeToken
+}
+
+// NewMemoryOneTimeTokenStore returns a store that keeps tokens in memory.
+func NewMemoryOneTimeTokenStore() OneTimeTokenStore {
+	return &memoryOneTimeTokenStore{tokens: make(map[string]OneTimeToken)}
+}
+
+func (m *memoryOneTimeTokenStore) Create(ctx context.Context, t *OneTimeToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.ID] = *t
+	return nil
+}
+
+func (m *memoryOneTimeTokenStore) Find(ctx context.Context, purpose, token string) (*OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := HashToken(token)
+	for _, t := range m.tokens {
+		if t.TokenHash == hash && t.Purpose == purpose && t.UsedAt == nil && t.ExpiresAt.After(time.Now()) {
+			return &t, nil
+		}
+	}
+	return nil, ErrOneTimeTokenNotFound
+}
+
+func (m *memoryOneTimeTokenStore) Consume(ctx context.Context, purpose, token string) (*OneTimeToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	hash := HashToken(token)
+	for id, t := range m.tokens {
+		if t.TokenHash == hash && t.Purpose == purpose && t.UsedAt == nil && t.ExpiresAt.After(now) {
+			t.UsedAt = &now
+			m.tokens[id] = t
+			return &t, nil
+		}
+	}
+	return nil, ErrOneTimeTokenNotFound
+}
+
+func (m *memoryOneTimeTokenStore) DeleteByUser(ctx context.Context, userID, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, t := range m.tokens {
+		if t.UserID == userID && t.Purpose == purpose {
+			delete(m.tokens, id)
+		}
+	}
+	return nil
+}
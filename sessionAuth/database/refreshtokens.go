@@ -0,0 +1,227 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// RefreshToken is a long-lived opaque token that can be exchanged once for a
+// new access token and a new refresh token. All tokens descending from the
+// same login share a FamilyID, so that the whole chain can be revoked when a
+// used token shows up again.
+type RefreshToken struct {
+	ID        string `json:"id" bson:"id"`
+	TokenHash string `json:"-" bson:"tokenhash"`
+	FamilyID  string `json:"familyid" bson:"familyid"`
+	UserID    string `json:"userid" bson:"userid"`
+	// ClientID and Scopes are set for tokens issued to OAuth clients.
+	ClientID  string     `json:"clientid,omitempty" bson:"clientid,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty" bson:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"createdat" bson:"createdat"`
+	ExpiresAt time.Time  `json:"expiresat" bson:"expiresat"`
+	UsedAt    *time.Time `json:"usedat,omitempty" bson:"usedat"`
+	RevokedAt *time.Time `json:"revokedat,omitempty" bson:"revokedat"`
+}
+
+// RefreshTokenStore keeps refresh tokens, hashed.
+type RefreshTokenStore interface {
+	Create(ctx context.Context, t *RefreshToken) error
+	// FindByToken returns the token even if it was used or revoked, so that
+	// reuse can be detected. Expired tokens are not returned.
+	FindByToken(ctx context.Context, token string) (*RefreshToken, error)
+	// MarkUsed marks the token as used and reports whether it wasn't already.
+	MarkUsed(ctx context.Context, id string, at time.Time) (bool, error)
+	// ListActive returns the refresh tokens of our own apps that the user can
+	// still exchange, the newest first. That is one per logged in client, as
+	// every refresh uses up the previous token of the family.
+	ListActive(ctx context.Context, userID string) ([]RefreshToken, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+	RevokeUser(ctx context.Context, userID string) error
+	// RevokeClient revokes the tokens of an OAuth client, only those issued
+	// for the user unless userID is empty.
+	RevokeClient(ctx context.Context, clientID, userID string) error
+}
+
+type mongoRefreshTokenStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoRefreshTokenStore returns a store backed by the collection. Expired
+// tokens are removed by a TTL index.
+func NewMongoRefreshTokenStore(col *mongo.Collection) (RefreshTokenStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenhash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "familyid", Value: 1}}},
+		{Keys: bson.D{{Key: "userid", Value: 1}}},
+		{Keys: bson.D{{Key: "clientid", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoRefreshTokenStore{col: col}, nil
+}
+
+func (m *mongoRefreshTokenStore) Create(ctx context.Context, t *RefreshToken) error {
+	_, err := m.col.InsertOne(ctx, t)
+	return err
+}
+
+func (m *mongoRefreshTokenStore) FindByToken(ctx context.Context, token string) (*RefreshToken, error) {
+	var t RefreshToken
+	filter := bson.M{"tokenhash": HashToken(token), "expiresat": bson.M{"$gt": time.Now()}}
+	if err := m.col.FindOne(ctx, filter).Decode(&t); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (m *mongoRefreshTokenStore) MarkUsed(ctx context.Context, id string, at time.Time) (bool, error) {
+	res, err := m.col.UpdateOne(ctx, bson.M{"id": id, "usedat": nil}, bson.M{"$set": bson.M{"usedat": at}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (m *mongoRefreshTokenStore) ListActive(ctx context.Context, userID string) ([]RefreshToken, error) {
+	filter := bson.M{
+		"userid":    userID,
+		"clientid":  bson.M{"$in": bson.A{nil, ""}},
+		"usedat":    nil,
+		"revokedat": nil,
+		"expiresat": bson.M{"$gt": time.Now()},
+	}
+	cursor, err := m.col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	tokens := []RefreshToken{}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (m *mongoRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	_, err := m.col.UpdateMany(ctx, bson.M{"familyid": familyID, "revokedat": nil}, bson.M{"$set": bson.M{"revokedat": time.Now()}})
+	return err
+}
+
+func (m *mongoRefreshTokenStore) RevokeUser(ctx context.Context, userID string) error {
+	_, err := m.col.UpdateMany(ctx, bson.M{"userid": userID, "revokedat": nil}, bson.M{"$set": bson.M{"revokedat": time.Now()}})
+	return err
+}
+
+func (m *mongoRefreshTokenStore) RevokeClient(ctx context.Context, clientID, userID string) error {
+	filter := bson.M{"clientid": clientID, "revokedat": nil}
+	if userID != "" {
+		filter["userid"] = userID
+	}
+	_, err := m.col.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revokedat": time.Now()}})
+	return err
+}
+
+type memoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+// NewMemoryRefreshTokenStore returns a store that keeps refresh tokens in
+// memory.
+func NewMemoryRefreshTokenStore() RefreshTokenStore {
+	return &memoryRefreshTokenStore{tokens: make(map[string]RefreshToken)}
+}
+
+func (m *memoryRefreshTokenStore) Create(ctx context.Context, t *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.ID] = *t
+	return nil
+}
+
+func (m *memoryRefreshTokenStore) FindByToken(ctx context.Context, token string) (*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := HashToken(token)
+	for _, t := range m.tokens {
+		if t.TokenHash == hash && t.ExpiresAt.After(time.Now()) {
+			return &t, nil
+		}
+	}
+	return nil, ErrRefreshTokenNotFound
+}
+
+func (m *memoryRefreshTokenStore) MarkUsed(ctx context.Context, id string, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || t.UsedAt != nil {
+		return false, nil
+	}
+	t.UsedAt = &at
+	m.tokens[id] = t
+	return true, nil
+}
+
+func (m *memoryRefreshTokenStore) ListActive(ctx context.Context, userID string) ([]RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := []RefreshToken{}
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.ClientID == "" && t.UsedAt == nil && t.RevokedAt == nil && t.ExpiresAt.After(time.Now()) {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (m *memoryRefreshTokenStore) revoke(match func(RefreshToken) bool) {
+	now := time.Now()
+	for id, t := range m.tokens {
+		if match(t) && t.RevokedAt == nil {
+			t.RevokedAt = &now
+			m.tokens[id] = t
+		}
+	}
+}
+
+func (m *memoryRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoke(func(t RefreshToken) bool { return t.FamilyID == familyID })
+	return nil
+}
+
+func (m *memoryRefreshTokenStore) RevokeUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoke(func(t RefreshToken) bool { return t.UserID == userID })
+	return nil
+}
+
+func (m *memoryRefreshTokenStore) RevokeClient(ctx context.Context, clientID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoke(func(t RefreshToken) bool {
+		return t.ClientID == clientID && (userID == "" || t.UserID == userID)
+	})
+	return nil
+}
@@ -0,0 +1,13 @@
+package database
+
+// Roles a user can have. Users without a role are treated as RoleUser.
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleService = "service"
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser || role == RoleService
+}
@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionTokenKey is the cookie session key holding the session token.
+const SessionTokenKey = "sessionToken"
+
+// Session is a login kept on the server. The browser only holds the token,
+// which is stored hashed; ID is a separate handle that can be shown to the
+// user and used to revoke the session.
+type Session struct {
+	ID         string    `json:"id" bson:"id"`
+	TokenHash  string    `json:"-" bson:"tokenhash"`
+	UserID     string    `json:"userid" bson:"userid"`
+	IP         string    `json:"ip" bson:"ip"`
+	UserAgent  string    `json:"useragent" bson:"useragent"`
+	CreatedAt  time.Time `json:"createdat" bson:"createdat"`
+	LastUsedAt time.Time `json:"lastusedat" bson:"lastusedat"`
+	ExpiresAt  time.Time `json:"expiresat" bson:"expiresat"`
+}
+
+// SessionStore keeps sessions on the server so that they can be listed and
+// revoked. Lookups never return expired sessions.
+type SessionStore interface {
+	Create(ctx context.Context, s *Session) error
+	FindByToken(ctx context.Context, token string) (*Session, error)
+	Get(ctx context.Context, id string) (*Session, error)
+	Touch(ctx context.Context, id string, at time.Time) error
+	ListByUser(ctx context.Context, userID string) ([]Session, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteByUser revokes all sessions of the user except the one with ID
+	// except, which may be empty.
+	DeleteByUser(ctx context.Context, userID, except string) (int64, error)
+}
+
+// HashToken returns the form in which secret tokens are stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type mongoSessionStore struct {
+	col *mongo.Collection
+}
+
+// NewMongoSessionStore returns a store backed by the collection. Expired
+// sessions are removed by a TTL index.
+func NewMongoSessionStore(col *mongo.Collection) (SessionStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "tokenhash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoSessionStore{col: col}, nil
+}
+
+func (m *mongoSessionStore) Create(ctx context.Context, s *Session) error {
+	_, err := m.col.InsertOne(ctx, s)
+	return err
+}
+
+func (m *mongoSessionStore) find(ctx context.Context, filter bson.M) (*Session, error) {
+	filter["expiresat"] = bson.M{"$gt": time.Now()}
+	var s Session
+	if err := m.col.FindOne(ctx, filter).Decode(&s); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *mongoSessionStore) FindByToken(ctx context.Context, token string) (*Session, error) {
+	return m.find(ctx, bson.M{"tokenhash": HashToken(token)})
+}
+
+func (m *mongoSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	return m.find(ctx, bson.M{"id": id})
+}
+
+func (m *mongoSessionStore) Touch(ctx context.Context, id string, at time.Time) error {
+	_, err := m.col.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"lastusedat": at}})
+	return err
+}
+
+func (m *mongoSessionStore) ListByUser(ctx context.Context, userID string) ([]Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "lastusedat", Value: -1}})
+	cursor, err := m.col.Find(ctx, bson.M{"userid": userID, "expiresat": bson.M{"$gt": time.Now()}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *mongoSessionStore) Delete(ctx context.Context, id string) error {
+	res, err := m.col.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (m *mongoSessionStore) DeleteByUser(ctx context.Context, userID, except string) (int64, error) {
+	filter := bson.M{"userid": userID}
+	if except != "" {
+		filter["id"] = bson.M{"$ne": except}
+	}
+	res, err := m.col.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessionStore returns a store that keeps sessions in memory.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (m *memorySessionStore) Create(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *memorySessionStore) FindByToken(ctx context.Context, token string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := HashToken(token)
+	for _, s := range m.sessions {
+		if s.TokenHash == hash && s.ExpiresAt.After(time.Now()) {
+			return &s, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (m *memorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return nil, ErrSessionNotFound
+	}
+	return &s, nil
+}
+
+func (m *memorySessionStore) Touch(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.LastUsedAt = at
+		m.sessions[id] = s
+	}
+	return nil
+}
+
+func (m *memorySessionStore) ListByUser(ctx context.Context, userID string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.ExpiresAt.After(time.Now()) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+func (m *memorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessionStore) DeleteByUser(ctx context.Context, userID, except string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, s := range m.sessions {
+		if s.UserID == userID && id != except {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
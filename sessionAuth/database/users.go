@@ -0,0 +1,469 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrEmailTaken   = errors.New("email address is already in use")
+)
+
+type User struct {
+	ID          string      `json:"id" bson:"id"`
+	Firstname   string      `json:"firstname" bson:"firstname"`
+	Lastname    string      `json:"lastname" bson:"lastname"`
+	Email       string      `json:"email" bson:"email"`
+	Password    string      `json:"password" bson:"password"`
+	CreatedAt   time.Time   `json:"createdat" bson:"createdat"`
+	Role        string      `json:"role" bson:"role"`
+	Preferences Preferences `json:"preferences" bson:"preferences"`
+
+	// DisplayName is shown instead of the first and last name when set
+	DisplayName string `json:"displayname" bson:"displayname,omitempty"`
+	Status      string `json:"status" bson:"status,omitempty"`
+	// Timezone is an IANA time zone name such as Europe/Berlin
+	Timezone  string `json:"timezone" bson:"timezone,omitempty"`
+	AvatarURL string `json:"avatarurl" bson:"avatarurl,omitempty"`
+
+	EmailVerified   bool       `json:"emailverified" bson:"emailverified"`
+	EmailVerifiedAt *time.Time `json:"emailverifiedat,omitempty" bson:"emailverifiedat,omitempty"`
+
+	TOTPEnabled       bool     `json:"totpenabled" bson:"totpenabled"`
+	TOTPSecret        string   `json:"-" bson:"totpsecret,omitempty"`
+	TOTPPendingSecret string   `json:"-" bson:"totppendingsecret,omitempty"`
+	TOTPLastCounter   int64    `json:"-" bson:"totplastcounter,omitempty"`
+	RecoveryCodes     []string `json:"-" bson:"recoverycodes,omitempty"`
+
+	Identities []Identity `json:"identities,omitempty" bson:"identities,omitempty"`
+}
+
+// Identity links an account at an external OpenID Connect provider to a user.
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email" bson:"email"`
+	LinkedAt time.Time `json:"linkedat" bson:"linkedat"`
+}
+
+// Preferences are display settings the user can choose.
+type Preferences struct {
+	Theme    string `json:"theme" bson:"theme"`
+	Language string `json:"language" bson:"language"`
+}
+
+// DirectoryQuery selects a page of the user directory.
+type DirectoryQuery struct {
+	// Search is matched case insensitively against the start of the first
+	// name, last name and email address. With several words, each has to
+	// match one of them.
+	Search string
+	// SortBy is "firstname" or "lastname". Ties are broken by ID.
+	SortBy     string
+	Descending bool
+	// After continues the listing behind the user it points to.
+	After *DirectoryCursor
+	Limit int
+}
+
+// DirectoryCursor is the position of a user in a sorted directory listing.
+type DirectoryCursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// directoryCollation makes sorting and comparing names case insensitive.
+var directoryCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// UserRepository stores user accounts. Email addresses are unique.
+type UserRepository interface {
+	// Create stores a new user, or returns ErrEmailTaken.
+	Create(ctx context.Context, u *User) error
+	GetByID(ctx context.Context, id string) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// GetByIdentity returns the user the provider's account is linked to.
+	GetByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	List(ctx context.Context) ([]User, error)
+	// Directory returns a page of users with only their ID, names and
+	// avatar set.
+	Directory(ctx context.Context, q DirectoryQuery) ([]User, error)
+	// Update replaces the stored user with u.
+	Update(ctx context.Context, u *User) error
+	Delete(ctx context.Context, id string) error
+	// UseTOTPCounter records that the code of the time step was used and
+	// reports false if it, or a later one, already was.
+	UseTOTPCounter(ctx context.Context, id string, counter int64) (bool, error)
+	// UseRecoveryCode removes the recovery code with the hash and reports
+	// whether the user had it.
+	UseRecoveryCode(ctx context.Context, id, hash string) (bool, error)
+}
+
+type mongoUserRepository struct {
+	col *mongo.Collection
+}
+
+// NewMongoUserRepository returns a repository backed by the collection. It
+// brings documents written by older versions up to date and fails if two
+// accounts share an email address, which has to be resolved by hand.
+func NewMongoUserRepository(col *mongo.Collection) (UserRepository, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	migrations := []struct{ filter, update bson.M }{
+		// Password confirmations used to be stored along with the hash
+		{bson.M{"confirmpassword": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"confirmpassword": ""}}},
+		{bson.M{"role": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"role": RoleUser}}},
+		// Accounts created before email verification existed are trusted as they are
+		{bson.M{"emailverified": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"emailverified": true}}},
+	}
+	for _, m := range migrations {
+		if _, err := col.UpdateMany(ctx, m.filter, m.update); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "firstname", Value: 1}, {Key: "id", Value: 1}}, Options: options.Index().SetCollation(directoryCollation)},
+		{Keys: bson.D{{Key: "lastname", Value: 1}, {Key: "id", Value: 1}}, Options: options.Index().SetCollation(directoryCollation)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating user indexes, check for accounts sharing an email address: %v", err)
+	}
+	return &mongoUserRepository{col: col}, nil
+}
+
+func (m *mongoUserRepository) Create(ctx context.Context, u *User) error {
+	_, err := m.col.InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (m *mongoUserRepository) find(ctx context.Context, filter bson.M) (*User, error) {
+	var u User
+	if err := m.col.FindOne(ctx, filter).Decode(&u); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (m *mongoUserRepository) GetByID(ctx context.Context, id string) (*User, error) {
+	return m.find(ctx, bson.M{"id": id})
+}
+
+func (m *mongoUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return m.find(ctx, bson.M{"email": email})
+}
+
+func (m *mongoUserRepository) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	return m.find(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}})
+}
+
+func (m *mongoUserRepository) List(ctx context.Context) ([]User, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}})
+	cursor, err := m.col.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (m *mongoUserRepository) Directory(ctx context.Context, q DirectoryQuery) ([]User, error) {
+	var and []bson.M
+	for _, word := range strings.Fields(q.Search) {
+		prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(word), Options: "i"}
+		and = append(and, bson.M{"$or": []bson.M{{"firstname": prefix}, {"lastname": prefix}, {"email": prefix}}})
+	}
+	order, after := 1, "$gt"
+	if q.Descending {
+		order, after = -1, "$lt"
+	}
+	if q.After != nil {
+		and = append(and, bson.M{"$or": []bson.M{
+			{q.SortBy: bson.M{after: q.After.Value}},
+			{q.SortBy: q.After.Value, "id": bson.M{after: q.After.ID}},
+		}})
+	}
+	filter := bson.M{}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: q.SortBy, Value: order}, {Key: "id", Value: order}}).
+		SetCollation(directoryCollation).
+		SetProjection(bson.M{"_id": 0, "id": 1, "firstname": 1, "lastname": 1, "displayname": 1, "avatarurl": 1}).
+		SetLimit(int64(q.Limit))
+	cursor, err := m.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (m *mongoUserRepository) Update(ctx context.Context, u *User) error {
+	res, err := m.col.ReplaceOne(ctx, bson.M{"id": u.ID}, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (m *mongoUserRepository) Delete(ctx context.Context, id string) error {
+	res, err := m.col.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (m *mongoUserRepository) UseTOTPCounter(ctx context.Context, id string, counter int64) (bool, error) {
+	filter := bson.M{"id": id, "$or": []bson.M{
+		{"totplastcounter": bson.M{"$lt": counter}},
+		{"totplastcounter": bson.M{"$exists": false}},
+	}}
+	res, err := m.col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totplastcounter": counter}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (m *mongoUserRepository) UseRecoveryCode(ctx context.Context, id, hash string) (bool, error) {
+	res, err := m.col.UpdateOne(ctx, bson.M{"id": id, "recoverycodes": hash}, bson.M{"$pull": bson.M{"recoverycodes": hash}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+type memoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+// NewMemoryUserRepository returns a repository that keeps users in memory.
+func NewMemoryUserRepository() UserRepository {
+	return &memoryUserRepository{users: make(map[string]User)}
+}
+
+// copyUser keeps callers from changing stored users through shared slices.
+func copyUser(u User) *User {
+	u.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+	u.Identities = append([]Identity(nil), u.Identities...)
+	return &u
+}
+
+func (m *memoryUserRepository) emailTaken(email, except string) bool {
+	for id, u := range m.users {
+		if id != except && u.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryUserRepository) Create(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.ID]; ok || m.emailTaken(u.Email, "") {
+		return ErrEmailTaken
+	}
+	m.users[u.ID] = *copyUser(*u)
+	return nil
+}
+
+func (m *memoryUserRepository) GetByID(ctx context.Context, id string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (m *memoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return copyUser(u), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (m *memoryUserRepository) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		for _, identity := range u.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return copyUser(u), nil
+			}
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (m *memoryUserRepository) List(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, *copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.Before(users[j].CreatedAt)
+		}
+		return strings.Compare(users[i].ID, users[j].ID) < 0
+	})
+	return users, nil
+}
+
+func (m *memoryUserRepository) Directory(ctx context.Context, q DirectoryQuery) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := func(u *User) string {
+		if q.SortBy == "lastname" {
+			return strings.ToLower(u.Lastname)
+		}
+		return strings.ToLower(u.Firstname)
+	}
+	// before reports whether a comes before b in the requested order
+	before := func(a, b, idA, idB string) bool {
+		if a != b {
+			return (a < b) != q.Descending
+		}
+		return idA != idB && (idA < idB) != q.Descending
+	}
+
+	users := []User{}
+	for _, u := range m.users {
+		if !matchesSearch(&u, q.Search) {
+			continue
+		}
+		if q.After != nil && !before(strings.ToLower(q.After.Value), key(&u), q.After.ID, u.ID) {
+			continue
+		}
+		users = append(users, User{ID: u.ID, Firstname: u.Firstname, Lastname: u.Lastname, DisplayName: u.DisplayName, AvatarURL: u.AvatarURL})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return before(key(&users[i]), key(&users[j]), users[i].ID, users[j].ID)
+	})
+	if q.Limit > 0 && len(users) > q.Limit {
+		users = users[:q.Limit]
+	}
+	return users, nil
+}
+
+func matchesSearch(u *User, search string) bool {
+	fields := []string{strings.ToLower(u.Firstname), strings.ToLower(u.Lastname), strings.ToLower(u.Email)}
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		found := false
+		for _, f := range fields {
+			if strings.HasPrefix(f, word) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *memoryUserRepository) Update(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.ID]; !ok {
+		return ErrUserNotFound
+	}
+	if m.emailTaken(u.Email, u.ID) {
+		return ErrEmailTaken
+	}
+	m.users[u.ID] = *copyUser(*u)
+	return nil
+}
+
+func (m *memoryUserRepository) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(m.users, id)
+	return nil
+}
+
+func (m *memoryUserRepository) UseTOTPCounter(ctx context.Context, id string, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.TOTPLastCounter >= counter {
+		return false, nil
+	}
+	u.TOTPLastCounter = counter
+	m.users[id] = u
+	return true, nil
+}
+
+func (m *memoryUserRepository) UseRecoveryCode(ctx context.Context, id, hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return false, nil
+	}
+	for i, code := range u.RecoveryCodes {
+		if code == hash {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			m.users[id] = u
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// EmailChangeLifetime is how long the link confirming a new address works.
+const EmailChangeLifetime = 24 * time.Hour
+
+// ReauthWindow is how recent a login has to be to confirm the deletion of an
+// account that has neither a password nor a second factor.
+const ReauthWindow = 5 * time.Minute
+
+var (
+	themes      = map[string]bool{"": true, "system": true, "light": true, "dark": true}
+	languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+type updateProfileRequest struct {
+	Firstname   *string `json:"firstname"`
+	Lastname    *string `json:"lastname"`
+	DisplayName *string `json:"displayname"`
+	Status      *string `json:"status"`
+	Timezone    *string `json:"timezone"`
+	Preferences *struct {
+		Theme    *string `json:"theme"`
+		Language *string `json:"language"`
+	} `json:"preferences"`
+}
+
+// UpdateProfileHandler changes the fields that are present in the request.
+func (h *Handlers) UpdateProfileHandler(c *gin.Context) {
+	var req updateProfileRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+
+	changed := false
+	if req.Firstname != nil {
+		name := strings.TrimSpace(*req.Firstname)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "First name can't be empty"})
+			return
+		}
+		user.Firstname = name
+		changed = true
+	}
+	if req.Lastname != nil {
+		name := strings.TrimSpace(*req.Lastname)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Last name can't be empty"})
+			return
+		}
+		user.Lastname = name
+		changed = true
+	}
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Display name must be at most %d characters long", maxDisplayNameLength)})
+			return
+		}
+		user.DisplayName = name
+		changed = true
+	}
+	if req.Status != nil {
+		status := strings.TrimSpace(*req.Status)
+		if utf8.RuneCountInString(status) > maxStatusLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Status must be at most %d characters long", maxStatusLength)})
+			return
+		}
+		user.Status = status
+		changed = true
+	}
+	if req.Timezone != nil {
+		if !validTimezone(*req.Timezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Timezone must be a time zone name such as Europe/Berlin"})
+			return
+		}
+		user.Timezone = *req.Timezone
+		changed = true
+	}
+	if p := req.Preferences; p != nil {
+		if p.Theme != nil {
+			if !themes[*p.Theme] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Theme must be system, light or dark"})
+				return
+			}
+			user.Preferences.Theme = *p.Theme
+			changed = true
+		}
+		if p.Language != nil {
+			if *p.Language != "" && (len(*p.Language) > 35 || !languageTag.MatchString(*p.Language)) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Language must be a language tag such as en or pt-BR"})
+				return
+			}
+			user.Preferences.Language = *p.Language
+			changed = true
+		}
+	}
+	if !changed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Profile updated", "user": publicUser(user)})
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentpassword"`
+	NewPassword     string `json:"newpassword"`
+	Confirmpassword string `json:"confirmpassword"`
+}
+
+// ChangePasswordHandler sets a new password. All other sessions and refresh
+// tokens are revoked, and a browser gets a fresh session in place of its own.
+func (h *Handlers) ChangePasswordHandler(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	errs := fieldErrors{}
+	if req.CurrentPassword == "" {
+		errs.add("currentpassword", "Required")
+	}
+	h.checkNewPassword(errs, "newpassword", req.NewPassword, "confirmpassword", req.Confirmpassword)
+	if len(errs) > 0 {
+		respondInvalid(c, errs)
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if !h.confirmPassword(c, user, req.CurrentPassword, "Current password is incorrect") {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash the password"})
+		return
+	}
+	user.Password = string(hashedPassword)
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+	h.audit(c, auditEvent{Type: database.AuditPasswordChanged, UserID: user.ID, Details: map[string]string{"method": "change"}})
+
+	if _, err := h.sessions.DeleteByUser(ctx, user.ID, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if err := h.refreshTokens.RevokeUser(ctx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh tokens"})
+		return
+	}
+	if c.GetString("sessionID") != "" {
+		if _, err := h.startSession(c, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, other sessions have been logged out"})
+}
+
+type changeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// ChangeEmailHandler starts moving the account to a new address. The change
+// only happens once the link sent to the new address is opened.
+func (h *Handlers) ChangeEmailHandler(c *gin.Context) {
+	var req changeEmailRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validMailAddress(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if !h.confirmPassword(c, user, req.Password, "Password is incorrect") {
+		return
+	}
+	if strings.EqualFold(email, user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This is already your email address"})
+		return
+	}
+	if _, err := h.users.GetByEmail(ctx, email); !errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already in use"})
+		return
+	}
+
+	if err := h.oneTimeTokens.DeleteByUser(ctx, user.ID, database.PurposeEmailChange); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create confirmation token"})
+		return
+	}
+	token, err := newToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create confirmation token"})
+		return
+	}
+	now := time.Now()
+	err = h.oneTimeTokens.Create(ctx, &database.OneTimeToken{
+		ID:        uuid.New().String(),
+		TokenHash: database.HashToken(token),
+		Purpose:   database.PurposeEmailChange,
+		UserID:    user.ID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(EmailChangeLifetime),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create confirmation token"})
+		return
+	}
+
+	link := h.cfg.AppURL + "/confirm-email?token=" + url.QueryEscape(token)
+	h.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link to use this address for your account from now on:\n\n%s\n\n"+
+			"The link works for 24 hours.\n", user.Firstname, link),
+	})
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your account to %s. "+
+			"If it wasn't you, change your password right away.\n", user.Firstname, email),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Check your new email address to confirm the change"})
+}
+
+// ConfirmEmailChangeHandler switches the account to the new address the
+// token was sent to.
+func (h *Handlers) ConfirmEmailChangeHandler(c *gin.Context) {
+	var req verifyEmailRequest
+	if err := c.ShouldBind(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	token, err := h.oneTimeTokens.Consume(ctx, database.PurposeEmailChange, req.Token)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Confirmation link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check confirmation token"})
+		return
+	}
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Confirmation link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+
+	now := time.Now()
+	user.Email = token.Email
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	// Someone may have registered the address in the meantime
+	err = h.users.Update(ctx, user)
+	if errors.Is(err, database.ErrEmailTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already in use"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email address changed"})
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// DeleteAccountHandler deletes the user for good. Their chat messages are
+// kept but no longer point to them. The user confirms with their password.
+// Accounts that only log in through a provider have none, they confirm with
+// their second factor or, without one, by having logged in just now.
+func (h *Handlers) DeleteAccountHandler(c *gin.Context) {
+	var req deleteAccountRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	confirmedBy := "password"
+	switch {
+	case user.Password != "":
+		if req.Password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+			return
+		}
+		if !h.confirmPassword(c, user, req.Password, "Password is incorrect") {
+			return
+		}
+	case user.TOTPEnabled:
+		// The code is checked below
+		confirmedBy = "second_factor"
+	default:
+		recent, err := h.recentlyLoggedIn(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session"})
+			return
+		}
+		if !recent {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in again to confirm that you want to delete your account", "reauth_required": true})
+			return
+		}
+		confirmedBy = "recent_login"
+	}
+	if user.TOTPEnabled {
+		ok, err := h.verifySecondFactor(ctx, user, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+	}
+
+	// The chat data goes first, so a failure leaves an account to retry with
+	if err := h.chat.AnonymizeUser(ctx, user.ID); err != nil {
+		log.Printf("Failed to anonymize chat data of %s: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	// API keys and OAuth consents don't expire on their own
+	if err := h.apiKeys.DeleteByUser(ctx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	consents, err := h.consents.DeleteByUser(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	if err := h.users.Delete(ctx, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	h.audit(c, auditEvent{Type: database.AuditAccountDeleted, UserID: user.ID, Email: user.Email, Details: map[string]string{
+		"confirmed_by":     confirmedBy,
+		"consents_revoked": strconv.FormatInt(consents, 10),
+	}})
+
+	// What is left expires on its own, so failures here are only logged
+	if _, err := h.sessions.DeleteByUser(ctx, user.ID, ""); err != nil {
+		log.Printf("Failed to revoke sessions of deleted user %s: %v", user.ID, err)
+	}
+	if err := h.refreshTokens.RevokeUser(ctx, user.ID); err != nil {
+		log.Printf("Failed to revoke refresh tokens of deleted user %s: %v", user.ID, err)
+	}
+	if err := h.deleteExport(ctx, user.ID); err != nil {
+		log.Printf("Failed to delete the data export of deleted user %s: %v", user.ID, err)
+	}
+	for _, purpose := range []string{database.PurposePasswordReset, database.PurposeEmailVerification, database.PurposeEmailChange, database.PurposeLoginChallenge, database.PurposeMagicLink} {
+		if err := h.oneTimeTokens.DeleteByUser(ctx, user.ID, purpose); err != nil {
+			log.Printf("Failed to delete tokens of deleted user %s: %v", user.ID, err)
+		}
+	}
+	h.clearSessionCookie(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// recentlyLoggedIn reports whether the request comes from a browser session
+// that was started within ReauthWindow.
+func (h *Handlers) recentlyLoggedIn(c *gin.Context) (bool, error) {
+	id := c.GetString("sessionID")
+	if id == "" {
+		return false, nil
+	}
+	s, err := h.sessions.Get(c.Request.Context(), id)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(s.CreatedAt) <= ReauthWindow, nil
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxAPIKeys is how many API keys a user can have at the same time.
+	MaxAPIKeys = 20
+	// MaxAPIKeyLifetimeDays is the longest expiry that can be chosen. Keys can
+	// also be created without one.
+	MaxAPIKeyLifetimeDays = 365
+)
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is optional, the key doesn't expire without it.
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreateAPIKeyHandler creates an API key for the user. The key is only shown
+// in the response.
+func (h *Handlers) CreateAPIKeyHandler(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, s := range req.Scopes {
+		if !knownScope(s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + s})
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > MaxAPIKeyLifetimeDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Keys can expire in at most 365 days"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetString("userID")
+	existing, err := h.apiKeys.ListByUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	if len(existing) >= MaxAPIKeys {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many API keys, revoke one first"})
+		return
+	}
+
+	secret, err := newToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	key := database.APIKeyPrefix + secret
+	now := time.Now()
+	k := &database.APIKey{
+		ID:        uuid.New().String(),
+		KeyHash:   database.HashToken(key),
+		UserID:    userID,
+		Name:      req.Name,
+		Hint:      key[:len(database.APIKeyPrefix)+6],
+		Scopes:    req.Scopes,
+		CreatedAt: now,
+	}
+	if req.ExpiresInDays > 0 {
+		expires := now.AddDate(0, 0, req.ExpiresInDays)
+		k.ExpiresAt = &expires
+	}
+	if err := h.apiKeys.Create(ctx, k); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "API key created, copy it now, it won't be shown again", "api_key": key, "key": k})
+}
+
+func (h *Handlers) ListAPIKeysHandler(c *gin.Context) {
+	keys, err := h.apiKeys.ListByUser(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// RevokeAPIKeyHandler deletes one of the user's API keys. Services that
+// introspect it see it as inactive right away.
+func (h *Handlers) RevokeAPIKeyHandler(c *gin.Context) {
+	err := h.apiKeys.Delete(c.Request.Context(), c.GetString("userID"), c.Param("id"))
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+// createAPIKey creates a key with the scopes and returns its ID and the key.
+func (ts *testServer) createAPIKey(t *testing.T, token string, scopes ...string) (string, string) {
+	t.Helper()
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/apikeys", gin.H{"name": "script", "scopes": scopes}, "Authorization", "Bearer "+token)
+	key, _ := body["api_key"].(string)
+	info, _ := body["key"].(map[string]any)
+	if status != http.StatusCreated || key == "" || info == nil {
+		t.Fatalf("create API key: got %d %v", status, body)
+	}
+	return info["id"].(string), key
+}
+
+// introspect asks the introspection endpoint about the token.
+func (ts *testServer) introspect(t *testing.T, token string) map[string]any {
+	t.Helper()
+	resp, err := http.PostForm(ts.URL+"/introspect", url.Values{"token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return out
+}
+
+func TestAPIKeys(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	id, key := ts.createAPIKey(t, token, "profile", "chat:read")
+	if !strings.HasPrefix(key, database.APIKeyPrefix) {
+		t.Errorf("got key %q, want the %s prefix", key, database.APIKeyPrefix)
+	}
+
+	status, body := ts.call(t, http.DefaultClient, http.MethodGet, "/apikeys", nil, "Authorization", "Bearer "+token)
+	keys, _ := body["api_keys"].([]any)
+	if status != http.StatusOK || len(keys) != 1 {
+		t.Fatalf("list: got %d %v", status, body)
+	}
+	listed, _ := json.Marshal(keys[0])
+	if strings.Contains(string(listed), key) || strings.Contains(string(listed), database.HashToken(key)) {
+		t.Errorf("the key is shown again: %s", listed)
+	}
+
+	status, body = ts.call(t, http.DefaultClient, http.MethodGet, "/userinfo", nil, "Authorization", "Bearer "+key)
+	if status != http.StatusOK || body["email"] != "anna@example.com" {
+		t.Errorf("userinfo with the key: got %d %v", status, body)
+	}
+	got := ts.introspect(t, key)
+	if got["active"] != true || got["token_type"] != "api_key" || got["scope"] != "profile chat:read" {
+		t.Errorf("introspection: got %v", got)
+	}
+	// Keys are for the other services, they can't manage the account
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/apikeys", nil, "Authorization", "Bearer "+key); status != http.StatusUnauthorized {
+		t.Errorf("listing keys with a key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Only the owner can revoke a key
+	other := ts.accessToken(t, "ben@example.com")
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodDelete, "/apikeys/"+id, nil, "Authorization", "Bearer "+other); status != http.StatusNotFound {
+		t.Errorf("revoking another user's key: got %d, want %d", status, http.StatusNotFound)
+	}
+	if status, body := ts.call(t, http.DefaultClient, http.MethodDelete, "/apikeys/"+id, nil, "Authorization", "Bearer "+token); status != http.StatusOK {
+		t.Fatalf("revoke: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/userinfo", nil, "Authorization", "Bearer "+key); status != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if got := ts.introspect(t, key); got["active"] != false {
+		t.Errorf("introspecting a revoked key: got %v", got)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	_, key := ts.createAPIKey(t, token, "chat:read")
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/userinfo", nil, "Authorization", "Bearer "+key); status != http.StatusForbidden {
+		t.Errorf("key without the profile scope: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/userinfo", nil, "Authorization", "Bearer "+database.APIKeyPrefix+"made up"); status != http.StatusUnauthorized {
+		t.Errorf("unknown key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/apikeys", gin.H{"name": "script", "scopes": []string{"profile"}, "expires_in_days": 30}, "Authorization", "Bearer "+token)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %v", status, body)
+	}
+	exp, _ := ts.introspect(t, body["api_key"].(string))["exp"].(float64)
+	if d := time.Until(time.Unix(int64(exp), 0)) - 30*24*time.Hour; d < -time.Minute || d > time.Minute {
+		t.Errorf("got expiry %v, want in 30 days", time.Unix(int64(exp), 0))
+	}
+
+	user, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	const expired = database.APIKeyPrefix + "expired"
+	err = ts.stores.APIKeys.Create(context.Background(), &database.APIKey{
+		ID: "expired", KeyHash: database.HashToken(expired), UserID: user.ID, Name: "old",
+		Scopes: []string{"profile"}, CreatedAt: past.Add(-time.Hour), ExpiresAt: &past,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/userinfo", nil, "Authorization", "Bearer "+expired); status != http.StatusUnauthorized {
+		t.Errorf("expired key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if got := ts.introspect(t, expired); got["active"] != false {
+		t.Errorf("introspecting an expired key: got %v", got)
+	}
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	for name, req := range map[string]gin.H{
+		"no name":          {"scopes": []string{"profile"}},
+		"no scopes":        {"name": "script"},
+		"unknown scope":    {"name": "script", "scopes": []string{"admin"}},
+		"negative expiry":  {"name": "script", "scopes": []string{"profile"}, "expires_in_days": -1},
+		"too long expiry":  {"name": "script", "scopes": []string{"profile"}, "expires_in_days": MaxAPIKeyLifetimeDays + 1},
+		"blank name":       {"name": "  ", "scopes": []string{"profile"}},
+		"scopes not array": {"name": "script", "scopes": "profile"},
+	} {
+		if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/apikeys", req, "Authorization", "Bearer "+token); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", name, status, http.StatusBadRequest)
+		}
+	}
+
+	for i := 0; i < MaxAPIKeys; i++ {
+		ts.createAPIKey(t, token, "profile")
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/apikeys", gin.H{"name": "one more", "scopes": []string{"profile"}}, "Authorization", "Bearer "+token); status != http.StatusBadRequest {
+		t.Errorf("key over the limit: got %d, want %d", status, http.StatusBadRequest)
+	}
+}
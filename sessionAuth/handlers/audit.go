@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEvent describes an event for h.audit. Only Type is required.
+type auditEvent struct {
+	Type    string
+	UserID  string
+	ActorID string
+	Email   string
+	Details map[string]string
+}
+
+// audit appends an event about the request to the audit log. A failure to
+// write it is logged but doesn't fail the request.
+func (h *Handlers) audit(c *gin.Context, e auditEvent) {
+	event := &database.AuditEvent{
+		ID:        uuid.New().String(),
+		Type:      e.Type,
+		UserID:    e.UserID,
+		ActorID:   e.ActorID,
+		Email:     e.Email,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: c.GetString("requestID"),
+		Details:   e.Details,
+		CreatedAt: time.Now(),
+	}
+	if err := h.auditLog.Append(c.Request.Context(), event); err != nil {
+		log.Printf("Failed to write %s audit event for %q (request %s): %v", e.Type, e.UserID, event.RequestID, err)
+	}
+}
+
+// ListAuditEventsHandler lets admins search the audit log by user, event type
+// and time range. Times are RFC 3339, until is exclusive.
+func (h *Handlers) ListAuditEventsHandler(c *gin.Context) {
+	f := database.AuditFilter{
+		UserID: c.Query("user_id"),
+		Type:   c.Query("type"),
+		Limit:  defaultAuditLimit,
+	}
+	if f.Type != "" && !database.ValidAuditType(f.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type " + f.Type})
+		return
+	}
+	for param, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := c.Query(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		f.Limit = n
+	}
+
+	events, err := h.auditLog.List(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
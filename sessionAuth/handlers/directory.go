@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDirectoryLimit = 20
+	maxDirectoryLimit     = 100
+	maxDirectorySearch    = 100
+)
+
+// DirectoryEntry is what the directory shows about a user. Email addresses
+// can be searched for but aren't returned, so the directory can't be used
+// to collect them.
+type DirectoryEntry struct {
+	ID        string `json:"id"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	// DisplayName and AvatarURL are empty unless the user set them
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatarurl"`
+}
+
+// DirectoryHandler lists users for pickers such as starting a direct message.
+// q searches the start of names and email addresses, sort is firstname or
+// lastname, prefixed with - for descending order. The response holds a
+// next_cursor while there are more results, pass it as cursor to continue.
+func (h *Handlers) DirectoryHandler(c *gin.Context) {
+	q := database.DirectoryQuery{
+		Search: strings.TrimSpace(c.Query("q")),
+		SortBy: "firstname",
+		Limit:  defaultDirectoryLimit,
+	}
+	if utf8.RuneCountInString(q.Search) > maxDirectorySearch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q must be at most 100 characters long"})
+		return
+	}
+	if v := c.Query("sort"); v != "" {
+		q.Descending = strings.HasPrefix(v, "-")
+		q.SortBy = strings.TrimPrefix(v, "-")
+		if q.SortBy != "firstname" && q.SortBy != "lastname" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be firstname or lastname"})
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDirectoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+			return
+		}
+		q.Limit = n
+	}
+	if v := c.Query("cursor"); v != "" {
+		after, err := decodeDirectoryCursor(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		q.After = after
+	}
+
+	// One more than asked for tells whether there is another page
+	limit := q.Limit
+	q.Limit++
+	users, err := h.users.Directory(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search the directory"})
+		return
+	}
+
+	entries := []DirectoryEntry{}
+	for i := 0; i < len(users) && i < limit; i++ {
+		u := &users[i]
+		entries = append(entries, DirectoryEntry{
+			ID:          u.ID,
+			Firstname:   u.Firstname,
+			Lastname:    u.Lastname,
+			DisplayName: u.DisplayName,
+			AvatarURL:   u.AvatarURL,
+		})
+	}
+	resp := gin.H{"users": entries}
+	if len(users) > limit {
+		last := &users[limit-1]
+		value := last.Firstname
+		if q.SortBy == "lastname" {
+			value = last.Lastname
+		}
+		resp["next_cursor"] = encodeDirectoryCursor(&database.DirectoryCursor{Value: value, ID: last.ID})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func encodeDirectoryCursor(cur *database.DirectoryCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeDirectoryCursor(s string) (*database.DirectoryCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur database.DirectoryCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
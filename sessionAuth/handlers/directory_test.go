@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerNamed registers a user with the names.
+func (ts *testServer) registerNamed(t *testing.T, firstname, lastname string) {
+	t.Helper()
+	email := strings.ToLower(firstname+"."+lastname) + "@example.com"
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/register", gin.H{
+		"firstname": firstname, "lastname": lastname, "email": email,
+		"password": "correct horse", "confirmpassword": "correct horse",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("register %s: got %d %v", email, status, body)
+	}
+}
+
+// directoryPages follows the cursors of the listing and returns the users in
+// the order they were listed. between is called before each page but the
+// first.
+func (ts *testServer) directoryPages(t *testing.T, token string, query url.Values, between func()) []DirectoryEntry {
+	t.Helper()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	var entries []DirectoryEntry
+	for page := 0; ; page++ {
+		status, body := ts.call(t, http.DefaultClient, http.MethodGet, "/directory?"+query.Encode(), nil, "Authorization", "Bearer "+token)
+		if status != http.StatusOK {
+			t.Fatalf("page %d: got %d %v", page, status, body)
+		}
+		users, _ := body["users"].([]any)
+		for _, u := range users {
+			fields := u.(map[string]any)
+			if _, ok := fields["email"]; ok {
+				t.Errorf("the directory shows email addresses: %v", fields)
+			}
+			entries = append(entries, DirectoryEntry{
+				ID:        fields["id"].(string),
+				Firstname: fields["firstname"].(string),
+				Lastname:  fields["lastname"].(string),
+			})
+		}
+		cursor, _ := body["next_cursor"].(string)
+		if cursor == "" {
+			return entries
+		}
+		if limit > 0 && len(users) != limit {
+			t.Errorf("page %d has %d users, want a full page before a cursor", page, len(users))
+		}
+		if page > 100 {
+			t.Fatalf("still listing after %d pages", page)
+		}
+		query.Set("cursor", cursor)
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func names(entries []DirectoryEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Firstname+" "+e.Lastname)
+	}
+	return names
+}
+
+// directoryUsers registers users with several equal first and last names, so
+// pages end in the middle of ties, and returns the token of an Anna Smith.
+func (ts *testServer) directoryUsers(t *testing.T) string {
+	t.Helper()
+	for _, n := range [][2]string{
+		{"anna", "Jones"}, {"Anna", "Brown"}, {"Ben", "Smithers"},
+		{"Carla", "Adams"}, {"Dan", "Smith"}, {"Eve", "Young"},
+	} {
+		ts.registerNamed(t, n[0], n[1])
+	}
+	return ts.accessToken(t, "anna.smith@example.com")
+}
+
+func TestDirectoryPages(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.directoryUsers(t)
+
+	for _, sortBy := range []string{"firstname", "-firstname", "lastname", "-lastname"} {
+		entries := ts.directoryPages(t, token, url.Values{"sort": {sortBy}, "limit": {"2"}}, nil)
+		if len(entries) != 7 {
+			t.Errorf("%s: got %q, want all 7 users", sortBy, names(entries))
+		}
+		seen := map[string]bool{}
+		for _, e := range entries {
+			if seen[e.ID] {
+				t.Errorf("%s: %s %s listed twice", sortBy, e.Firstname, e.Lastname)
+			}
+			seen[e.ID] = true
+		}
+		key := func(e DirectoryEntry) string {
+			if strings.HasSuffix(sortBy, "lastname") {
+				return strings.ToLower(e.Lastname)
+			}
+			return strings.ToLower(e.Firstname)
+		}
+		sorted := sort.SliceIsSorted(entries, func(i, j int) bool {
+			if strings.HasPrefix(sortBy, "-") {
+				return key(entries[i]) > key(entries[j])
+			}
+			return key(entries[i]) < key(entries[j])
+		})
+		if !sorted {
+			t.Errorf("%s: got %q, not in order", sortBy, names(entries))
+		}
+	}
+}
+
+func TestDirectoryCursorIsStable(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.directoryUsers(t)
+
+	// Someone joining before the cursor doesn't shift the pages after it
+	joined := false
+	entries := ts.directoryPages(t, token, url.Values{"limit": {"2"}}, func() {
+		if !joined {
+			ts.registerNamed(t, "Aaron", "Early")
+			joined = true
+		}
+	})
+	var got []string
+	for _, e := range entries {
+		got = append(got, strings.ToLower(e.Firstname))
+	}
+	if want := "anna anna anna ben carla dan eve"; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %s", names(entries), want)
+	}
+}
+
+func TestDirectorySearch(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.directoryUsers(t)
+
+	for q, want := range map[string][]string{
+		"smith":       {"Anna Smith", "Ben Smithers", "Dan Smith"},
+		"ANNA s":      {"Anna Smith"},
+		"carla.adams": {"Carla Adams"},
+		"nobody":      nil,
+	} {
+		got := names(ts.directoryPages(t, token, url.Values{"q": {q}, "limit": {"2"}}, nil))
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%q: got %q, want %q", q, got, want)
+		}
+	}
+}
+
+func TestDirectoryValidation(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	for _, query := range []string{
+		"sort=email", "limit=0", "limit=101", "limit=ten", "cursor=not-base64!", "cursor=bm90IGpzb24",
+		"q=" + strings.Repeat("a", maxDirectorySearch+1),
+	} {
+		if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/directory?"+query, nil, "Authorization", "Bearer "+token); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, status, http.StatusBadRequest)
+		}
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/directory", nil); status != http.StatusUnauthorized {
+		t.Errorf("logged out: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// ExportLifetime is how long a finished export can be downloaded.
+	ExportLifetime = 7 * 24 * time.Hour
+	// ExportTimeout is how long building an export may take. An export
+	// that is still pending after it, because the instance building it
+	// stopped, counts as failed.
+	ExportTimeout = 30 * time.Minute
+	// maxExportFileSize limits each uploaded file put into an export.
+	maxExportFileSize = 100 << 20 // 100 MB
+)
+
+// exportStatus returns the status of the export, taking into account that
+// pending exports can be abandoned.
+func exportStatus(e *database.Export, now time.Time) string {
+	if e.Status == database.ExportPending && now.Sub(e.CreatedAt) > ExportTimeout {
+		return database.ExportFailed
+	}
+	return e.Status
+}
+
+func (h *Handlers) exportPath(e *database.Export) string {
+	return filepath.Join(h.cfg.ExportDir, e.ID+".zip")
+}
+
+// respondExport shows the export with its current status and, once it is
+// ready, where to download it.
+func respondExport(c *gin.Context, status int, message string, e *database.Export) {
+	view := *e
+	view.Status = exportStatus(e, time.Now())
+	resp := gin.H{"message": message, "export": view}
+	if view.Status == database.ExportReady {
+		resp["download_url"] = "/account/export/download"
+	}
+	c.JSON(status, resp)
+}
+
+// StartExportHandler starts building an archive of everything stored about
+// the user. It replaces the previous export, unless that is still being
+// built. Poll ExportStatusHandler to learn when it is ready.
+func (h *Handlers) StartExportHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("userID")
+	now := time.Now()
+
+	previous, err := h.exports.Get(ctx, userID)
+	if err != nil && !errors.Is(err, database.ErrExportNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		return
+	}
+	if err == nil {
+		if exportStatus(previous, now) == database.ExportPending {
+			respondExport(c, http.StatusConflict, "An export is already being prepared", previous)
+			return
+		}
+		if err := os.Remove(h.exportPath(previous)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove export %s: %v", previous.ID, err)
+		}
+	}
+
+	export := &database.Export{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Status:    database.ExportPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ExportLifetime),
+	}
+	if err := h.exports.Save(ctx, export); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		return
+	}
+	h.audit(c, auditEvent{Type: database.AuditDataExported, UserID: userID, Details: map[string]string{"export_id": export.ID}})
+
+	go h.runExport(*export)
+	respondExport(c, http.StatusAccepted, "Export started", export)
+}
+
+// ExportStatusHandler returns the user's latest export.
+func (h *Handlers) ExportStatusHandler(c *gin.Context) {
+	export, err := h.exports.Get(c.Request.Context(), c.GetString("userID"))
+	if errors.Is(err, database.ErrExportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No export has been requested"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export"})
+		return
+	}
+	respondExport(c, http.StatusOK, "Export "+exportStatus(export, time.Now()), export)
+}
+
+// DownloadExportHandler sends the archive of the user's latest export.
+func (h *Handlers) DownloadExportHandler(c *gin.Context) {
+	export, err := h.exports.Get(c.Request.Context(), c.GetString("userID"))
+	if err != nil && !errors.Is(err, database.ErrExportNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export"})
+		return
+	}
+	if err != nil || export.Status != database.ExportReady || time.Now().After(export.ExpiresAt) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No export is ready for download"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.FileAttachment(h.exportPath(export), "account-export-"+export.CreatedAt.Format("2006-01-02")+".zip")
+}
+
+// runExport builds the archive of an export and records whether it worked.
+func (h *Handlers) runExport(export database.Export) {
+	ctx, cancel := context.WithTimeout(context.Background(), ExportTimeout)
+	defer cancel()
+
+	size, err := h.buildExport(ctx, &export)
+	if err != nil {
+		log.Printf("Failed to build export %s of %s: %v", export.ID, export.UserID, err)
+		export.Status = database.ExportFailed
+	} else {
+		now := time.Now()
+		export.Status = database.ExportReady
+		export.Size = size
+		export.CompletedAt = &now
+		export.ExpiresAt = now.Add(ExportLifetime)
+	}
+
+	// The user may have started a new export or deleted their account in
+	// the meantime, which replaces or removes this one
+	current, err := h.exports.Get(ctx, export.UserID)
+	if err != nil || current.ID != export.ID {
+		os.Remove(h.exportPath(&export))
+		return
+	}
+	if err := h.exports.Save(ctx, &export); err != nil {
+		log.Printf("Failed to save export %s: %v", export.ID, err)
+	}
+}
+
+// buildExport writes the archive to a temporary file first, so a half
+// written archive is never offered for download.
+func (h *Handlers) buildExport(ctx context.Context, export *database.Export) (int64, error) {
+	if err := os.MkdirAll(h.cfg.ExportDir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(h.cfg.ExportDir, export.ID+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := h.writeExport(ctx, f, export.UserID); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), h.exportPath(export)); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// writeExport writes the ZIP archive of everything stored about the user.
+func (h *Handlers) writeExport(ctx context.Context, w io.Writer, userID string) error {
+	user, err := h.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	auditEvents, err := h.auditLog.List(ctx, database.AuditFilter{UserID: userID})
+	if err != nil {
+		return err
+	}
+	sessions, err := h.sessions.ListByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	rooms, err := h.chat.RoomsCreatedBy(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	z := zip.NewWriter(w)
+	files := []struct {
+		name  string
+		value any
+	}{
+		// The same fields the profile shows, which leaves out the password
+		// hash, TOTP secrets and recovery codes
+		{"account.json", publicUser(user)},
+		{"audit_events.json", auditEvents},
+		{"sessions.json", sessions},
+		{"rooms.json", rooms},
+	}
+	for _, file := range files {
+		part, err := z.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(part)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.value); err != nil {
+			return err
+		}
+	}
+
+	// Messages can be many, so they are streamed one per line
+	part, err := z.Create("messages.jsonl")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(part)
+	err = h.chat.MessagesBySender(ctx, userID, func(msg *database.ChatMessage) error {
+		return enc.Encode(msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	uploads := map[string]string{}
+	if user.AvatarURL != "" {
+		uploads["files/avatar/"+fileName(user.AvatarURL)] = user.AvatarURL
+	}
+	for _, room := range rooms {
+		if room.Avatar != "" {
+			uploads["files/rooms/"+room.ID+"/"+fileName(room.Avatar)] = room.Avatar
+		}
+	}
+	var missing []string
+	// Chat attachments and anything else the user uploaded, which takes in
+	// the avatars unless someone else uploaded them
+	uploaded, err := h.listUploads(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to list the uploads of %s: %v", userID, err)
+		missing = append(missing, h.cfg.FileServiceURL+"/files")
+	}
+	included := make(map[string]bool, len(uploads))
+	for _, fileURL := range uploads {
+		included[fileURL] = true
+	}
+	for _, name := range uploaded {
+		fileURL := h.cfg.FileServiceURL + "/file?filename=" + url.QueryEscape(name)
+		if !included[fileURL] {
+			uploads["files/uploads/"+fileName(fileURL)] = fileURL
+		}
+	}
+	for name, fileURL := range uploads {
+		if err := h.copyUpload(ctx, z, name, fileURL); err != nil {
+			log.Printf("Failed to add %s to the export of %s: %v", fileURL, userID, err)
+			missing = append(missing, fileURL)
+		}
+	}
+
+	readme, err := z.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(readme, "Personal data of %s, exported %s.\n\n", user.Email, time.Now().UTC().Format(time.RFC1123))
+	fmt.Fprintln(readme, "account.json       your account and profile")
+	fmt.Fprintln(readme, "audit_events.json  security events of your account")
+	fmt.Fprintln(readme, "sessions.json      where you are logged in")
+	fmt.Fprintln(readme, "rooms.json         the chat rooms you created")
+	fmt.Fprintln(readme, "messages.jsonl     the chat messages you sent, one per line")
+	fmt.Fprintln(readme, "files/avatar/      your avatar")
+	fmt.Fprintln(readme, "files/rooms/       the avatars of your rooms")
+	fmt.Fprintln(readme, "files/uploads/     the other files you uploaded, such as chat attachments")
+	if len(missing) > 0 {
+		fmt.Fprintln(readme, "\nThese files could not be retrieved:")
+		for _, fileURL := range missing {
+			fmt.Fprintln(readme, fileURL)
+		}
+	}
+	return z.Close()
+}
+
+// fileName returns the name of a file in the file service from its URL.
+func fileName(fileURL string) string {
+	name := fileURL
+	if u, err := url.Parse(fileURL); err == nil {
+		if q := u.Query().Get("filename"); q != "" {
+			name = q
+		} else {
+			name = u.Path
+		}
+	}
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// listUploads asks the file service for the names of the files the user
+// uploaded.
+func (h *Handlers) listUploads(ctx context.Context, userID string) ([]string, error) {
+	token, _, err := h.tokens.Issue(userID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.cfg.FileServiceURL+"/files", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file service responded with %s", resp.Status)
+	}
+	var list struct {
+		Files []struct {
+			Filename string `json:"filename"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list.Files))
+	for _, f := range list.Files {
+		names = append(names, f.Filename)
+	}
+	return names, nil
+}
+
+// copyUpload downloads a file from the file service into the archive. Other
+// URLs are refused, they could point anywhere in our network.
+func (h *Handlers) copyUpload(ctx context.Context, z *zip.Writer, name, fileURL string) error {
+	if !strings.HasPrefix(fileURL, h.cfg.FileServiceURL+"/") {
+		return fmt.Errorf("not a file service URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("file service responded with %s", resp.Status)
+	}
+	part, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(part, io.LimitReader(resp.Body, maxExportFileSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxExportFileSize {
+		return fmt.Errorf("file is larger than %d bytes", maxExportFileSize)
+	}
+	return nil
+}
+
+// PruneExports deletes exports that expired, with their archives.
+func (h *Handlers) PruneExports(ctx context.Context) error {
+	expired, err := h.exports.ListExpired(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range expired {
+		if err := os.Remove(h.exportPath(&expired[i])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := h.exports.Delete(ctx, expired[i].UserID, expired[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExport removes the user's export, for when the account is deleted.
+func (h *Handlers) deleteExport(ctx context.Context, userID string) error {
+	export, err := h.exports.Get(ctx, userID)
+	if errors.Is(err, database.ErrExportNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.exports.Delete(ctx, userID, export.ID); err != nil {
+		return err
+	}
+	if err := os.Remove(h.exportPath(export)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/my/module/database"
+)
+
+// fileService fakes the file service with one upload, and one that is listed
+// but can't be downloaded anymore.
+func fileService(t *testing.T) func(*Config) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/files" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"files":[{"filename":"notes.txt"},{"filename":"gone.txt"}]}`)
+		case r.URL.Path == "/file" && r.URL.Query().Get("filename") == "notes.txt":
+			io.WriteString(w, "my notes")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return func(cfg *Config) { cfg.FileServiceURL = srv.URL }
+}
+
+// waitForExport polls the export until it is no longer being prepared.
+func (ts *testServer) waitForExport(t *testing.T, token string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, body := ts.call(t, http.DefaultClient, http.MethodGet, "/account/export", nil, "Authorization", "Bearer "+token)
+		export, _ := body["export"].(map[string]any)
+		if status != http.StatusOK || export == nil {
+			t.Fatalf("export status: got %d %v", status, body)
+		}
+		if export["status"] != database.ExportPending {
+			return body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("export still pending")
+	return nil
+}
+
+// downloadExport returns the status and the archive of the latest export.
+func (ts *testServer) downloadExport(t *testing.T, token string) (int, *zip.Reader) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/account/export/download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	return resp.StatusCode, z
+}
+
+func readZipFile(t *testing.T, z *zip.Reader, name string) string {
+	t.Helper()
+	f, err := z.Open(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// archives returns the export archives in the export directory.
+func (ts *testServer) archives(t *testing.T) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(ts.h.cfg.ExportDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestExport(t *testing.T) {
+	ts := newTestServer(t, fileService(t))
+	token := ts.accessToken(t, "anna@example.com")
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusNotFound {
+		t.Errorf("status before an export: got %d, want %d", status, http.StatusNotFound)
+	}
+	if status, _ := ts.downloadExport(t, token); status != http.StatusNotFound {
+		t.Errorf("download before an export: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusAccepted {
+		t.Fatalf("start: got %d %v", status, body)
+	}
+	body := ts.waitForExport(t, token)
+	if export := body["export"].(map[string]any); export["status"] != database.ExportReady || body["download_url"] != "/account/export/download" {
+		t.Fatalf("got %v, want a ready export", body)
+	}
+
+	status, z := ts.downloadExport(t, token)
+	if status != http.StatusOK {
+		t.Fatalf("download: got %d", status)
+	}
+	account := readZipFile(t, z, "account.json")
+	if !strings.Contains(account, "anna@example.com") {
+		t.Errorf("account.json: got %s", account)
+	}
+	if strings.Contains(strings.ToLower(account), "password") {
+		t.Errorf("account.json has the password hash: %s", account)
+	}
+	for _, name := range []string{"audit_events.json", "sessions.json", "rooms.json", "messages.jsonl"} {
+		readZipFile(t, z, name)
+	}
+	if got := readZipFile(t, z, "files/uploads/notes.txt"); got != "my notes" {
+		t.Errorf("uploaded file: got %q", got)
+	}
+	readme := readZipFile(t, z, "README.txt")
+	if !strings.Contains(readme, "could not be retrieved") || !strings.Contains(readme, "gone.txt") || strings.Contains(readme, "notes.txt") {
+		t.Errorf("README doesn't list just the missing upload: %s", readme)
+	}
+
+	// Other users only see their own exports
+	other := ts.accessToken(t, "ben@example.com")
+	if status, _ := ts.downloadExport(t, other); status != http.StatusNotFound {
+		t.Errorf("another user downloading: got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestExportReplacesPrevious(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	start := func() string {
+		t.Helper()
+		if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusAccepted {
+			t.Fatalf("start: got %d %v", status, body)
+		}
+		return ts.waitForExport(t, token)["export"].(map[string]any)["id"].(string)
+	}
+
+	first := start()
+	second := start()
+	if first == second {
+		t.Fatal("the export wasn't replaced")
+	}
+	if got := ts.archives(t); len(got) != 1 || filepath.Base(got[0]) != second+".zip" {
+		t.Errorf("got archives %q, want only the one of the new export", got)
+	}
+}
+
+func TestExportWhilePending(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	user, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &database.Export{ID: "pending", UserID: user.ID, Status: database.ExportPending, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(ExportLifetime)}
+	if err := ts.stores.Exports.Save(context.Background(), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusConflict {
+		t.Errorf("start while pending: got %d, want %d", status, http.StatusConflict)
+	}
+	if status, _ := ts.downloadExport(t, token); status != http.StatusNotFound {
+		t.Errorf("download while pending: got %d, want %d", status, http.StatusNotFound)
+	}
+
+	// An export nobody finished in time was abandoned and can be retried
+	pending.CreatedAt = time.Now().Add(-ExportTimeout - time.Minute)
+	if err := ts.stores.Exports.Save(context.Background(), pending); err != nil {
+		t.Fatal(err)
+	}
+	_, body := ts.call(t, http.DefaultClient, http.MethodGet, "/account/export", nil, "Authorization", "Bearer "+token)
+	if export, _ := body["export"].(map[string]any); export["status"] != database.ExportFailed {
+		t.Errorf("abandoned export: got %v, want it failed", body)
+	}
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusAccepted {
+		t.Errorf("retry: got %d %v", status, body)
+	}
+	ts.waitForExport(t, token)
+}
+
+func TestPruneExports(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/account/export", nil, "Authorization", "Bearer "+token); status != http.StatusAccepted {
+		t.Fatalf("start: got %d %v", status, body)
+	}
+	ts.waitForExport(t, token)
+	ctx := context.Background()
+	user, err := ts.stores.Users.GetByEmail(ctx, "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exports that are still valid are kept
+	if err := ts.h.PruneExports(ctx); err != nil {
+		t.Fatal(err)
+	}
+	export, err := ts.stores.Exports.Get(ctx, user.ID)
+	if err != nil || len(ts.archives(t)) != 1 {
+		t.Fatalf("valid export pruned: %v, archives %q", err, ts.archives(t))
+	}
+
+	export.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := ts.stores.Exports.Save(ctx, export); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.downloadExport(t, token); status != http.StatusNotFound {
+		t.Errorf("download of an expired export: got %d, want %d", status, http.StatusNotFound)
+	}
+	if err := ts.h.PruneExports(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.stores.Exports.Get(ctx, user.ID); !errors.Is(err, database.ErrExportNotFound) {
+		t.Errorf("expired export: got %v, want %v", err, database.ErrExportNotFound)
+	}
+	if got := ts.archives(t); len(got) != 0 {
+		t.Errorf("archives left after pruning: %q", got)
+	}
+}
@@ -1,9 +1,8 @@
 package handlers
 
 import (
-	"context"
 	"errors"
-	//"log"
+	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -11,22 +10,104 @@ import (
 	"net/mail"
 
 	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"example.com/my/module/oidc"
+	"example.com/my/module/passwords"
+	"example.com/my/module/tokens"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
-type User struct {
-	ID        string    `json:"id" bson:"id"`
-	Firstname string    `json:"firstname" bson:"firstname"`
-	Lastname  string    `json:"lastname" bson:"lastname"`
-	Email     string    `json:"email" bson:"email"`
-	Password  string    `json:"password" bson:"password"`
-	Confirmpassword string `json:"confirmpassword" bson:"confirmpassword"`
-	CreatedAt time.Time `json:"createdat" bson:"createdat"`
+// Config holds the settings of the handlers.
+type Config struct {
+	// AppURL is the address of the web app, which the links in emails point to.
+	AppURL string
+	// RequireVerifiedEmail stops users from logging in before they verified
+	// their email address.
+	RequireVerifiedEmail bool
+	// AdminEmails become admins once they are verified.
+	AdminEmails []string
+	// TOTPIssuer is the account name shown in authenticator apps.
+	TOTPIssuer string
+	// IntrospectionSecret must be presented by services calling /introspect.
+	// Without it anyone may introspect, which is only acceptable when the
+	// endpoint isn't exposed.
+	IntrospectionSecret string
+	// OIDCProviders are the external providers users can log in with.
+	OIDCProviders []*oidc.Provider
+	// PasswordPolicy applies to every new password.
+	PasswordPolicy passwords.Policy
+	// FileServiceURL is where the fileChunksUpload service listens. Avatars
+	// are stored there.
+	FileServiceURL string
+	// ExportDir is where data exports are written. With several instances
+	// it has to be shared between them.
+	ExportDir string
+	// Cookie holds the attributes of the session cookie. Other cookies use
+	// its domain and security attributes.
+	Cookie sessions.Options
+}
+
+// Handlers serves the HTTP API. Everything it depends on is passed to New, so
+// that it can run against in-memory stores.
+type Handlers struct {
+	users         database.UserRepository
+	sessions      database.SessionStore
+	refreshTokens database.RefreshTokenStore
+	oneTimeTokens database.OneTimeTokenStore
+	loginAttempts database.LoginAttemptStore
+	clients       database.ClientStore
+	authCodes     database.AuthorizationCodeStore
+	consents      database.ConsentStore
+	apiKeys       database.APIKeyStore
+	auditLog      database.AuditStore
+	exports       database.ExportStore
+	chat          database.ChatStore
+	mailer        mailer.Mailer
+	tokens        *tokens.Issuer
+	cfg           Config
+
+	// Verification emails can be resent a few times an hour per address and
+	// per client, so the endpoint can't be used to flood someone's inbox.
+	resendPerEmail *rateLimiter
+	resendPerIP    *rateLimiter
+	// Login links and password reset links are limited the same way.
+	magicLinkPerEmail *rateLimiter
+	magicLinkPerIP    *rateLimiter
+	forgotPerEmail    *rateLimiter
+	forgotPerIP       *rateLimiter
+	// Each login challenge gets a handful of attempts, otherwise the six
+	// digits could simply be guessed.
+	secondFactorAttempts *rateLimiter
+}
+
+func New(stores *database.Stores, m mailer.Mailer, issuer *tokens.Issuer, cfg Config) *Handlers {
+	return &Handlers{
+		users:                stores.Users,
+		sessions:             stores.Sessions,
+		refreshTokens:        stores.RefreshTokens,
+		oneTimeTokens:        stores.OneTimeTokens,
+		loginAttempts:        stores.LoginAttempts,
+		clients:              stores.Clients,
+		authCodes:            stores.AuthorizationCodes,
+		consents:             stores.Consents,
+		apiKeys:              stores.APIKeys,
+		auditLog:             stores.Audit,
+		exports:              stores.Exports,
+		chat:                 stores.Chat,
+		mailer:               m,
+		tokens:               issuer,
+		cfg:                  cfg,
+		resendPerEmail:       newRateLimiter(3, time.Hour),
+		resendPerIP:          newRateLimiter(10, time.Hour),
+		magicLinkPerEmail:    newRateLimiter(5, time.Hour),
+		magicLinkPerIP:       newRateLimiter(20, time.Hour),
+		forgotPerEmail:       newRateLimiter(3, time.Hour),
+		forgotPerIP:          newRateLimiter(10, time.Hour),
+		secondFactorAttempts: newRateLimiter(5, LoginChallengeLifetime),
+	}
 }
 
 func validMailAddress(address string) bool {
@@ -34,57 +115,63 @@ func validMailAddress(address string) bool {
 	return err == nil
 }
 
-func RegisterHandler(c *gin.Context) {
-	var user User
-	user.CreatedAt = time.Now()
+// registerRequest is all a client may choose when registering. Everything
+// else about a new user, such as linked identities or the role, is set by
+// the server.
+type registerRequest struct {
+	Firstname       string `json:"firstname"`
+	Lastname        string `json:"lastname"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	Confirmpassword string `json:"confirmpassword"`
+}
 
-	// Bind JSON data to the user struct
-	if err := c.BindJSON(&user); err != nil {
+func (h *Handlers) RegisterHandler(c *gin.Context) {
+	var req registerRequest
+	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
 
-	// Trim whitespace from user input
-	user.Firstname = strings.TrimSpace(user.Firstname)
-	user.Lastname = strings.TrimSpace(user.Lastname)
-	user.Email = strings.TrimSpace(user.Email)
-	user.Password = strings.TrimSpace(user.Password)
-	user.Confirmpassword=strings.TrimSpace(user.Confirmpassword)
-
-
-	// Check if any of the required fields are empty
-	if user.Firstname == "" || user.Lastname == "" || user.Email == "" || user.Password == "" || user.Confirmpassword==""{
-		c.JSON(http.StatusBadRequest, gin.H{"error": "All fields are mandatory"})
-		return
+	// Trim whitespace from user input, but not from the password, where it
+	// is part of what the user chose
+	user := database.User{
+		Firstname: strings.TrimSpace(req.Firstname),
+		Lastname:  strings.TrimSpace(req.Lastname),
+		Email:     strings.TrimSpace(req.Email),
+		Password:  req.Password,
+		CreatedAt: time.Now(),
+		Role:      database.RoleUser,
 	}
 
-	if !validMailAddress(user.Email) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+	errs := fieldErrors{}
+	if user.Firstname == "" {
+		errs.add("firstname", "Required")
+	}
+	if user.Lastname == "" {
+		errs.add("lastname", "Required")
+	}
+	if user.Email == "" {
+		errs.add("email", "Required")
+	} else if !validMailAddress(user.Email) {
+		errs.add("email", "Invalid email format")
+	}
+	h.checkNewPassword(errs, "password", req.Password, "confirmpassword", req.Confirmpassword)
+	if len(errs) > 0 {
+		respondInvalid(c, errs)
 		return
 	}
 
-	var existingUser User
-	// Check if the user already exists based on firstname, lastname, or email
-	if err := database.UserCollection.FindOne(context.TODO(), bson.M{
-		"$and": []bson.M{
-			{"firstname": user.Firstname},
-			{"lastname": user.Lastname},
-			{"email": user.Email},
-		},
-	}).Decode(&existingUser); err == nil {
+	// Check if the user already exists based on email
+	if _, err := h.users.GetByEmail(c.Request.Context(), user.Email); err == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User already exists"})
 		return
 	}
 
-	// Generate a new UUID for the user ID
+	// Generate a new UUID for the user ID. The address is only trusted once
+	// the user clicked the emailed link, so EmailVerified stays false.
 	user.ID = uuid.New().String()
 
-	if user.Password!=user.Confirmpassword{
-		c.JSON(http.StatusBadRequest, gin.H{"error":"Password and confirm password do not match"})
-		//log.Fatal(user.Password);
-		
-		return
-	}
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -96,150 +183,165 @@ func RegisterHandler(c *gin.Context) {
 	// Insert the user into the database
 
 	
-	_, err = database.UserCollection.InsertOne(context.Background(), user)
+	err = h.users.Create(c.Request.Context(), &user)
+	if errors.Is(err, database.ErrEmailTaken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully"})
+	h.audit(c, auditEvent{Type: database.AuditRegistered, UserID: user.ID, Email: user.Email})
+
+	if err := h.sendVerificationEmail(c.Request.Context(), &user); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", user.Email, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully, check your email to verify your address"})
 	
 }
 
-func LoginHandler(c *gin.Context) {
-	var user User
+func (h *Handlers) LoginHandler(c *gin.Context) {
+	var user database.User
 	if err := c.BindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
 
-	filter := bson.M{"email": user.Email}
+	ctx := c.Request.Context()
 
-	var result User
-	if err := database.UserCollection.FindOne(context.TODO(), filter).Decode(&result); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not registered"})
-		} else {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		}
+	remaining, err := h.lockoutRemaining(ctx, emailAttemptKey(user.Email), ipAttemptKey(c.ClientIP()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(result.Password), []byte(user.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if remaining > 0 {
+		h.audit(c, auditEvent{Type: database.AuditLoginFailed, Email: user.Email, Details: map[string]string{"reason": "locked_out"}})
+		tooManyAttempts(c, remaining)
 		return
 	}
 
-	session := sessions.Default(c)
-	session.Set("userID", result.ID)
-	if err := session.Save(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+	// Unknown emails and wrong passwords get the same answer in the same time,
+	// so the login can't be used to find out who has an account
+	result, err := h.users.GetByEmail(ctx, user.Email)
+	if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+	hash := dummyPasswordHash
+	// Accounts created through a login provider may not have a password
+	if err == nil && result.Password != "" {
+		hash = []byte(result.Password)
+	}
+	passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(user.Password)) == nil
+	// Passwords used to be trimmed on registration, so some accounts only
+	// match without the whitespace the user types
+	if trimmed := strings.TrimSpace(user.Password); !passwordOK && trimmed != user.Password {
+		passwordOK = bcrypt.CompareHashAndPassword(hash, []byte(trimmed)) == nil
+	}
+	if !passwordOK || err != nil || result.Password == "" {
+		if err := h.recordLoginFailure(ctx, user.Email, c.ClientIP()); err != nil {
+			log.Printf("Failed to record failed login: %v", err)
+		}
+		event := auditEvent{Type: database.AuditLoginFailed, Email: user.Email, Details: map[string]string{"reason": "invalid_credentials"}}
+		if result != nil {
+			event.UserID = result.ID
+		}
+		h.audit(c, event)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if err := h.loginAttempts.Reset(ctx, emailAttemptKey(user.Email)); err != nil {
+		log.Printf("Failed to reset failed logins: %v", err)
+	}
+	if h.cfg.RequireVerifiedEmail && !result.EmailVerified {
+		h.audit(c, auditEvent{Type: database.AuditLoginFailed, UserID: result.ID, Email: result.Email, Details: map[string]string{"reason": "email_not_verified"}})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Please verify your email address before logging in"})
 		return
 	}
-	session.Save()
-	sessionID := session.ID()
 
-	// Set the session cookie in the response headers
-	c.SetCookie("mysession", sessionID, 3600, "/", "localhost", false, true)
-	c.JSON(http.StatusOK, gin.H{"message": "Logged in successfully"})
+	// The password alone isn't enough when two-factor authentication is on
+	if result.TOTPEnabled {
+		h.startLoginChallenge(c, result.ID)
+		return
+	}
+	// Clients that can't keep the session cookie ask for tokens instead
+	h.completeLogin(c, result.ID)
 }
 
-func ProfileHandler(c *gin.Context) {
-	session := sessions.Default(c)
-	userID := session.Get("userID")
-	if userID == nil {
+func (h *Handlers) ProfileHandler(c *gin.Context) {
+	userID := c.GetString("userID")
+	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
 		return
 	}
-	var user User
-	filter := bson.M{"id": userID.(string)} // Convert userID to string if it's not already
-	if err := database.UserCollection.FindOne(context.TODO(), filter).Decode(&user); err != nil {
+	user, err := h.users.GetByID(c.Request.Context(), userID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Profile Accessed", "user": user})
+	c.JSON(http.StatusOK, gin.H{"message": "Profile Accessed", "user": publicUser(user)})
 }
 
-func LogoutHandler(c *gin.Context) {
-	session := sessions.Default(c)
-	session.Clear()
-	if err := session.Save(); err != nil {
+// LogoutHandler ends the browser session. It only answers POST, so it goes
+// through the CSRF check and another site can't log the user out.
+func (h *Handlers) LogoutHandler(c *gin.Context) {
+	// Revoke the session on the server so the cookie can't be reused
+	err := h.sessions.Delete(c.Request.Context(), c.GetString("sessionID"))
+	if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear session"})
 		return
 	}
+	h.audit(c, auditEvent{Type: database.AuditLogout, UserID: c.GetString("userID"), Details: map[string]string{"session_id": c.GetString("sessionID")}})
 
-	// Remove the session cookie from the response headers
-	c.SetCookie("mysession", "", -1, "/", "localhost", false, true)
+	// Remove the session cookie from the browser
+	h.clearSessionCookie(c)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
 
 
 
-func GetAllUsers(c *gin.Context) {
-    filter := bson.M{}
-    var users []User
-    cursor, err := database.UserCollection.Find(context.Background(), filter)
+func (h *Handlers) GetAllUsers(c *gin.Context) {
+    all, err := h.users.List(c.Request.Context())
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    defer cursor.Close(context.Background())
-
-    for cursor.Next(context.Background()) {
-        var user User
-        if err := cursor.Decode(&user); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
-        }
-        users = append(users, user)
-    }
 
-    if err := cursor.Err(); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+    users := []PublicUser{}
+    for i := range all {
+        users = append(users, publicUser(&all[i]))
     }
 
     c.JSON(http.StatusOK, users)
 }
 
 
-func GetSpecificUser(c *gin.Context) {
+func (h *Handlers) GetSpecificUser(c *gin.Context) {
     // Retrieve the email query parameter from the request
     email := c.Query("email")
 
-    // Define a filter to retrieve documents with the specified email
-    filter := bson.M{}
-    if email != "" {
-        filter = bson.M{"email": email}
+    // Listing everyone is what the directory is for
+    if email == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "email is required, use /directory to search for users"})
+        return
     }
 
     // Create a slice to store the results
-    var users []User
+    users := []PublicUser{}
 
-    // Perform the find operation with the filter
-    cursor, err := database.UserCollection.Find(context.Background(), filter)
-    if err != nil {
+    user, err := h.users.GetByEmail(c.Request.Context(), email)
+    if err != nil && !errors.Is(err, database.ErrUserNotFound) {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-    defer cursor.Close(context.Background())
-
-    // Iterate over the cursor and decode each document into a User struct
-    for cursor.Next(context.Background()) {
-        var user User
-        if err := cursor.Decode(&user); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
-        }
-        users = append(users, user)
-    }
-
-    // Check if any error occurred during cursor iteration
-    if err := cursor.Err(); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+    if err == nil {
+        users = append(users, publicUser(user))
     }
 
     // Return the list of users as JSON response
     c.JSON(http.StatusOK, users)
-}
\ No newline at end of file
+}
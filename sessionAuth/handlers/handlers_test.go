@@ -0,0 +1,527 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"example.com/my/module/middleware"
+	"example.com/my/module/tokens"
+	"example.com/my/module/totp"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+const testAppURL = "http://app.test"
+
+// testServer runs the auth flows against in-memory stores.
+type testServer struct {
+	*httptest.Server
+	h      *Handlers
+	stores *database.Stores
+	mail   *mailer.MemoryMailer
+}
+
+// newTestServer starts the handlers with the given changes to the default
+// configuration.
+func newTestServer(t *testing.T, configure ...func(*Config)) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	key, err := tokens.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := tokens.NewIssuer(key, "http://auth.test", "test")
+	stores := database.NewMemoryStores()
+	mail := &mailer.MemoryMailer{}
+	cfg := Config{AppURL: testAppURL, TOTPIssuer: "Test", ExportDir: t.TempDir()}
+	for _, f := range configure {
+		f(&cfg)
+	}
+	h := New(stores, mail, issuer, cfg)
+	mw := middleware.New(stores.Sessions, stores.Users, stores.APIKeys, issuer)
+
+	// The CSRF check is left out, it has nothing to do with the flows tested here
+	router := gin.New()
+	router.Use(sessions.Sessions("mysession", cookie.NewStore([]byte("test session secret"))))
+	router.POST("/register", h.RegisterHandler)
+	router.POST("/login", h.LoginHandler)
+	router.POST("/login/2fa", h.LoginSecondFactorHandler)
+	router.GET("/profile", mw.AnyAuthMiddleware(), h.ProfileHandler)
+	router.POST("/password/change", mw.AnyAuthMiddleware(), h.ChangePasswordHandler)
+	router.POST("/email/change", mw.AnyAuthMiddleware(), h.ChangeEmailHandler)
+	router.DELETE("/account", mw.AnyAuthMiddleware(), h.DeleteAccountHandler)
+	router.POST("/2fa/disable", mw.AnyAuthMiddleware(), h.DisableTwoFactorHandler)
+	router.POST("/token/refresh", h.RefreshTokenHandler)
+	router.POST("/password/forgot", h.ForgotPasswordHandler)
+	router.POST("/password/reset", h.ResetPasswordHandler)
+	router.POST("/email/verify", h.VerifyEmailHandler)
+	router.GET("/auth/:provider/login", h.OIDCLoginHandler)
+	router.GET("/auth/:provider/callback", h.OIDCCallbackHandler)
+	router.GET("/auth/:provider/link", mw.AuthMiddleware(), h.OIDCLinkHandler)
+	router.GET("/oauth/authorize", h.AuthorizeHandler)
+	router.POST("/oauth/consent", mw.AuthMiddleware(), h.ConsentHandler)
+	router.POST("/oauth/token", h.OAuthTokenHandler)
+	router.POST("/introspect", h.IntrospectHandler)
+	router.GET("/userinfo", mw.ScopeMiddleware("profile"), h.UserInfoHandler)
+	router.GET("/apikeys", mw.AnyAuthMiddleware(), h.ListAPIKeysHandler)
+	router.POST("/apikeys", mw.AnyAuthMiddleware(), h.CreateAPIKeyHandler)
+	router.DELETE("/apikeys/:id", mw.AnyAuthMiddleware(), h.RevokeAPIKeyHandler)
+	router.GET("/users", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.GetAllUsers)
+	router.PUT("/admin/users/:id/role", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.SetRoleHandler)
+	router.GET("/directory", mw.AnyAuthMiddleware(), h.DirectoryHandler)
+	router.POST("/account/export", mw.AnyAuthMiddleware(), h.StartExportHandler)
+	router.GET("/account/export", mw.AnyAuthMiddleware(), h.ExportStatusHandler)
+	router.GET("/account/export/download", mw.AnyAuthMiddleware(), h.DownloadExportHandler)
+
+	ts := &testServer{Server: httptest.NewServer(router), h: h, stores: stores, mail: mail}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// browser returns a client that keeps cookies, like a browser would.
+func (ts *testServer) browser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// call sends body as JSON and decodes the JSON response.
+func (ts *testServer) call(t *testing.T, client *http.Client, method, path string, body any, header ...string) (int, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func (ts *testServer) register(t *testing.T, email, password string) {
+	t.Helper()
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/register", gin.H{
+		"firstname": "Anna", "lastname": "Smith", "email": email,
+		"password": password, "confirmpassword": password,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("register: got %d %v", status, body)
+	}
+}
+
+// accessToken registers a user and logs them in for tokens.
+func (ts *testServer) accessToken(t *testing.T, email string) string {
+	t.Helper()
+	ts.register(t, email, "correct horse")
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/login?tokens=true", gin.H{"email": email, "password": "correct horse"})
+	token, _ := body["access_token"].(string)
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("login: got %d %v", status, body)
+	}
+	return token
+}
+
+// waitForMail returns the newest message to the address with the subject.
+// Mail is sent in the background, so it may take a moment to arrive.
+func (ts *testServer) waitForMail(t *testing.T, to, subject string) mailer.Message {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if msg, ok := ts.mail.Last(to); ok && msg.Subject == subject {
+			return msg
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q mail to %s", subject, to)
+	return mailer.Message{}
+}
+
+// tokenFromLink returns the token of the first link in the mail to path.
+func tokenFromLink(t *testing.T, msg mailer.Message, path string) string {
+	t.Helper()
+	m := regexp.MustCompile(regexp.QuoteMeta(testAppURL+path) + `\?token=([^\s&]+)`).FindStringSubmatch(msg.Body)
+	if m == nil {
+		t.Fatalf("no %s link in %q", path, msg.Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+
+	msg := ts.waitForMail(t, "anna@example.com", "Verify your email address")
+	token := tokenFromLink(t, msg, "/verify-email")
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/email/verify", gin.H{"token": token}); status != http.StatusOK {
+		t.Fatalf("verify: got %d %v", status, body)
+	}
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/register", gin.H{
+		"firstname": "Anna", "lastname": "Smith", "email": "anna@example.com",
+		"password": "another one", "confirmpassword": "another one",
+	}); status != http.StatusBadRequest {
+		t.Errorf("registering the address again: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	browser := ts.browser(t)
+	if status, _ := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "wrong horse"}); status != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, body := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"}); status != http.StatusOK {
+		t.Fatalf("login: got %d %v", status, body)
+	}
+	status, body := ts.call(t, browser, http.MethodGet, "/profile", nil)
+	if status != http.StatusOK {
+		t.Fatalf("profile: got %d %v", status, body)
+	}
+	user, _ := body["user"].(map[string]any)
+	if user["email"] != "anna@example.com" || user["emailverified"] != true {
+		t.Errorf("profile: got %v", user)
+	}
+}
+
+func TestRegisterIgnoresServerFields(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/register", gin.H{
+		"firstname": "Anna", "lastname": "Smith", "email": "anna@example.com",
+		"password": "correct horse", "confirmpassword": "correct horse",
+		"role": database.RoleAdmin, "emailverified": true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("register: got %d %v", status, body)
+	}
+	user, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != database.RoleUser || user.EmailVerified {
+		t.Errorf("got role %q and verified %v, want a plain unverified user", user.Role, user.EmailVerified)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/register", gin.H{
+		"firstname": " ", "lastname": "Smith", "email": "not an address",
+		"password": "short", "confirmpassword": "different",
+	})
+	if status != http.StatusBadRequest {
+		t.Fatalf("got %d %v, want %d", status, body, http.StatusBadRequest)
+	}
+	if users, _ := ts.stores.Users.List(context.Background()); len(users) != 0 {
+		t.Errorf("got %d users, want the invalid one not stored", len(users))
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+
+	for i := 0; i < accountLockThreshold; i++ {
+		if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "wrong horse"}); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+	// Once locked, even the right password is refused
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/login", bytes.NewBufferString(`{"email":"anna@example.com","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("locked login: got %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("locked login has no Retry-After header")
+	}
+
+	// Other accounts aren't affected
+	ts.register(t, "ben@example.com", "correct horse")
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "ben@example.com", "password": "correct horse"}); status != http.StatusOK {
+		t.Errorf("other account: got %d %v", status, body)
+	}
+}
+
+func TestConfirmPasswordLockout(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	// Every change that asks for the password counts towards the same lock
+	confirmations := []struct {
+		method, path string
+		body         gin.H
+	}{
+		{http.MethodPost, "/password/change", gin.H{"currentpassword": "wrong horse", "newpassword": "battery staple", "confirmpassword": "battery staple"}},
+		{http.MethodPost, "/email/change", gin.H{"email": "anna.new@example.com", "password": "wrong horse"}},
+		{http.MethodDelete, "/account", gin.H{"password": "wrong horse"}},
+	}
+	wrong := func(i int) {
+		t.Helper()
+		try := confirmations[i%len(confirmations)]
+		if status, body := ts.call(t, http.DefaultClient, try.method, try.path, try.body, "Authorization", "Bearer "+token); status != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d on %s: got %d %v", i+1, try.path, status, body)
+		}
+	}
+
+	// The right password clears the failures, like a login does
+	for i := 0; i < accountLockThreshold-1; i++ {
+		wrong(i)
+	}
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/email/change", gin.H{"email": "anna.new@example.com", "password": "correct horse"}, "Authorization", "Bearer "+token); status != http.StatusOK {
+		t.Fatalf("email change: got %d %v", status, body)
+	}
+	for i := 0; i < accountLockThreshold; i++ {
+		wrong(i)
+	}
+
+	// Locked out, the right password doesn't work here or at the login
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/password/change", gin.H{"currentpassword": "correct horse", "newpassword": "battery staple", "confirmpassword": "battery staple"}, "Authorization", "Bearer "+token); status != http.StatusTooManyRequests {
+		t.Errorf("locked password change: got %d %v, want %d", status, body, http.StatusTooManyRequests)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"}); status != http.StatusTooManyRequests {
+		t.Errorf("locked login: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestLockoutFor(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{accountLockThreshold - 1, 0},
+		{accountLockThreshold, baseLockout},
+		{accountLockThreshold + 1, 2 * baseLockout},
+		{accountLockThreshold + 3, 8 * baseLockout},
+		{accountLockThreshold + 100, maxLockout},
+	}
+	for _, tt := range tests {
+		if got := lockoutFor(tt.failures, accountLockThreshold); got != tt.want {
+			t.Errorf("lockoutFor(%d): got %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// enableTOTP turns on two-factor authentication for the user and returns the
+// secret.
+func (ts *testServer) enableTOTP(t *testing.T, email string) string {
+	t.Helper()
+	user, err := ts.stores.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.TOTPEnabled = true
+	user.TOTPSecret = secret
+	if err := ts.stores.Users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestLoginSecondFactor(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+	secret := ts.enableTOTP(t, "anna@example.com")
+
+	browser := ts.browser(t)
+	status, body := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"})
+	if status != http.StatusOK || body["two_factor_required"] != true {
+		t.Fatalf("login: got %d %v, want a second factor challenge", status, body)
+	}
+	if status, _ := ts.call(t, browser, http.MethodGet, "/profile", nil); status != http.StatusUnauthorized {
+		t.Fatalf("profile before the second factor: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	if status, _ := ts.call(t, browser, http.MethodPost, "/login/2fa", gin.H{"code": "000000"}); status != http.StatusUnauthorized {
+		t.Errorf("wrong code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	code, err := totp.Code(secret, totp.Counter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The browser keeps the challenge in its cookie
+	if status, body := ts.call(t, browser, http.MethodPost, "/login/2fa", gin.H{"code": code}); status != http.StatusOK {
+		t.Fatalf("second factor: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, browser, http.MethodGet, "/profile", nil); status != http.StatusOK {
+		t.Errorf("profile after the second factor: got %d, want %d", status, http.StatusOK)
+	}
+
+	// A code can't be used twice, even for a new login
+	status, body = ts.call(t, http.DefaultClient, http.MethodPost, "/login?tokens=true", gin.H{"email": "anna@example.com", "password": "correct horse"})
+	if status != http.StatusOK {
+		t.Fatalf("second login: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login/2fa", gin.H{"login_token": body["login_token"], "code": code}); status != http.StatusUnauthorized {
+		t.Errorf("reused code: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLoginSecondFactorAttemptsLimited(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+	secret := ts.enableTOTP(t, "anna@example.com")
+
+	_, body := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"})
+	loginToken := body["login_token"]
+	for i := 0; i < 5; i++ {
+		ts.call(t, http.DefaultClient, http.MethodPost, "/login/2fa", gin.H{"login_token": loginToken, "code": "000000"})
+	}
+	code, err := totp.Code(secret, totp.Counter(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login/2fa", gin.H{"login_token": loginToken, "code": code}); status != http.StatusTooManyRequests {
+		t.Errorf("right code after too many attempts: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestDisableTwoFactorLockout(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.accessToken(t, "anna@example.com")
+	ts.enableTOTP(t, "anna@example.com")
+
+	for i := 0; i < accountLockThreshold; i++ {
+		if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/2fa/disable", gin.H{"password": "wrong horse", "code": "123456"}, "Authorization", "Bearer "+token); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/2fa/disable", gin.H{"password": "correct horse", "code": "123456"}, "Authorization", "Bearer "+token); status != http.StatusTooManyRequests {
+		t.Errorf("locked out: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+	user, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.TOTPEnabled {
+		t.Error("two-factor authentication was turned off")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+
+	status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/login?tokens=true", gin.H{"email": "anna@example.com", "password": "correct horse"})
+	if status != http.StatusOK {
+		t.Fatalf("login: got %d %v", status, body)
+	}
+	first, _ := body["refresh_token"].(string)
+	if first == "" || body["access_token"] == nil {
+		t.Fatalf("login: got %v, want tokens", body)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/profile", nil, "Authorization", "Bearer "+body["access_token"].(string)); status != http.StatusOK {
+		t.Errorf("profile with the access token: got %d, want %d", status, http.StatusOK)
+	}
+
+	status, body = ts.call(t, http.DefaultClient, http.MethodPost, "/token/refresh", gin.H{"refresh_token": first})
+	if status != http.StatusOK {
+		t.Fatalf("refresh: got %d %v", status, body)
+	}
+	second, _ := body["refresh_token"].(string)
+	if second == "" || second == first {
+		t.Fatalf("refresh: got refresh token %q, want a new one", second)
+	}
+
+	// Using the first token again means it leaked, which ends the whole login
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/token/refresh", gin.H{"refresh_token": first}); status != http.StatusUnauthorized {
+		t.Errorf("reused token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/token/refresh", gin.H{"refresh_token": second}); status != http.StatusUnauthorized {
+		t.Errorf("token of the revoked family: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/token/refresh", gin.H{"refresh_token": "made up"}); status != http.StatusUnauthorized {
+		t.Errorf("unknown token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+	browser := ts.browser(t)
+	if status, _ := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"}); status != http.StatusOK {
+		t.Fatal("login failed")
+	}
+	_, body := ts.call(t, http.DefaultClient, http.MethodPost, "/login?tokens=true", gin.H{"email": "anna@example.com", "password": "correct horse"})
+	refreshToken := body["refresh_token"]
+
+	// Unknown addresses get the same answer
+	known, knownBody := ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "anna@example.com"})
+	unknown, unknownBody := ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "nobody@example.com"})
+	if known != http.StatusOK || unknown != known || knownBody["message"] != unknownBody["message"] {
+		t.Errorf("forgot password: got %d %v for a known address and %d %v for an unknown one", known, knownBody, unknown, unknownBody)
+	}
+	token := tokenFromLink(t, ts.waitForMail(t, "anna@example.com", "Reset your password"), "/reset-password")
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", gin.H{"token": token, "password": "short", "confirmpassword": "short"}); status != http.StatusBadRequest {
+		t.Errorf("weak password: got %d, want %d", status, http.StatusBadRequest)
+	}
+	reset := gin.H{"token": token, "password": "battery staple", "confirmpassword": "battery staple"}
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", reset); status != http.StatusOK {
+		t.Fatalf("reset: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", reset); status != http.StatusBadRequest {
+		t.Errorf("reused reset link: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Everyone logged in with the old password is logged out
+	if status, _ := ts.call(t, browser, http.MethodGet, "/profile", nil); status != http.StatusUnauthorized {
+		t.Errorf("old session: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/token/refresh", gin.H{"refresh_token": refreshToken}); status != http.StatusUnauthorized {
+		t.Errorf("old refresh token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "correct horse"}); status != http.StatusUnauthorized {
+		t.Errorf("old password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/login", gin.H{"email": "anna@example.com", "password": "battery staple"}); status != http.StatusOK {
+		t.Errorf("new password: got %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestForgotPasswordRateLimited(t *testing.T) {
+	ts := newTestServer(t)
+	var status int
+	for i := 0; i < 4; i++ {
+		status, _ = ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "Anna@example.com"})
+	}
+	if status != http.StatusTooManyRequests {
+		t.Errorf("fourth request for the address: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
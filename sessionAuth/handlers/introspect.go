@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+// JWKSHandler publishes the public key access tokens are signed with.
+func (h *Handlers) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.tokens.JWKS())
+}
+
+// introspectionAllowed checks the caller against the introspection secret,
+// sent as a bearer token or as the basic auth password.
+func (h *Handlers) introspectionAllowed(c *gin.Context) bool {
+	secret := h.cfg.IntrospectionSecret
+	if secret == "" {
+		return true
+	}
+	given := ""
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		given = password
+	} else if scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		given = token
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// IntrospectHandler tells other services whether a token is active and who it
+// belongs to, following RFC 7662. Anything that isn't valid is reported as
+// inactive without saying why.
+func (h *Handlers) IntrospectHandler(c *gin.Context) {
+	if !h.introspectionAllowed(c) {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+	hint := c.PostForm("token_type_hint")
+
+	if strings.HasPrefix(token, database.APIKeyPrefix) {
+		k, err := h.apiKeys.FindByKey(c.Request.Context(), token)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+		if now := time.Now(); k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > time.Minute {
+			h.apiKeys.Touch(c.Request.Context(), k.ID, now)
+		}
+		resp := gin.H{
+			"active":     true,
+			"token_type": "api_key",
+			"sub":        k.UserID,
+			"scope":      strings.Join(k.Scopes, " "),
+			"iat":        k.CreatedAt.Unix(),
+		}
+		if k.ExpiresAt != nil {
+			resp["exp"] = k.ExpiresAt.Unix()
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	if hint != "refresh_token" {
+		if claims, err := h.tokens.Verify(token); err == nil {
+			resp := gin.H{
+				"active":     true,
+				"token_type": "access_token",
+				"sub":        claims.Subject,
+				"iss":        claims.Issuer,
+				"aud":        claims.Audience,
+				"exp":        claims.ExpiresAt.Unix(),
+				"iat":        claims.IssuedAt.Unix(),
+				"jti":        claims.ID,
+			}
+			if claims.ClientID != "" {
+				resp["client_id"] = claims.ClientID
+				resp["scope"] = claims.Scope
+			}
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+	}
+
+	rt, err := h.refreshTokens.FindByToken(c.Request.Context(), token)
+	if err == nil && rt.UsedAt == nil && rt.RevokedAt == nil {
+		resp := gin.H{
+			"active":     true,
+			"token_type": "refresh_token",
+			"sub":        rt.UserID,
+			"exp":        rt.ExpiresAt.Unix(),
+			"iat":        rt.CreatedAt.Unix(),
+		}
+		if rt.ClientID != "" {
+			resp["client_id"] = rt.ClientID
+			resp["scope"] = strings.Join(rt.Scopes, " ")
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"active": false})
+}
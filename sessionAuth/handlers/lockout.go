@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are allowed freely up to a threshold. After that every further
+// failure locks the account or address out, for twice as long each time.
+const (
+	accountLockThreshold = 5
+	ipLockThreshold      = 20
+	baseLockout          = time.Minute
+	maxLockout           = time.Hour
+)
+
+// dummyPasswordHash is compared against when the email is unknown, so that
+// the response takes as long as for a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+func emailAttemptKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockoutRemaining returns how long the longest lock on any of the keys still
+// lasts.
+func (h *Handlers) lockoutRemaining(ctx context.Context, keys ...string) (time.Duration, error) {
+	var remaining time.Duration
+	for _, key := range keys {
+		a, err := h.loginAttempts.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if left := time.Until(a.LockedUntil); left > remaining {
+			remaining = left
+		}
+	}
+	return remaining, nil
+}
+
+// lockoutFor returns how long to lock after the given number of failures.
+func lockoutFor(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := baseLockout
+	for i := threshold; i < failures && d < maxLockout; i++ {
+		d *= 2
+	}
+	if d > maxLockout {
+		d = maxLockout
+	}
+	return d
+}
+
+// recordLoginFailure counts a failed login for the account and the client
+// address, locking either once it crossed its threshold.
+func (h *Handlers) recordLoginFailure(ctx context.Context, email, ip string) error {
+	now := time.Now()
+	for key, threshold := range map[string]int{emailAttemptKey(email): accountLockThreshold, ipAttemptKey(ip): ipLockThreshold} {
+		a, err := h.loginAttempts.RecordFailure(ctx, key, now)
+		if err != nil {
+			return err
+		}
+		if d := lockoutFor(a.Failures, threshold); d > 0 {
+			if err := h.loginAttempts.Lock(ctx, key, now.Add(d)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tooManyAttempts tells the client when it may try again.
+func tooManyAttempts(c *gin.Context, remaining time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds()+0.5)))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, please try again later"})
+}
+
+// confirmPassword checks the password a logged in user gives to confirm a
+// change. Wrong passwords count as failed logins and lock the account the
+// same way, so a stolen session can't be used to guess it. Unless the
+// password is right it responds itself, with wrong as the error.
+func (h *Handlers) confirmPassword(c *gin.Context, user *database.User, password, wrong string) bool {
+	ctx := c.Request.Context()
+	remaining, err := h.lockoutRemaining(ctx, emailAttemptKey(user.Email), ipAttemptKey(c.ClientIP()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password"})
+		return false
+	}
+	if remaining > 0 {
+		h.audit(c, auditEvent{Type: database.AuditLoginFailed, UserID: user.ID, Email: user.Email, Details: map[string]string{"reason": "locked_out"}})
+		tooManyAttempts(c, remaining)
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		if err := h.recordLoginFailure(ctx, user.Email, c.ClientIP()); err != nil {
+			log.Printf("Failed to record failed login: %v", err)
+		}
+		h.audit(c, auditEvent{Type: database.AuditLoginFailed, UserID: user.ID, Email: user.Email, Details: map[string]string{"reason": "invalid_credentials"}})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": wrong})
+		return false
+	}
+	if err := h.loginAttempts.Reset(ctx, emailAttemptKey(user.Email)); err != nil {
+		log.Printf("Failed to reset failed logins: %v", err)
+	}
+	return true
+}
+
+// ListLockoutsHandler shows the accounts and addresses that are locked out.
+func (h *Handlers) ListLockoutsHandler(c *gin.Context) {
+	locked, err := h.loginAttempts.ListLocked(c.Request.Context(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list lockouts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": locked})
+}
+
+// ClearLockoutHandler lifts a lockout early, for example after the owner of
+// the account got in touch.
+func (h *Handlers) ClearLockoutHandler(c *gin.Context) {
+	if err := h.loginAttempts.Reset(c.Request.Context(), c.Param("key")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared"})
+}
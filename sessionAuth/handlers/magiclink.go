@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// MagicLinkLifetime is how long an emailed login link works.
+const MagicLinkLifetime = 15 * time.Minute
+
+// magicLinkCookie holds the nonce that ties a login link to the browser that
+// asked for it, so a link that leaks from the inbox can't be used elsewhere.
+const magicLinkCookie = "magic_login"
+
+type magicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+// MagicLinkHandler emails a link that logs the user in without a password.
+// The response is the same whether or not the address belongs to an account.
+func (h *Handlers) MagicLinkHandler(c *gin.Context) {
+	var req magicLinkRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validMailAddress(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		return
+	}
+	if !h.magicLinkPerIP.allow(c.ClientIP()) || !h.magicLinkPerEmail.allow(strings.ToLower(email)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please try again later"})
+		return
+	}
+	ctx := c.Request.Context()
+	const message = "If an account exists for this address, a login link has been sent"
+
+	// Every request gets a nonce cookie, otherwise its absence would tell
+	// that the address has no account
+	nonce, err := newToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+	h.setCookie(c, magicLinkCookie, nonce, int(MagicLinkLifetime.Seconds()))
+
+	user, err := h.users.GetByEmail(ctx, email)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": message})
+		return
+	}
+
+	if err := h.oneTimeTokens.DeleteByUser(ctx, user.ID, database.PurposeMagicLink); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+	token, err := newToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+	now := time.Now()
+	err = h.oneTimeTokens.Create(ctx, &database.OneTimeToken{
+		ID:        uuid.New().String(),
+		TokenHash: database.HashToken(token),
+		Purpose:   database.PurposeMagicLink,
+		UserID:    user.ID,
+		NonceHash: database.HashToken(nonce),
+		CreatedAt: now,
+		ExpiresAt: now.Add(MagicLinkLifetime),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+
+	link := h.cfg.AppURL + "/magic-login?token=" + url.QueryEscape(token)
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within 15 minutes, in the same browser you asked for it from, to log in:\n\n%s\n\n"+
+			"If you didn't ask for it, you can ignore this email.\n", user.Firstname, link),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+type magicLinkCallbackRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// MagicLinkCallbackHandler logs in the user a login link was sent to, the same
+// way LoginHandler does. Following the link proves the address is theirs.
+func (h *Handlers) MagicLinkCallbackHandler(c *gin.Context) {
+	var req magicLinkCallbackRequest
+	if err := c.ShouldBind(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+	ctx := c.Request.Context()
+	const invalid = "Login link is invalid or has expired"
+
+	// The nonce is checked before the token is used up, so opening the link
+	// in another browser doesn't spoil it
+	t, err := h.oneTimeTokens.Find(ctx, database.PurposeMagicLink, req.Token)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login link"})
+		return
+	}
+	nonce, _ := c.Cookie(magicLinkCookie)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(database.HashToken(nonce)), []byte(t.NonceHash)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Open the link in the browser you asked for it from"})
+		return
+	}
+	_, err = h.oneTimeTokens.Consume(ctx, database.PurposeMagicLink, req.Token)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login link"})
+		return
+	}
+	h.setCookie(c, magicLinkCookie, "", -1)
+
+	user, err := h.users.GetByID(ctx, t.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if !user.EmailVerified {
+		h.markEmailVerified(user)
+		if err := h.users.Update(ctx, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			return
+		}
+	}
+
+	if user.TOTPEnabled {
+		h.startLoginChallenge(c, user.ID)
+		return
+	}
+	h.completeLogin(c, user.ID)
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerificationMail(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+
+	msg := ts.waitForMail(t, "anna@example.com", "Verify your email address")
+	if !strings.HasPrefix(msg.Body, "Hi Anna,") {
+		t.Errorf("mail doesn't greet the user: %q", msg.Body)
+	}
+	token := tokenFromLink(t, msg, "/verify-email")
+	if n := len(ts.mail.Sent()); n != 1 {
+		t.Errorf("got %d mails, want 1", n)
+	}
+
+	// The link is for verifying only, it can't reset the password
+	reset := gin.H{"token": token, "password": "battery staple", "confirmpassword": "battery staple"}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", reset); status != http.StatusBadRequest {
+		t.Errorf("verification token used for a reset: got %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/email/verify", gin.H{"token": token}); status != http.StatusOK {
+		t.Fatalf("verify: got %d %v", status, body)
+	}
+	user, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Error("the address isn't verified after following the link")
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/email/verify", gin.H{"token": token}); status != http.StatusBadRequest {
+		t.Errorf("reused verification link: got %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestResetMail(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "anna@example.com", "correct horse")
+	ts.waitForMail(t, "anna@example.com", "Verify your email address")
+
+	ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "nobody@example.com"})
+	ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "anna@example.com"})
+	msg := ts.waitForMail(t, "anna@example.com", "Reset your password")
+	first := tokenFromLink(t, msg, "/reset-password")
+
+	// Asking again replaces the link
+	ts.call(t, http.DefaultClient, http.MethodPost, "/password/forgot", gin.H{"email": "anna@example.com"})
+	deadline := time.Now().Add(2 * time.Second)
+	var second string
+	for second == "" || second == first {
+		if time.Now().After(deadline) {
+			t.Fatal("no second reset mail")
+		}
+		time.Sleep(10 * time.Millisecond)
+		second = tokenFromLink(t, ts.waitForMail(t, "anna@example.com", "Reset your password"), "/reset-password")
+	}
+	for _, sent := range ts.mail.Sent() {
+		if sent.To != "anna@example.com" {
+			t.Errorf("mail sent to %s, which has no account", sent.To)
+		}
+	}
+
+	reset := gin.H{"token": first, "password": "battery staple", "confirmpassword": "battery staple"}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", reset); status != http.StatusBadRequest {
+		t.Errorf("replaced reset link: got %d, want %d", status, http.StatusBadRequest)
+	}
+	reset["token"] = second
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/password/reset", reset); status != http.StatusOK {
+		t.Errorf("latest reset link: got %d %v", status, body)
+	}
+}
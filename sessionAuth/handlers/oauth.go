@@ -0,0 +1,689 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AuthorizationCodeLifetime is how long a client has to exchange a code.
+const AuthorizationCodeLifetime = 5 * time.Minute
+
+// scopes are what OAuth clients can ask for, in the order they are shown on
+// the consent screen.
+var scopes = []struct{ Name, Description string }{
+	{"profile", "See your name and email address"},
+	{"chat:read", "Read your conversations and messages"},
+	{"chat:write", "Send messages as you"},
+	{"files:read", "Download your files"},
+	{"files:write", "Upload files as you"},
+}
+
+func knownScope(name string) bool {
+	for _, s := range scopes {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// validRedirectURI accepts https addresses, http on the local machine for
+// development and native apps, and the private URI schemes of mobile apps.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	case "javascript", "data", "file", "vbscript":
+		return false
+	}
+	// Private schemes are reverse domain names, such as com.example.app
+	return strings.Contains(u.Scheme, ".")
+}
+
+type createClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	GrantTypes   []string `json:"grant_types"`
+	Public       bool     `json:"public"`
+	FirstParty   bool     `json:"first_party"`
+}
+
+// CreateClientHandler registers an OAuth client. The secret of a confidential
+// client is only shown in the response.
+func (h *Handlers) CreateClientHandler(c *gin.Context) {
+	var req createClientRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if len(req.GrantTypes) == 0 {
+		req.GrantTypes = []string{database.GrantAuthorizationCode, database.GrantRefreshToken}
+	}
+	for _, g := range req.GrantTypes {
+		switch g {
+		case database.GrantAuthorizationCode, database.GrantRefreshToken:
+		case database.GrantClientCredentials:
+			if req.Public {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Public clients can't use client credentials"})
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown grant type " + g})
+			return
+		}
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, s := range req.Scopes {
+		if !knownScope(s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + s})
+			return
+		}
+	}
+	client := &database.OAuthClient{
+		ID:           uuid.New().String(),
+		Name:         req.Name,
+		RedirectURIs: []string{},
+		Scopes:       req.Scopes,
+		GrantTypes:   req.GrantTypes,
+		FirstParty:   req.FirstParty,
+		CreatedBy:    c.GetString("userID"),
+		CreatedAt:    time.Now(),
+	}
+	if client.AllowsGrant(database.GrantAuthorizationCode) {
+		if len(req.RedirectURIs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one redirect URI is required"})
+			return
+		}
+		for _, uri := range req.RedirectURIs {
+			if !validRedirectURI(uri) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid redirect URI " + uri})
+				return
+			}
+		}
+		client.RedirectURIs = req.RedirectURIs
+	}
+
+	resp := gin.H{"client": client}
+	if !req.Public {
+		secret, err := newToken(32)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client secret"})
+			return
+		}
+		client.SecretHash = database.HashToken(secret)
+		resp["client_secret"] = secret
+	}
+	if err := h.clients.Create(c.Request.Context(), client); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client"})
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// ListClientsHandler lists the registered OAuth clients.
+func (h *Handlers) ListClientsHandler(c *gin.Context) {
+	clients, err := h.clients.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list clients"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+// DeleteClientHandler removes an OAuth client along with the consents users
+// gave it and its refresh tokens.
+func (h *Handlers) DeleteClientHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	err := h.clients.Delete(ctx, id)
+	if errors.Is(err, database.ErrClientNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete client"})
+		return
+	}
+	if err := h.consents.DeleteByClient(ctx, id); err != nil {
+		log.Printf("Failed to delete consents of client %s: %v", id, err)
+	}
+	if err := h.refreshTokens.RevokeClient(ctx, id, ""); err != nil {
+		log.Printf("Failed to revoke refresh tokens of client %s: %v", id, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted"})
+}
+
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+}
+
+// authorization is a checked authorization request.
+type authorization struct {
+	client      *database.OAuthClient
+	redirectURI string
+	scopes      []string
+	state       string
+	challenge   string
+}
+
+// oauthError is an error the client is told about, following RFC 6749.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+// parseAuthorization checks the authorization request in the query. Without
+// a known client and one of its redirect URIs the user can't be sent back, so
+// the second result reports whether the error may be redirected.
+func (h *Handlers) parseAuthorization(c *gin.Context) (*authorization, bool, *oauthError) {
+	var req authorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		return nil, false, &oauthError{"invalid_request", "Invalid authorization request"}
+	}
+	client, err := h.clients.Get(c.Request.Context(), req.ClientID)
+	if err != nil {
+		return nil, false, &oauthError{"invalid_client", "Unknown client"}
+	}
+	a := &authorization{client: client, redirectURI: req.RedirectURI, state: req.State}
+	if a.redirectURI == "" && len(client.RedirectURIs) == 1 {
+		a.redirectURI = client.RedirectURIs[0]
+	}
+	if !containsAll(client.RedirectURIs, []string{a.redirectURI}) || a.redirectURI == "" {
+		return nil, false, &oauthError{"invalid_request", "Redirect URI is not registered for this client"}
+	}
+
+	if req.ResponseType != "code" {
+		return a, true, &oauthError{"unsupported_response_type", "Only the code response type is supported"}
+	}
+	if !client.AllowsGrant(database.GrantAuthorizationCode) {
+		return a, true, &oauthError{"unauthorized_client", "Client may not use the authorization code grant"}
+	}
+	// PKCE protects the code on its way through the browser, for every client
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return a, true, &oauthError{"invalid_request", "A S256 code challenge is required"}
+	}
+	a.challenge = req.CodeChallenge
+	a.scopes = strings.Fields(req.Scope)
+	if len(a.scopes) == 0 {
+		a.scopes = client.Scopes
+	}
+	if !containsAll(client.Scopes, a.scopes) {
+		return a, true, &oauthError{"invalid_scope", "Client may not ask for these scopes"}
+	}
+	return a, true, nil
+}
+
+// redirectURL adds the parameters to the client's redirect URI.
+func redirectURL(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	for key, values := range params {
+		for _, v := range values {
+			if v != "" {
+				q.Add(key, v)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (a *authorization) errorURL(e *oauthError) string {
+	return redirectURL(a.redirectURI, url.Values{
+		"error":             {e.Code},
+		"error_description": {e.Description},
+		"state":             {a.state},
+	})
+}
+
+// codeURL issues an authorization code and returns where to send the user
+// with it.
+func (h *Handlers) codeURL(ctx context.Context, a *authorization, userID string) (string, error) {
+	code, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = h.authCodes.Create(ctx, &database.AuthorizationCode{
+		ID:            uuid.New().String(),
+		CodeHash:      database.HashToken(code),
+		ClientID:      a.client.ID,
+		UserID:        userID,
+		RedirectURI:   a.redirectURI,
+		Scopes:        a.scopes,
+		CodeChallenge: a.challenge,
+		FamilyID:      uuid.New().String(),
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(AuthorizationCodeLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	return redirectURL(a.redirectURI, url.Values{"code": {code}, "state": {a.state}}), nil
+}
+
+// sessionUserID returns the user logged in with the session cookie, if any.
+func (h *Handlers) sessionUserID(c *gin.Context) string {
+	token, _ := sessions.Default(c).Get(database.SessionTokenKey).(string)
+	if token == "" {
+		return ""
+	}
+	s, err := h.sessions.FindByToken(c.Request.Context(), token)
+	if err != nil {
+		return ""
+	}
+	return s.UserID
+}
+
+// consented reports whether the user doesn't have to be asked before the
+// client gets the scopes.
+func (h *Handlers) consented(ctx context.Context, a *authorization, userID string) (bool, error) {
+	if a.client.FirstParty {
+		return true, nil
+	}
+	consent, err := h.consents.Get(ctx, userID, a.client.ID)
+	if errors.Is(err, database.ErrConsentNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return containsAll(consent.Scopes, a.scopes), nil
+}
+
+// AuthorizeHandler is where OAuth clients send the browser to ask for access.
+// Users who aren't logged in are sent to the login page of the web app, and
+// to its consent page if they haven't allowed the client the scopes yet.
+func (h *Handlers) AuthorizeHandler(c *gin.Context) {
+	a, redirect, oerr := h.parseAuthorization(c)
+	if oerr != nil {
+		if redirect {
+			c.Redirect(http.StatusFound, a.errorURL(oerr))
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": oerr.Description})
+		return
+	}
+
+	userID := h.sessionUserID(c)
+	if userID == "" {
+		c.Redirect(http.StatusFound, h.cfg.AppURL+"/login?return_to="+url.QueryEscape(c.Request.URL.RequestURI()))
+		return
+	}
+	ctx := c.Request.Context()
+	ok, err := h.consented(ctx, a, userID)
+	if err != nil {
+		c.Redirect(http.StatusFound, a.errorURL(&oauthError{"server_error", "Failed to check consent"}))
+		return
+	}
+	if !ok {
+		c.Redirect(http.StatusFound, h.cfg.AppURL+"/consent?"+c.Request.URL.RawQuery)
+		return
+	}
+
+	target, err := h.codeURL(ctx, a, userID)
+	if err != nil {
+		c.Redirect(http.StatusFound, a.errorURL(&oauthError{"server_error", "Failed to issue code"}))
+		return
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+type scopeInfo struct {
+	Scope       string `json:"scope"`
+	Description string `json:"description"`
+}
+
+func describeScopes(names []string) []scopeInfo {
+	infos := []scopeInfo{}
+	for _, s := range scopes {
+		if containsAll(names, []string{s.Name}) {
+			infos = append(infos, scopeInfo{s.Name, s.Description})
+		}
+	}
+	return infos
+}
+
+// ConsentInfoHandler tells the consent page of the web app what the client in
+// the authorization request asks for. The page is opened with the same query
+// as the authorization request.
+func (h *Handlers) ConsentInfoHandler(c *gin.Context) {
+	a, _, oerr := h.parseAuthorization(c)
+	if oerr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": oerr.Description})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"client":       gin.H{"id": a.client.ID, "name": a.client.Name},
+		"scopes":       describeScopes(a.scopes),
+		"redirect_uri": a.redirectURI,
+	})
+}
+
+type consentRequest struct {
+	Approve bool `json:"approve"`
+}
+
+// ConsentHandler records the user's answer on the consent page and returns
+// where to send the browser, back to the client either way.
+func (h *Handlers) ConsentHandler(c *gin.Context) {
+	var req consentRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	a, _, oerr := h.parseAuthorization(c)
+	if oerr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": oerr.Description})
+		return
+	}
+	if !req.Approve {
+		c.JSON(http.StatusOK, gin.H{"redirect_to": a.errorURL(&oauthError{"access_denied", "The user denied access"})})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetString("userID")
+	granted := append([]string{}, a.scopes...)
+	if previous, err := h.consents.Get(ctx, userID, a.client.ID); err == nil {
+		for _, s := range previous.Scopes {
+			if !containsAll(granted, []string{s}) {
+				granted = append(granted, s)
+			}
+		}
+	}
+	err := h.consents.Save(ctx, &database.Consent{
+		UserID:    userID,
+		ClientID:  a.client.ID,
+		Scopes:    granted,
+		GrantedAt: time.Now(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save consent"})
+		return
+	}
+	target, err := h.codeURL(ctx, a, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue code"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect_to": target})
+}
+
+// ListConsentsHandler lists the apps the user allowed access to their account.
+func (h *Handlers) ListConsentsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	consents, err := h.consents.List(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list apps"})
+		return
+	}
+	apps := []gin.H{}
+	for _, consent := range consents {
+		client, err := h.clients.Get(ctx, consent.ClientID)
+		if err != nil {
+			continue
+		}
+		apps = append(apps, gin.H{
+			"client":    gin.H{"id": client.ID, "name": client.Name},
+			"scopes":    describeScopes(consent.Scopes),
+			"grantedat": consent.GrantedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"apps": apps})
+}
+
+// RevokeConsentHandler takes back an app's access. Its refresh tokens stop
+// working right away, access tokens it already has run out on their own.
+func (h *Handlers) RevokeConsentHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, clientID := c.GetString("userID"), c.Param("client_id")
+	err := h.consents.Delete(ctx, userID, clientID)
+	if err != nil && !errors.Is(err, database.ErrConsentNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access"})
+		return
+	}
+	if err := h.refreshTokens.RevokeClient(ctx, clientID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
+
+func tokenError(c *gin.Context, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// authenticateClient returns the client calling the token endpoint. Client
+// credentials are accepted with basic auth and in the form.
+func (h *Handlers) authenticateClient(c *gin.Context) (*database.OAuthClient, bool) {
+	id, secret, ok := c.Request.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, err := h.clients.Get(c.Request.Context(), id)
+	if errors.Is(err, database.ErrClientNotFound) || id == "" {
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "Unknown client")
+		return nil, false
+	}
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Failed to look up client")
+		return nil, false
+	}
+	if !client.Public() && subtle.ConstantTimeCompare([]byte(database.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "Invalid client credentials")
+		return nil, false
+	}
+	return client, true
+}
+
+// OAuthTokenHandler is the token endpoint of RFC 6749 for OAuth clients.
+func (h *Handlers) OAuthTokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	client, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+	grantType := c.PostForm("grant_type")
+	switch grantType {
+	case database.GrantAuthorizationCode, database.GrantRefreshToken, database.GrantClientCredentials:
+	default:
+		tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+		return
+	}
+	if !client.AllowsGrant(grantType) {
+		tokenError(c, http.StatusBadRequest, "unauthorized_client", "Client may not use this grant type")
+		return
+	}
+	switch grantType {
+	case database.GrantAuthorizationCode:
+		h.exchangeCode(c, client)
+	case database.GrantRefreshToken:
+		h.refreshClientToken(c, client)
+	case database.GrantClientCredentials:
+		h.issueClientCredentials(c, client)
+	}
+}
+
+func (h *Handlers) exchangeCode(c *gin.Context, client *database.OAuthClient) {
+	ctx := c.Request.Context()
+	code, err := h.authCodes.Consume(ctx, c.PostForm("code"))
+	if errors.Is(err, database.ErrAuthorizationCodeUsed) {
+		// Someone else has the code, whatever was issued for it can't be trusted
+		if err := h.refreshTokens.RevokeFamily(ctx, code.FamilyID); err != nil {
+			log.Printf("Failed to revoke tokens of reused code: %v", err)
+		}
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+	if err != nil || code.ClientID != client.ID || code.RedirectURI != c.PostForm("redirect_uri") {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+	sum := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != code.CodeChallenge {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Code verifier doesn't match the challenge")
+		return
+	}
+	if _, err := h.users.GetByID(ctx, code.UserID); err != nil {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+
+	resp, err := h.issueClientTokens(ctx, code.UserID, client, code.Scopes, code.FamilyID)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Failed to issue tokens")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handlers) refreshClientToken(c *gin.Context, client *database.OAuthClient) {
+	ctx := c.Request.Context()
+	token := c.PostForm("refresh_token")
+	// The client may ask for fewer scopes than it was granted, never more.
+	// Asking for too much is refused before the token is used up, so it
+	// doesn't cost the client its login.
+	requested := strings.Fields(c.PostForm("scope"))
+	if len(requested) > 0 {
+		if rt, err := h.refreshTokens.FindByToken(ctx, token); err == nil && rt.ClientID == client.ID && !containsAll(rt.Scopes, requested) {
+			tokenError(c, http.StatusBadRequest, "invalid_scope", "Scope exceeds what was granted")
+			return
+		}
+	}
+	rt, err := h.useRefreshToken(ctx, token, client.ID)
+	if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused) {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Failed to check refresh token")
+		return
+	}
+	granted := rt.Scopes
+	if len(requested) > 0 {
+		if !containsAll(rt.Scopes, requested) {
+			tokenError(c, http.StatusBadRequest, "invalid_scope", "Scope exceeds what was granted")
+			return
+		}
+		granted = requested
+	}
+
+	resp, err := h.issueClientTokens(ctx, rt.UserID, client, granted, rt.FamilyID)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Failed to issue tokens")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// issueClientCredentials gives a service a token of its own, with the client
+// as subject. There is no user who could log in again, so there is no
+// refresh token either.
+func (h *Handlers) issueClientCredentials(c *gin.Context, client *database.OAuthClient) {
+	if client.Public() {
+		tokenError(c, http.StatusBadRequest, "unauthorized_client", "Public clients can't use client credentials")
+		return
+	}
+	granted := strings.Fields(c.PostForm("scope"))
+	if len(granted) == 0 {
+		granted = client.Scopes
+	}
+	if !containsAll(client.Scopes, granted) {
+		tokenError(c, http.StatusBadRequest, "invalid_scope", "Client may not ask for these scopes")
+		return
+	}
+	accessToken, expiresAt, err := h.tokens.IssueForClient(client.ID, client.ID, granted)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "Failed to issue tokens")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(expiresAt).Seconds()),
+		"scope":        strings.Join(granted, " "),
+	})
+}
+
+// UserInfoHandler returns the profile of the token's user in OpenID Connect
+// form, for clients granted the profile scope.
+func (h *Handlers) UserInfoHandler(c *gin.Context) {
+	user, err := h.users.GetByID(c.Request.Context(), c.GetString("userID"))
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sub":            user.ID,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"given_name":     user.Firstname,
+		"family_name":    user.Lastname,
+		"name":           strings.TrimSpace(user.Firstname + " " + user.Lastname),
+	})
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	testClientSecret = "client secret"
+	testRedirectURI  = "https://client.test/callback"
+	testVerifier     = "a verifier that is long enough to be hard to guess"
+)
+
+// addClient registers a client with the test redirect URI, by default a
+// third-party client using codes and refresh tokens. A secret makes it
+// confidential.
+func (ts *testServer) addClient(t *testing.T, client database.OAuthClient, secret string) *database.OAuthClient {
+	t.Helper()
+	client.ID = uuid.New().String()
+	client.Name = "Test client"
+	client.RedirectURIs = []string{testRedirectURI}
+	client.CreatedAt = time.Now()
+	if client.Scopes == nil {
+		client.Scopes = []string{"profile", "chat:read"}
+	}
+	if client.GrantTypes == nil {
+		client.GrantTypes = []string{database.GrantAuthorizationCode, database.GrantRefreshToken}
+	}
+	if secret != "" {
+		client.SecretHash = database.HashToken(secret)
+	}
+	if err := ts.stores.Clients.Create(context.Background(), &client); err != nil {
+		t.Fatal(err)
+	}
+	return &client
+}
+
+// loggedIn returns a browser with a session of a new user.
+func (ts *testServer) loggedIn(t *testing.T, email string) *http.Client {
+	t.Helper()
+	ts.register(t, email, "correct horse")
+	browser := ts.browser(t)
+	if status, body := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": email, "password": "correct horse"}); status != http.StatusOK {
+		t.Fatalf("login: got %d %v", status, body)
+	}
+	return browser
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeParams is an authorization request of the client with a PKCE
+// challenge of testVerifier.
+func authorizeParams(client *database.OAuthClient) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {testRedirectURI},
+		"state":                 {"some state"},
+		"code_challenge":        {challenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// authorize sends the browser to the authorization endpoint and returns the
+// status and where it was sent on to.
+func (ts *testServer) authorize(t *testing.T, browser *http.Client, params url.Values) (int, *url.URL) {
+	t.Helper()
+	client := *browser
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(ts.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, location
+}
+
+// code returns the code the authorization endpoint redirected to the client
+// with.
+func (ts *testServer) code(t *testing.T, browser *http.Client, params url.Values) string {
+	t.Helper()
+	status, location := ts.authorize(t, browser, params)
+	if status != http.StatusFound || !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+		t.Fatalf("authorize: got %d to %s, want a redirect to the client", status, location)
+	}
+	q := location.Query()
+	if q.Get("state") != params.Get("state") {
+		t.Errorf("got state %q, want %q", q.Get("state"), params.Get("state"))
+	}
+	if q.Get("code") == "" {
+		t.Fatalf("no code in %s", location)
+	}
+	return q.Get("code")
+}
+
+// token posts the form to the token endpoint as the client.
+func (ts *testServer) token(t *testing.T, client *database.OAuthClient, secret string, form url.Values) (int, map[string]any) {
+	t.Helper()
+	if secret == "" {
+		form.Set("client_id", client.ID)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(url.QueryEscape(client.ID), url.QueryEscape(secret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func exchange(code, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {database.GrantAuthorizationCode},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+}
+
+func refresh(refreshToken, scope string) url.Values {
+	return url.Values{"grant_type": {database.GrantRefreshToken}, "refresh_token": {refreshToken}, "scope": {scope}}
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.addClient(t, database.OAuthClient{FirstParty: true}, testClientSecret)
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	params := authorizeParams(client)
+	params.Set("scope", "chat:read")
+	code := ts.code(t, browser, params)
+	status, body := ts.token(t, client, testClientSecret, exchange(code, testVerifier))
+	if status != http.StatusOK {
+		t.Fatalf("exchange: got %d %v", status, body)
+	}
+	if body["access_token"] == nil || body["refresh_token"] == nil || body["scope"] != "chat:read" {
+		t.Errorf("got %v, want tokens for chat:read", body)
+	}
+
+	// Without a session the user has to log in first
+	status, location := ts.authorize(t, ts.browser(t), params)
+	if status != http.StatusFound || !strings.HasPrefix(location.String(), testAppURL+"/login?") {
+		t.Errorf("logged out: got %d to %s, want the login page", status, location)
+	}
+}
+
+func TestOAuthRedirectURI(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.addClient(t, database.OAuthClient{FirstParty: true}, testClientSecret)
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	for _, uri := range []string{"https://evil.test/callback", testRedirectURI + "/more", "https://client.test/callback?next=x"} {
+		params := authorizeParams(client)
+		params.Set("redirect_uri", uri)
+		if status, location := ts.authorize(t, browser, params); status != http.StatusBadRequest {
+			t.Errorf("%s: got %d to %s, want %d without a redirect", uri, status, location, http.StatusBadRequest)
+		}
+	}
+
+	// The code is bound to the redirect URI it was issued for
+	form := exchange(ts.code(t, browser, authorizeParams(client)), testVerifier)
+	form.Set("redirect_uri", "https://evil.test/callback")
+	if status, body := ts.token(t, client, testClientSecret, form); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("other redirect URI: got %d %v", status, body)
+	}
+}
+
+func TestOAuthPKCE(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.addClient(t, database.OAuthClient{FirstParty: true}, "")
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	for name, change := range map[string]func(url.Values){
+		"no challenge":    func(p url.Values) { p.Del("code_challenge") },
+		"plain challenge": func(p url.Values) { p.Set("code_challenge_method", "plain") },
+	} {
+		params := authorizeParams(client)
+		change(params)
+		status, location := ts.authorize(t, browser, params)
+		if status != http.StatusFound || location.Query().Get("error") != "invalid_request" {
+			t.Errorf("%s: got %d to %s, want an invalid_request error", name, status, location)
+		}
+	}
+
+	for name, verifier := range map[string]string{"no verifier": "", "wrong verifier": "another verifier of the same length as the real one"} {
+		code := ts.code(t, browser, authorizeParams(client))
+		if status, body := ts.token(t, client, "", exchange(code, verifier)); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+			t.Errorf("%s: got %d %v", name, status, body)
+		}
+	}
+	code := ts.code(t, browser, authorizeParams(client))
+	if status, body := ts.token(t, client, "", exchange(code, testVerifier)); status != http.StatusOK {
+		t.Errorf("public client with the verifier: got %d %v", status, body)
+	}
+}
+
+func TestOAuthCodeReuseRevokesTokens(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.addClient(t, database.OAuthClient{FirstParty: true}, testClientSecret)
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	code := ts.code(t, browser, authorizeParams(client))
+	status, body := ts.token(t, client, testClientSecret, exchange(code, testVerifier))
+	if status != http.StatusOK {
+		t.Fatalf("exchange: got %d %v", status, body)
+	}
+	refreshToken := body["refresh_token"].(string)
+
+	if status, body := ts.token(t, client, testClientSecret, exchange(code, testVerifier)); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("reused code: got %d %v", status, body)
+	}
+	if status, body := ts.token(t, client, testClientSecret, refresh(refreshToken, "")); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("refresh token issued for the reused code: got %d %v", status, body)
+	}
+}
+
+func TestOAuthRefreshScopes(t *testing.T) {
+	ts := newTestServer(t)
+	client := ts.addClient(t, database.OAuthClient{FirstParty: true, Scopes: []string{"profile", "chat:read", "chat:write"}}, testClientSecret)
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	params := authorizeParams(client)
+	params.Set("scope", "profile chat:read")
+	_, body := ts.token(t, client, testClientSecret, exchange(ts.code(t, browser, params), testVerifier))
+	refreshToken, _ := body["refresh_token"].(string)
+
+	status, body := ts.token(t, client, testClientSecret, refresh(refreshToken, "chat:read"))
+	if status != http.StatusOK || body["scope"] != "chat:read" {
+		t.Fatalf("fewer scopes: got %d %v", status, body)
+	}
+	refreshToken = body["refresh_token"].(string)
+
+	// Neither scopes the client never got nor those it gave up come back
+	for _, scope := range []string{"chat:read chat:write", "profile"} {
+		status, body := ts.token(t, client, testClientSecret, refresh(refreshToken, scope))
+		if status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+			t.Errorf("%s: got %d %v", scope, status, body)
+		}
+	}
+	// Asking for too much doesn't use up the refresh token
+	if status, body := ts.token(t, client, testClientSecret, refresh(refreshToken, "")); status != http.StatusOK || body["scope"] != "chat:read" {
+		t.Errorf("after asking for too much: got %d %v", status, body)
+	}
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	ts := newTestServer(t)
+	grants := []string{database.GrantClientCredentials}
+	service := ts.addClient(t, database.OAuthClient{Scopes: []string{"chat:read", "chat:write"}, GrantTypes: grants}, testClientSecret)
+
+	status, body := ts.token(t, service, testClientSecret, url.Values{"grant_type": {database.GrantClientCredentials}, "scope": {"chat:read"}})
+	if status != http.StatusOK || body["access_token"] == nil || body["scope"] != "chat:read" {
+		t.Fatalf("client credentials: got %d %v", status, body)
+	}
+	if body["refresh_token"] != nil {
+		t.Error("client credentials came with a refresh token")
+	}
+	if status, body := ts.token(t, service, testClientSecret, url.Values{"grant_type": {database.GrantClientCredentials}, "scope": {"profile"}}); status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Errorf("scope the client may not have: got %d %v", status, body)
+	}
+	if status, body := ts.token(t, service, "wrong secret", url.Values{"grant_type": {database.GrantClientCredentials}}); status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Errorf("wrong secret: got %d %v", status, body)
+	}
+
+	// Anyone could use a public client's ID, even if it was stored with the grant
+	public := ts.addClient(t, database.OAuthClient{GrantTypes: grants}, "")
+	if status, body := ts.token(t, public, "", url.Values{"grant_type": {database.GrantClientCredentials}}); status != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+		t.Errorf("public client: got %d %v", status, body)
+	}
+}
+
+func TestOAuthConsent(t *testing.T) {
+	ts := newTestServer(t)
+	firstParty := ts.addClient(t, database.OAuthClient{FirstParty: true}, testClientSecret)
+	thirdParty := ts.addClient(t, database.OAuthClient{}, testClientSecret)
+	browser := ts.loggedIn(t, "anna@example.com")
+
+	// Our own apps aren't asked about
+	ts.code(t, browser, authorizeParams(firstParty))
+
+	params := authorizeParams(thirdParty)
+	params.Set("scope", "profile")
+	askConsent := func(name string) {
+		t.Helper()
+		status, location := ts.authorize(t, browser, params)
+		if status != http.StatusFound || !strings.HasPrefix(location.String(), testAppURL+"/consent?") {
+			t.Fatalf("%s: got %d to %s, want the consent page", name, status, location)
+		}
+	}
+	askConsent("third-party client")
+
+	status, body := ts.call(t, browser, http.MethodPost, "/oauth/consent?"+params.Encode(), gin.H{"approve": false})
+	if redirect, _ := body["redirect_to"].(string); status != http.StatusOK || !strings.Contains(redirect, "error=access_denied") {
+		t.Errorf("denied: got %d %v", status, body)
+	}
+	askConsent("after denying")
+
+	status, body = ts.call(t, browser, http.MethodPost, "/oauth/consent?"+params.Encode(), gin.H{"approve": true})
+	if redirect, _ := body["redirect_to"].(string); status != http.StatusOK || !strings.HasPrefix(redirect, testRedirectURI+"?code=") {
+		t.Fatalf("approved: got %d %v", status, body)
+	}
+	ts.code(t, browser, params)
+
+	// Asking for more than was allowed asks again
+	params.Set("scope", "profile chat:read")
+	askConsent("more scopes")
+}
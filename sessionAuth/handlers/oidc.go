@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/oidc"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// OIDCLoginLifetime is how long the user has to log in at the provider.
+const OIDCLoginLifetime = 10 * time.Minute
+
+// Cookie session keys of a login waiting for the provider's callback.
+const (
+	oidcProviderKey = "oidcProvider"
+	oidcStateKey    = "oidcState"
+	oidcNonceKey    = "oidcNonce"
+	oidcVerifierKey = "oidcVerifier"
+	oidcStartedKey  = "oidcStarted"
+	oidcLinkUserKey = "oidcLinkUser"
+)
+
+func (h *Handlers) provider(c *gin.Context) (*oidc.Provider, bool) {
+	name := c.Param("provider")
+	for _, p := range h.cfg.OIDCProviders {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+	return nil, false
+}
+
+// OIDCProvidersHandler lists the providers users can log in with.
+func (h *Handlers) OIDCProvidersHandler(c *gin.Context) {
+	names := []string{}
+	for _, p := range h.cfg.OIDCProviders {
+		names = append(names, p.Name)
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": names})
+}
+
+// OIDCLoginHandler sends the browser to the provider to log in.
+func (h *Handlers) OIDCLoginHandler(c *gin.Context) {
+	h.startOIDCLogin(c, "")
+}
+
+// OIDCLinkHandler sends a logged in user to the provider to link their account
+// there to this one.
+func (h *Handlers) OIDCLinkHandler(c *gin.Context) {
+	h.startOIDCLogin(c, c.GetString("userID"))
+}
+
+func (h *Handlers) startOIDCLogin(c *gin.Context, linkUserID string) {
+	p, ok := h.provider(c)
+	if !ok {
+		return
+	}
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomValue()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	target, err := p.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to start login with %s: %v", p.Name, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Login provider is not available"})
+		return
+	}
+
+	// The session cookie is signed, so the values can't be swapped by the browser
+	session := sessions.Default(c)
+	session.Set(oidcProviderKey, p.Name)
+	session.Set(oidcStateKey, state)
+	session.Set(oidcNonceKey, nonce)
+	session.Set(oidcVerifierKey, verifier)
+	session.Set(oidcStartedKey, time.Now().Unix())
+	session.Set(oidcLinkUserKey, linkUserID)
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// OIDCCallbackHandler finishes a login at the provider. The provider's account
+// is looked up among the linked identities. If it isn't linked yet, it is
+// linked to the account with the same verified email address, or a new
+// account is created.
+func (h *Handlers) OIDCCallbackHandler(c *gin.Context) {
+	p, ok := h.provider(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	providerName, _ := session.Get(oidcProviderKey).(string)
+	state, _ := session.Get(oidcStateKey).(string)
+	nonce, _ := session.Get(oidcNonceKey).(string)
+	verifier, _ := session.Get(oidcVerifierKey).(string)
+	started, _ := session.Get(oidcStartedKey).(int64)
+	linkUserID, _ := session.Get(oidcLinkUserKey).(string)
+	for _, key := range []string{oidcProviderKey, oidcStateKey, oidcNonceKey, oidcVerifierKey, oidcStartedKey, oidcLinkUserKey} {
+		session.Delete(key)
+	}
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was cancelled or denied by the provider"})
+		return
+	}
+	if state == "" || providerName != p.Name || c.Query("state") != state ||
+		time.Since(time.Unix(started, 0)) > OIDCLoginLifetime {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login has expired, please try again"})
+		return
+	}
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	claims, err := p.Exchange(ctx, code, verifier, nonce)
+	if err != nil {
+		log.Printf("Failed to finish login with %s: %v", p.Name, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login with the provider failed"})
+		return
+	}
+
+	if linkUserID != "" {
+		h.linkIdentity(c, p.Name, claims, linkUserID)
+		return
+	}
+
+	user, err := h.users.GetByIdentity(ctx, p.Name, claims.Subject)
+	if errors.Is(err, database.ErrUserNotFound) {
+		user, err = h.userForNewIdentity(c, p.Name, claims)
+		if user == nil && err == nil {
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		h.startLoginChallenge(c, user.ID)
+		return
+	}
+	h.completeLogin(c, user.ID)
+}
+
+// userForNewIdentity links a provider account that isn't linked yet to the
+// user with the same email address, or creates a user for it. Only addresses
+// both sides have verified are trusted, anything else would let a provider
+// account take over someone's account. It writes the response and returns a
+// nil user if the login can't go on.
+func (h *Handlers) userForNewIdentity(c *gin.Context, provider string, claims *oidc.Claims) (*database.User, error) {
+	ctx := c.Request.Context()
+	email := strings.TrimSpace(claims.Email)
+	if !claims.EmailVerified || !validMailAddress(email) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The provider didn't confirm a verified email address"})
+		return nil, nil
+	}
+	identity := database.Identity{Provider: provider, Subject: claims.Subject, Email: email, LinkedAt: time.Now()}
+
+	user, err := h.users.GetByEmail(ctx, email)
+	if err == nil {
+		if !user.EmailVerified {
+			c.JSON(http.StatusConflict, gin.H{"error": "An account with this email address exists, log in with your password and verify it first"})
+			return nil, nil
+		}
+		user.Identities = append(user.Identities, identity)
+		if err := h.users.Update(ctx, user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if !errors.Is(err, database.ErrUserNotFound) {
+		return nil, err
+	}
+
+	firstname, lastname := claims.GivenName, claims.FamilyName
+	if firstname == "" && lastname == "" {
+		firstname, lastname, _ = strings.Cut(strings.TrimSpace(claims.Name), " ")
+	}
+	now := time.Now()
+	// Without a password the account can only be used through the provider,
+	// until the user sets one with the password reset
+	user = &database.User{
+		ID:              uuid.New().String(),
+		Firstname:       firstname,
+		Lastname:        lastname,
+		Email:           email,
+		CreatedAt:       now,
+		Role:            database.RoleUser,
+		EmailVerified:   true,
+		EmailVerifiedAt: &now,
+		Identities:      []database.Identity{identity},
+	}
+	if h.isAdminEmail(email) {
+		user.Role = database.RoleAdmin
+	}
+	if err := h.users.Create(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// linkIdentity links the provider account to the user who started the login
+// from their account settings.
+func (h *Handlers) linkIdentity(c *gin.Context, provider string, claims *oidc.Claims, userID string) {
+	ctx := c.Request.Context()
+	existing, err := h.users.GetByIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		if existing.ID == userID {
+			c.JSON(http.StatusOK, gin.H{"message": "Account is already linked"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is linked to another user"})
+		return
+	}
+	if !errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link account"})
+		return
+	}
+
+	user, err := h.users.GetByID(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	for _, identity := range user.Identities {
+		if identity.Provider == provider {
+			c.JSON(http.StatusConflict, gin.H{"error": "Another account at this provider is already linked"})
+			return
+		}
+	}
+	user.Identities = append(user.Identities, database.Identity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    strings.TrimSpace(claims.Email),
+		LinkedAt: time.Now(),
+	})
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link account"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account linked", "user": publicUser(user)})
+}
+
+// UnlinkIdentityHandler removes the link to the user's account at a provider.
+// The last way to log in can't be removed.
+func (h *Handlers) UnlinkIdentityHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	provider := c.Param("provider")
+	kept := user.Identities[:0:0]
+	for _, identity := range user.Identities {
+		if identity.Provider != provider {
+			kept = append(kept, identity)
+		}
+	}
+	if len(kept) == len(user.Identities) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No account at this provider is linked"})
+		return
+	}
+	if len(kept) == 0 && user.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set a password before removing your last login provider"})
+		return
+	}
+	user.Identities = kept
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink account"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlinked", "user": publicUser(user)})
+}
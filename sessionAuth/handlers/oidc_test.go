@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/oidc"
+	"example.com/my/module/tokens"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockClientID     = "sessionauth"
+	mockClientSecret = "provider secret"
+	mockRedirectURL  = "http://auth.test/auth/mock/callback"
+)
+
+// mockProvider is an OpenID Connect provider for tests. Instead of a login
+// page, tests hand out codes with authorize.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := tokens.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, codes: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// token redeems a code once, if the client authenticates and presents the
+// PKCE verifier of the challenge the code was issued for.
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	id, secret, _ := r.BasicAuth()
+	if id != mockClientID || secret != url.QueryEscape(mockClientSecret) {
+		fail("invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != mockRedirectURL {
+		fail("invalid_request")
+		return
+	}
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		fail("invalid_grant")
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "token_type": "Bearer", "id_token": idToken})
+}
+
+// authorize hands out a code for an ID token with the claims, as if the user
+// logged in at the provider after being sent there with params. The standard
+// claims default to valid values.
+func (m *mockProvider) authorize(t *testing.T, params url.Values, claims jwt.MapClaims) string {
+	t.Helper()
+	now := time.Now()
+	defaults := jwt.MapClaims{
+		"iss":   m.URL,
+		"aud":   mockClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": params.Get("nonce"),
+	}
+	for k, v := range defaults {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	code, err := oidc.RandomValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: params.Get("code_challenge"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+func (m *mockProvider) configure(cfg *Config) {
+	cfg.OIDCProviders = []*oidc.Provider{{
+		Name:         "mock",
+		Issuer:       m.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		RedirectURL:  mockRedirectURL,
+		Scopes:       []string{"email", "profile"},
+	}}
+}
+
+// startOIDC follows path to the provider and returns the parameters the
+// browser was sent there with.
+func (ts *testServer) startOIDC(t *testing.T, browser *http.Client, path string) url.Values {
+	t.Helper()
+	client := *browser
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("%s: got %d, want a redirect to the provider", path, resp.StatusCode)
+	}
+	target, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target.Query()
+}
+
+// oidcLogin logs in at the provider as the user the claims describe and
+// returns the response of the callback.
+func (ts *testServer) oidcLogin(t *testing.T, m *mockProvider, browser *http.Client, claims jwt.MapClaims) (int, map[string]any) {
+	t.Helper()
+	params := ts.startOIDC(t, browser, "/auth/mock/login")
+	code := m.authorize(t, params, claims)
+	return ts.call(t, browser, http.MethodGet, "/auth/mock/callback?"+url.Values{"code": {code}, "state": {params.Get("state")}}.Encode(), nil)
+}
+
+func (ts *testServer) verifiedUser(t *testing.T, email, password string) *database.User {
+	t.Helper()
+	ts.register(t, email, password)
+	user, err := ts.stores.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.h.markEmailVerified(user)
+	if err := ts.stores.Users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestOIDCAuthorizationRequest(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+
+	first := ts.startOIDC(t, ts.browser(t), "/auth/mock/login")
+	second := ts.startOIDC(t, ts.browser(t), "/auth/mock/login")
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             mockClientID,
+		"redirect_uri":          mockRedirectURL,
+		"scope":                 "openid email profile",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := first.Get(k); got != v {
+			t.Errorf("%s: got %q, want %q", k, got, v)
+		}
+	}
+	for _, k := range []string{"state", "nonce", "code_challenge"} {
+		if first.Get(k) == "" || first.Get(k) == second.Get(k) {
+			t.Errorf("%s: got %q and %q, want a fresh value for every login", k, first.Get(k), second.Get(k))
+		}
+	}
+
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/auth/other/login", nil); status != http.StatusNotFound {
+		t.Errorf("unknown provider: got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	browser := ts.browser(t)
+
+	status, body := ts.oidcLogin(t, m, browser, jwt.MapClaims{
+		"sub": "subject-1", "email": "anna@example.com", "email_verified": true,
+		"given_name": "Anna", "family_name": "Smith",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("callback: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, browser, http.MethodGet, "/profile", nil); status != http.StatusOK {
+		t.Errorf("profile: got %d, want %d", status, http.StatusOK)
+	}
+	user, err := ts.stores.Users.GetByIdentity(context.Background(), "mock", "subject-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "anna@example.com" || user.Firstname != "Anna" || user.Lastname != "Smith" || !user.EmailVerified || user.Password != "" {
+		t.Errorf("got %+v", user)
+	}
+
+	// The next login finds the linked identity, whatever the email says now
+	status, body = ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{"sub": "subject-1", "email": "anna@new.example.com"})
+	if status != http.StatusOK {
+		t.Fatalf("second login: got %d %v", status, body)
+	}
+	if users, _ := ts.stores.Users.List(context.Background()); len(users) != 1 {
+		t.Errorf("got %d users, want 1", len(users))
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "subject-1", "email": "anna@example.com", "email_verified": true}
+	}
+
+	// A callback with another state, as when an attacker sends the user to
+	// the callback with their own code
+	browser := ts.browser(t)
+	params := ts.startOIDC(t, browser, "/auth/mock/login")
+	code := m.authorize(t, params, claims())
+	callback := "/auth/mock/callback?" + url.Values{"code": {code}, "state": {"forged"}}.Encode()
+	if status, _ := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusBadRequest {
+		t.Errorf("wrong state: got %d, want %d", status, http.StatusBadRequest)
+	}
+	// A callback in a browser that never started a login
+	callback = "/auth/mock/callback?" + url.Values{"code": {code}, "state": {params.Get("state")}}.Encode()
+	if status, _ := ts.call(t, ts.browser(t), http.MethodGet, callback, nil); status != http.StatusBadRequest {
+		t.Errorf("no login started: got %d, want %d", status, http.StatusBadRequest)
+	}
+	// A failed callback ends the login, the right state doesn't help afterwards
+	if status, _ := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusBadRequest {
+		t.Errorf("state of an ended login: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	browser = ts.browser(t)
+	params = ts.startOIDC(t, browser, "/auth/mock/login")
+	callback = "/auth/mock/callback?" + url.Values{"code": {m.authorize(t, params, claims())}, "state": {params.Get("state")}}.Encode()
+	if status, body := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusOK {
+		t.Fatalf("callback: got %d %v", status, body)
+	}
+	if status, _ := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusBadRequest {
+		t.Errorf("replayed callback: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// The provider reporting an error
+	browser = ts.browser(t)
+	params = ts.startOIDC(t, browser, "/auth/mock/login")
+	callback = "/auth/mock/callback?" + url.Values{"error": {"access_denied"}, "state": {params.Get("state")}}.Encode()
+	if status, _ := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusUnauthorized {
+		t.Errorf("denied login: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+
+	// An ID token from another login can't be replayed
+	status, _ := ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{
+		"sub": "subject-1", "email": "anna@example.com", "email_verified": true, "nonce": "from another login",
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("wrong nonce: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, _ = ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{
+		"sub": "subject-1", "email": "anna@example.com", "email_verified": true, "nonce": "",
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("no nonce: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if users, _ := ts.stores.Users.List(context.Background()); len(users) != 0 {
+		t.Errorf("got %d users, want none", len(users))
+	}
+}
+
+func TestOIDCIDTokenChecks(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"other issuer", jwt.MapClaims{"iss": "https://evil.example.com"}},
+		{"other audience", jwt.MapClaims{"aud": "someone else"}},
+		{"several audiences without us as azp", jwt.MapClaims{"aud": []string{mockClientID, "someone else"}, "azp": "someone else"}},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"no subject", jwt.MapClaims{"sub": ""}},
+	}
+	for _, tt := range tests {
+		claims := jwt.MapClaims{"sub": "subject-1", "email": "anna@example.com", "email_verified": true}
+		for k, v := range tt.claims {
+			claims[k] = v
+		}
+		if status, _ := ts.oidcLogin(t, m, ts.browser(t), claims); status != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want %d", tt.name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+
+	// A code issued for another login's challenge, as when an attacker gets
+	// their own code injected into the user's callback, can't be redeemed
+	browser := ts.browser(t)
+	params := ts.startOIDC(t, browser, "/auth/mock/login")
+	other := ts.startOIDC(t, ts.browser(t), "/auth/mock/login")
+	code := m.authorize(t, url.Values{"nonce": {params.Get("nonce")}, "code_challenge": {other.Get("code_challenge")}},
+		jwt.MapClaims{"sub": "subject-1", "email": "anna@example.com", "email_verified": true})
+	callback := "/auth/mock/callback?" + url.Values{"code": {code}, "state": {params.Get("state")}}.Encode()
+	if status, _ := ts.call(t, browser, http.MethodGet, callback, nil); status != http.StatusUnauthorized {
+		t.Errorf("code for another challenge: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCNewIdentity(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	anna := ts.verifiedUser(t, "anna@example.com", "correct horse")
+	ts.register(t, "ben@example.com", "correct horse")
+
+	// A verified address at both ends is the same person
+	browser := ts.browser(t)
+	status, body := ts.oidcLogin(t, m, browser, jwt.MapClaims{"sub": "subject-anna", "email": "anna@example.com", "email_verified": true})
+	if status != http.StatusOK {
+		t.Fatalf("verified address: got %d %v", status, body)
+	}
+	user, err := ts.stores.Users.GetByIdentity(context.Background(), "mock", "subject-anna")
+	if err != nil || user.ID != anna.ID {
+		t.Errorf("got %v %v, want the identity linked to the existing user", user, err)
+	}
+
+	// The provider doesn't vouch for the address
+	status, _ = ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{"sub": "subject-2", "email": "anna@example.com", "email_verified": false})
+	if status != http.StatusForbidden {
+		t.Errorf("address the provider didn't verify: got %d, want %d", status, http.StatusForbidden)
+	}
+	status, _ = ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{"sub": "subject-2", "email_verified": true})
+	if status != http.StatusForbidden {
+		t.Errorf("no address: got %d, want %d", status, http.StatusForbidden)
+	}
+	if _, err := ts.stores.Users.GetByIdentity(context.Background(), "mock", "subject-2"); err == nil {
+		t.Error("identity with an unverified address was linked")
+	}
+
+	// The account never proved it owns the address, whoever registered it
+	// mustn't get a foothold in the provider user's account
+	status, _ = ts.oidcLogin(t, m, ts.browser(t), jwt.MapClaims{"sub": "subject-ben", "email": "ben@example.com", "email_verified": true})
+	if status != http.StatusConflict {
+		t.Errorf("account with an unverified address: got %d, want %d", status, http.StatusConflict)
+	}
+	ben, err := ts.stores.Users.GetByEmail(context.Background(), "ben@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ben.Identities) != 0 {
+		t.Errorf("got identities %v, want none", ben.Identities)
+	}
+}
+
+func TestOIDCNewIdentitySecondFactor(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	ts.verifiedUser(t, "anna@example.com", "correct horse")
+	ts.enableTOTP(t, "anna@example.com")
+
+	browser := ts.browser(t)
+	status, body := ts.oidcLogin(t, m, browser, jwt.MapClaims{"sub": "subject-anna", "email": "anna@example.com", "email_verified": true})
+	if status != http.StatusOK || body["two_factor_required"] != true {
+		t.Fatalf("got %d %v, want a second factor challenge", status, body)
+	}
+	if status, _ := ts.call(t, browser, http.MethodGet, "/profile", nil); status != http.StatusUnauthorized {
+		t.Errorf("profile before the second factor: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	m := newMockProvider(t)
+	ts := newTestServer(t, m.configure)
+	anna := ts.verifiedUser(t, "anna@example.com", "correct horse")
+	ts.verifiedUser(t, "ben@example.com", "correct horse")
+	loggedIn := func(email string) *http.Client {
+		browser := ts.browser(t)
+		if status, body := ts.call(t, browser, http.MethodPost, "/login", gin.H{"email": email, "password": "correct horse"}); status != http.StatusOK {
+			t.Fatalf("login: got %d %v", status, body)
+		}
+		return browser
+	}
+	link := func(browser *http.Client, claims jwt.MapClaims) (int, map[string]any) {
+		params := ts.startOIDC(t, browser, "/auth/mock/link")
+		code := m.authorize(t, params, claims)
+		return ts.call(t, browser, http.MethodGet, "/auth/mock/callback?"+url.Values{"code": {code}, "state": {params.Get("state")}}.Encode(), nil)
+	}
+
+	if status, _ := ts.call(t, ts.browser(t), http.MethodGet, "/auth/mock/link", nil); status != http.StatusUnauthorized {
+		t.Errorf("linking without logging in: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Linking doesn't need the addresses to match, the user is logged in
+	annaBrowser := loggedIn("anna@example.com")
+	if status, body := link(annaBrowser, jwt.MapClaims{"sub": "subject-anna", "email": "anna@elsewhere.example.com"}); status != http.StatusOK {
+		t.Fatalf("link: got %d %v", status, body)
+	}
+	user, err := ts.stores.Users.GetByIdentity(context.Background(), "mock", "subject-anna")
+	if err != nil || user.ID != anna.ID {
+		t.Fatalf("got %v %v, want the identity linked to the user", user, err)
+	}
+	if status, body := link(annaBrowser, jwt.MapClaims{"sub": "subject-anna"}); status != http.StatusOK || body["message"] != "Account is already linked" {
+		t.Errorf("linking again: got %d %v", status, body)
+	}
+	if status, _ := link(annaBrowser, jwt.MapClaims{"sub": "subject-other"}); status != http.StatusConflict {
+		t.Errorf("second account at the provider: got %d, want %d", status, http.StatusConflict)
+	}
+
+	if status, _ := link(loggedIn("ben@example.com"), jwt.MapClaims{"sub": "subject-anna"}); status != http.StatusConflict {
+		t.Errorf("identity of another user: got %d, want %d", status, http.StatusConflict)
+	}
+	user, err = ts.stores.Users.GetByIdentity(context.Background(), "mock", "subject-anna")
+	if err != nil || user.ID != anna.ID {
+		t.Errorf("got %v %v, want the identity still linked to its user", user, err)
+	}
+}
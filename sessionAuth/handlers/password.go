@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordResetLifetime is how long a password reset link works.
+const PasswordResetLifetime = time.Hour
+
+// issueOneTimeToken replaces the user's tokens for the purpose with a new one
+// and returns it.
+func (h *Handlers) issueOneTimeToken(ctx context.Context, userID, purpose string, lifetime time.Duration) (string, error) {
+	if err := h.oneTimeTokens.DeleteByUser(ctx, userID, purpose); err != nil {
+		return "", err
+	}
+	token, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = h.oneTimeTokens.Create(ctx, &database.OneTimeToken{
+		ID:        uuid.New().String(),
+		TokenHash: database.HashToken(token),
+		Purpose:   purpose,
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendMail sends the message in the background, so that response times don't
+// reveal whether an email was sent.
+func (h *Handlers) sendMail(msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ForgotPasswordHandler emails a password reset link. The response is the
+// same whether or not the address belongs to an account, and it is sent
+// before the account is looked up, so its timing doesn't tell either.
+func (h *Handlers) ForgotPasswordHandler(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validMailAddress(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		return
+	}
+	if !h.forgotPerIP.allow(c.ClientIP()) || !h.forgotPerEmail.allow(strings.ToLower(email)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please try again later"})
+		return
+	}
+
+	go h.sendPasswordReset(email)
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists for this address, a reset link has been sent"})
+}
+
+// sendPasswordReset emails a reset link if the address belongs to an account.
+// It runs after the response is sent, so failures can only be logged.
+func (h *Handlers) sendPasswordReset(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	user, err := h.users.GetByEmail(ctx, email)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up %s for a password reset: %v", email, err)
+		return
+	}
+
+	token, err := h.issueOneTimeToken(ctx, user.ID, database.PurposePasswordReset, PasswordResetLifetime)
+	if err != nil {
+		log.Printf("Failed to create a reset token for %s: %v", user.ID, err)
+		return
+	}
+	link := h.cfg.AppURL + "/reset-password?token=" + url.QueryEscape(token)
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+			"If it was you, open this link within an hour to choose a new password:\n\n%s\n\n"+
+			"If it wasn't, you can ignore this email.\n", user.Firstname, link),
+	})
+}
+
+type resetPasswordRequest struct {
+	Token           string `json:"token"`
+	Password        string `json:"password"`
+	Confirmpassword string `json:"confirmpassword"`
+}
+
+// ResetPasswordHandler sets a new password using the token from a reset link
+// and logs the user out everywhere.
+func (h *Handlers) ResetPasswordHandler(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	errs := fieldErrors{}
+	if req.Token == "" {
+		errs.add("token", "Required")
+	}
+	h.checkNewPassword(errs, "password", req.Password, "confirmpassword", req.Confirmpassword)
+	if len(errs) > 0 {
+		respondInvalid(c, errs)
+		return
+	}
+	ctx := c.Request.Context()
+
+	token, err := h.oneTimeTokens.Consume(ctx, database.PurposePasswordReset, req.Token)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check reset token"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash the password"})
+		return
+	}
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	user.Password = string(hashedPassword)
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+	h.audit(c, auditEvent{Type: database.AuditPasswordChanged, UserID: user.ID, Details: map[string]string{"method": "reset"}})
+
+	// Whoever knew the old password must not stay logged in
+	if _, err := h.sessions.DeleteByUser(ctx, token.UserID, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if err := h.refreshTokens.RevokeUser(ctx, token.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset, please log in again"})
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"example.com/my/module/avatars"
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxStatusLength      = 140
+	maxAvatarSize        = 5 << 20 // 5 MB
+)
+
+// PublicProfile is what anyone may see about a user, such as the other
+// members of a chat room.
+type PublicProfile struct {
+	ID          string `json:"id"`
+	Firstname   string `json:"firstname"`
+	Lastname    string `json:"lastname"`
+	DisplayName string `json:"displayname"`
+	Status      string `json:"status"`
+	Timezone    string `json:"timezone"`
+	AvatarURL   string `json:"avatarurl"`
+}
+
+// validTimezone accepts IANA time zone names and the empty string, which
+// clears the time zone.
+func validTimezone(name string) bool {
+	if name == "" {
+		return true
+	}
+	if name == "Local" || len(name) > 64 {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// PublicProfileHandler returns the public profile of a user. It needs no
+// login, so services such as the chat can show who sent a message.
+func (h *Handlers) PublicProfileHandler(c *gin.Context) {
+	user, err := h.users.GetByID(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	c.JSON(http.StatusOK, PublicProfile{
+		ID:          user.ID,
+		Firstname:   user.Firstname,
+		Lastname:    user.Lastname,
+		DisplayName: user.DisplayName,
+		Status:      user.Status,
+		Timezone:    user.Timezone,
+		AvatarURL:   user.AvatarURL,
+	})
+}
+
+// UploadAvatarHandler takes a PNG, JPEG or GIF picture in the avatar form
+// field, makes a square avatar of it and stores that in the file service.
+func (h *Handlers) UploadAvatarHandler(c *gin.Context) {
+	file, _, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar upload failed"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar upload failed"})
+		return
+	}
+	if len(data) > maxAvatarSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar is too large"})
+		return
+	}
+	avatar, err := avatars.Process(data)
+	if errors.Is(err, avatars.ErrUnsupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a PNG, JPEG or GIF image"})
+		return
+	}
+	if errors.Is(err, avatars.ErrTooLarge) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar has too many pixels"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to process avatar: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process avatar"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	// A new name for every upload, so caches don't keep showing the old one
+	filename := fmt.Sprintf("user-%s-%d.png", user.ID, time.Now().UnixNano())
+	avatarURL, err := h.storeFile(ctx, user.ID, filename, avatar)
+	if err != nil {
+		log.Printf("Failed to store avatar of %s: %v", user.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	user.AvatarURL = avatarURL
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar updated", "avatarurl": avatarURL})
+}
+
+// DeleteAvatarHandler removes the avatar from the profile. The file service
+// can't delete files, so the picture itself stays where it was.
+func (h *Handlers) DeleteAvatarHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if user.AvatarURL != "" {
+		user.AvatarURL = ""
+		if err := h.users.Update(ctx, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar removed"})
+}
+
+// storeFile uploads data to the file service on behalf of the user and
+// returns the URL it can be downloaded from.
+func (h *Handlers) storeFile(ctx context.Context, userID, filename string, data []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	// The file service checks uploaders against our own access tokens
+	token, _, err := h.tokens.Issue(userID)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.FileServiceURL+"/upload", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("file service responded with %s", resp.Status)
+	}
+	// The file service may store the file under another name than asked for
+	var stored struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil || stored.Filename == "" {
+		return "", fmt.Errorf("file service didn't say where it stored the file")
+	}
+	return h.cfg.FileServiceURL + "/file?filename=" + url.QueryEscape(stored.Filename), nil
+}
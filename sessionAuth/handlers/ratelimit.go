@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most max events per key within window. It lives in
+// memory, so each instance counts on its own.
+type rateLimiter struct {
+	max    int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{max: max, window: window, events: make(map[string][]time.Time)}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+// Events over the limit are not recorded.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+
+	recent := l.events[key][:0]
+	for _, t := range l.events[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.max {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+
+	// Forget keys that have gone quiet so the map doesn't grow forever
+	if len(l.events) > 10000 {
+		for k, ts := range l.events {
+			if len(ts) == 0 || now.Sub(ts[len(ts)-1]) >= l.window {
+				delete(l.events, k)
+			}
+		}
+	}
+	return true
+}
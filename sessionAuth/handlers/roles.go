@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+// PublicUser is what the API shows of a user. It never contains credentials.
+type PublicUser struct {
+	ID            string               `json:"id"`
+	Firstname     string               `json:"firstname"`
+	Lastname      string               `json:"lastname"`
+	Email         string               `json:"email"`
+	Role          string               `json:"role"`
+	EmailVerified bool                 `json:"emailverified"`
+	TOTPEnabled   bool                 `json:"totpenabled"`
+	Preferences   database.Preferences `json:"preferences"`
+	DisplayName   string               `json:"displayname"`
+	Status        string               `json:"status"`
+	Timezone      string               `json:"timezone"`
+	AvatarURL     string               `json:"avatarurl"`
+	Identities    []database.Identity  `json:"identities"`
+	CreatedAt     time.Time            `json:"createdat"`
+}
+
+func publicUser(u *database.User) PublicUser {
+	role := u.Role
+	if role == "" {
+		role = database.RoleUser
+	}
+	return PublicUser{
+		ID:            u.ID,
+		Firstname:     u.Firstname,
+		Lastname:      u.Lastname,
+		Email:         u.Email,
+		Role:          role,
+		EmailVerified: u.EmailVerified,
+		TOTPEnabled:   u.TOTPEnabled,
+		Preferences:   u.Preferences,
+		DisplayName:   u.DisplayName,
+		Status:        u.Status,
+		Timezone:      u.Timezone,
+		AvatarURL:     u.AvatarURL,
+		Identities:    append([]database.Identity{}, u.Identities...),
+		CreatedAt:     u.CreatedAt,
+	}
+}
+
+func (h *Handlers) isAdminEmail(email string) bool {
+	for _, admin := range h.cfg.AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// BootstrapAdmins makes the verified accounts listed in Config.AdminEmails
+// admins, so that a new installation has someone who can hand out roles.
+// Unverified accounts are skipped, anyone could have registered them.
+func (h *Handlers) BootstrapAdmins(ctx context.Context) error {
+	for _, email := range h.cfg.AdminEmails {
+		user, err := h.users.GetByEmail(ctx, email)
+		if errors.Is(err, database.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !user.EmailVerified || user.Role == database.RoleAdmin {
+			continue
+		}
+		user.Role = database.RoleAdmin
+		if err := h.users.Update(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetRoleHandler changes the role of a user.
+func (h *Handlers) SetRoleHandler(c *gin.Context) {
+	var req setRoleRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if !database.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin, user or service"})
+		return
+	}
+	userID := c.Param("id")
+	// Otherwise the last admin could lock everyone out of the admin endpoints
+	if userID == c.GetString("userID") && req.Role != database.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins can't remove their own admin role"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	previous := user.Role
+	user.Role = req.Role
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	h.audit(c, auditEvent{
+		Type:    database.AuditRoleChanged,
+		UserID:  user.ID,
+		ActorID: c.GetString("userID"),
+		Details: map[string]string{"from": previous, "to": user.Role},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated", "user": publicUser(user)})
+}
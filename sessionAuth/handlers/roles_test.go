@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+)
+
+func withAdmins(emails ...string) func(*Config) {
+	return func(cfg *Config) { cfg.AdminEmails = emails }
+}
+
+// role returns the stored role of the user with the address.
+func (ts *testServer) role(t *testing.T, email string) string {
+	t.Helper()
+	user, err := ts.stores.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Role
+}
+
+// verify follows the verification link mailed to the address.
+func (ts *testServer) verify(t *testing.T, email string) {
+	t.Helper()
+	token := tokenFromLink(t, ts.waitForMail(t, email, "Verify your email address"), "/verify-email")
+	if status, body := ts.call(t, http.DefaultClient, http.MethodPost, "/email/verify", gin.H{"token": token}); status != http.StatusOK {
+		t.Fatalf("verify: got %d %v", status, body)
+	}
+}
+
+func TestAdminEmailsBecomeAdminsWhenVerified(t *testing.T) {
+	ts := newTestServer(t, withAdmins("Admin@Example.com"))
+	token := ts.accessToken(t, "admin@example.com")
+
+	// Anyone could register the address, it only counts once it is proven
+	if role := ts.role(t, "admin@example.com"); role != database.RoleUser {
+		t.Errorf("unverified admin address: got role %q, want %q", role, database.RoleUser)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/users", nil, "Authorization", "Bearer "+token); status != http.StatusForbidden {
+		t.Errorf("unverified admin address listing users: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	ts.verify(t, "admin@example.com")
+	if role := ts.role(t, "admin@example.com"); role != database.RoleAdmin {
+		t.Errorf("verified admin address: got role %q, want %q", role, database.RoleAdmin)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/users", nil, "Authorization", "Bearer "+token); status != http.StatusOK {
+		t.Errorf("admin listing users: got %d, want %d", status, http.StatusOK)
+	}
+
+	ts.register(t, "anna@example.com", "correct horse")
+	ts.verify(t, "anna@example.com")
+	if role := ts.role(t, "anna@example.com"); role != database.RoleUser {
+		t.Errorf("other address: got role %q, want %q", role, database.RoleUser)
+	}
+}
+
+func TestBootstrapAdmins(t *testing.T) {
+	ts := newTestServer(t)
+	ts.verifiedUser(t, "admin@example.com", "correct horse")
+	ts.register(t, "squatter@example.com", "correct horse")
+
+	ts.h.cfg.AdminEmails = []string{"admin@example.com", "squatter@example.com", "nobody@example.com"}
+	if err := ts.h.BootstrapAdmins(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if role := ts.role(t, "admin@example.com"); role != database.RoleAdmin {
+		t.Errorf("verified account: got role %q, want %q", role, database.RoleAdmin)
+	}
+	if role := ts.role(t, "squatter@example.com"); role != database.RoleUser {
+		t.Errorf("unverified account: got role %q, want %q", role, database.RoleUser)
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	ts := newTestServer(t, withAdmins("admin@example.com"))
+	admin := ts.accessToken(t, "admin@example.com")
+	ts.verify(t, "admin@example.com")
+	anna := ts.accessToken(t, "anna@example.com")
+	annaUser, err := ts.stores.Users.GetByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminUser, err := ts.stores.Users.GetByEmail(context.Background(), "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRole := func(token, userID, role string) int {
+		t.Helper()
+		status, _ := ts.call(t, http.DefaultClient, http.MethodPut, "/admin/users/"+userID+"/role", gin.H{"role": role}, "Authorization", "Bearer "+token)
+		return status
+	}
+
+	if status := setRole(anna, annaUser.ID, database.RoleAdmin); status != http.StatusForbidden {
+		t.Errorf("user making themselves admin: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status := setRole(admin, annaUser.ID, "root"); status != http.StatusBadRequest {
+		t.Errorf("unknown role: got %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := setRole(admin, "nobody", database.RoleAdmin); status != http.StatusNotFound {
+		t.Errorf("unknown user: got %d, want %d", status, http.StatusNotFound)
+	}
+	if status := setRole(admin, adminUser.ID, database.RoleUser); status != http.StatusBadRequest {
+		t.Errorf("admin demoting themselves: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status := setRole(admin, annaUser.ID, database.RoleAdmin); status != http.StatusOK {
+		t.Fatalf("promote: got %d", status)
+	}
+	// Roles are looked up on every request, tokens don't have to be renewed
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/users", nil, "Authorization", "Bearer "+anna); status != http.StatusOK {
+		t.Errorf("promoted user listing users: got %d, want %d", status, http.StatusOK)
+	}
+	if status := setRole(anna, adminUser.ID, database.RoleService); status != http.StatusOK {
+		t.Errorf("new admin changing a role: got %d", status)
+	}
+	if status, _ := ts.call(t, http.DefaultClient, http.MethodGet, "/users", nil, "Authorization", "Bearer "+admin); status != http.StatusForbidden {
+		t.Errorf("demoted admin listing users: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	events, err := ts.stores.Audit.List(context.Background(), database.AuditFilter{UserID: annaUser.ID, Type: database.AuditRoleChanged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filter matches the user as actor too, anna demoted the admin
+	var promotions []database.AuditEvent
+	for _, e := range events {
+		if e.UserID == annaUser.ID {
+			promotions = append(promotions, e)
+		}
+	}
+	if len(promotions) != 1 || promotions[0].ActorID != adminUser.ID || promotions[0].Details["to"] != database.RoleAdmin {
+		t.Errorf("got audit events %+v, want the promotion by the admin", promotions)
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// SessionLifetime is how long a login lasts before the user has to log in again.
+const SessionLifetime = 24 * time.Hour
+
+// newToken returns a random URL-safe token with n bytes of entropy.
+func newToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startSession stores a new server-side session for the user and puts its
+// token into the session cookie.
+func (h *Handlers) startSession(c *gin.Context, userID string) (*database.Session, error) {
+	token, err := newToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &database.Session{
+		ID:         uuid.New().String(),
+		TokenHash:  database.HashToken(token),
+		UserID:     userID,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(SessionLifetime),
+	}
+	if err := h.sessions.Create(c.Request.Context(), s); err != nil {
+		return nil, err
+	}
+
+	session := sessions.Default(c)
+	session.Clear()
+	session.Set(database.SessionTokenKey, token)
+	if err := session.Save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// describeDevice gives a short description of the browser and system in a
+// user agent string, good enough to tell sessions apart.
+func describeDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	browsers := []struct{ key, name string }{
+		{"edg/", "Edge"}, {"opr/", "Opera"}, {"firefox/", "Firefox"},
+		{"chrome/", "Chrome"}, {"safari/", "Safari"}, {"curl/", "curl"},
+	}
+	systems := []struct{ key, name string }{
+		{"android", "Android"}, {"iphone", "iOS"}, {"ipad", "iPadOS"},
+		{"windows", "Windows"}, {"mac os", "macOS"}, {"linux", "Linux"},
+	}
+
+	browser, system := "Unknown browser", ""
+	for _, b := range browsers {
+		if strings.Contains(ua, b.key) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.key) {
+			system = s.name
+			break
+		}
+	}
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
+
+// ListSessionsHandler lists where the user is logged in: the browser sessions
+// and the logins of token clients, such as the mobile apps. A token login is
+// shown with the ID of its refresh token family and with the time of its
+// latest refresh.
+func (h *Handlers) ListSessionsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("userID")
+	list, err := h.sessions.ListByUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	tokenLogins, err := h.refreshTokens.ListActive(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	type sessionView struct {
+		database.Session
+		Kind    string `json:"kind"`
+		Device  string `json:"device"`
+		Current bool   `json:"current"`
+	}
+	views := make([]sessionView, 0, len(list)+len(tokenLogins))
+	for _, s := range list {
+		views = append(views, sessionView{
+			Session: s,
+			Kind:    "session",
+			Device:  describeDevice(s.UserAgent),
+			Current: s.ID == c.GetString("sessionID"),
+		})
+	}
+	for _, t := range tokenLogins {
+		views = append(views, sessionView{
+			Session: database.Session{
+				ID:         t.FamilyID,
+				UserID:     t.UserID,
+				CreatedAt:  t.CreatedAt,
+				LastUsedAt: t.CreatedAt,
+				ExpiresAt:  t.ExpiresAt,
+			},
+			Kind:   "token",
+			Device: "Token client",
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": views})
+}
+
+// RevokeSessionHandler revokes one of the user's sessions or token logins, or
+// all of them when the ID is "all".
+func (h *Handlers) RevokeSessionHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("userID")
+	id := c.Param("id")
+
+	if id == "all" {
+		n, err := h.sessions.DeleteByUser(ctx, userID, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+		tokenLogins, err := h.refreshTokens.ListActive(ctx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+		for _, t := range tokenLogins {
+			if err := h.refreshTokens.RevokeFamily(ctx, t.FamilyID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+				return
+			}
+			n++
+		}
+		h.audit(c, auditEvent{Type: database.AuditSessionRevoked, UserID: userID, Details: map[string]string{"session_id": "all", "count": strconv.FormatInt(n, 10)}})
+		h.clearSessionCookie(c)
+		c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked", "revoked": n})
+		return
+	}
+
+	s, err := h.sessions.Get(ctx, id)
+	if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session"})
+		return
+	}
+	if err != nil || s.UserID != userID {
+		// Not a browser session of the user, but it may be a token login
+		revoked, err := h.revokeTokenLogin(ctx, userID, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+		if !revoked {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		h.audit(c, auditEvent{Type: database.AuditSessionRevoked, UserID: userID, Details: map[string]string{"session_id": id}})
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked", "revoked": 1})
+		return
+	}
+	if err := h.sessions.Delete(ctx, id); err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	h.audit(c, auditEvent{Type: database.AuditSessionRevoked, UserID: userID, Details: map[string]string{"session_id": id}})
+	if id == c.GetString("sessionID") {
+		h.clearSessionCookie(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked", "revoked": 1})
+}
+
+// revokeTokenLogin revokes the refresh token family of the user with the ID
+// and reports whether there was one.
+func (h *Handlers) revokeTokenLogin(ctx context.Context, userID, familyID string) (bool, error) {
+	tokenLogins, err := h.refreshTokens.ListActive(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tokenLogins {
+		if t.FamilyID == familyID {
+			return true, h.refreshTokens.RevokeFamily(ctx, familyID)
+		}
+	}
+	return false, nil
+}
+
+// clearSessionCookie removes the session cookie from the browser. The cookie
+// is only removed if the attributes match the ones it was set with.
+func (h *Handlers) clearSessionCookie(c *gin.Context) {
+	opts := h.cfg.Cookie
+	opts.MaxAge = -1
+	session := sessions.Default(c)
+	session.Clear()
+	session.Options(opts)
+	session.Save()
+}
+
+// setCookie sets a cookie of our own with the configured domain and security
+// attributes.
+func (h *Handlers) setCookie(c *gin.Context, name, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   h.cfg.Cookie.Domain,
+		MaxAge:   maxAge,
+		Secure:   h.cfg.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: h.cfg.Cookie.SameSite,
+	})
+}
+
+// CSRFTokenHandler returns the CSRF token of the client, for apps on another
+// origin that can't read the cookie. It has to be sent in the X-CSRF-Token
+// header of every POST, PUT, PATCH and DELETE request.
+func (h *Handlers) CSRFTokenHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"csrf_token": c.GetString("csrfToken")})
+}
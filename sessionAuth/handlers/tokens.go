@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RefreshTokenLifetime is how long a refresh token can be used. Each use
+// replaces it with a new one, so active clients stay logged in.
+const RefreshTokenLifetime = 30 * 24 * time.Hour
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// issueTokens returns a new access token and a new refresh token in the given
+// family. An empty family starts a new one.
+func (h *Handlers) issueTokens(ctx context.Context, userID, familyID string) (gin.H, error) {
+	return h.issueClientTokens(ctx, userID, nil, nil, familyID)
+}
+
+// issueClientTokens is issueTokens for an OAuth client, limited to the scopes.
+// A nil client stands for our own apps.
+func (h *Handlers) issueClientTokens(ctx context.Context, userID string, client *database.OAuthClient, scopes []string, familyID string) (gin.H, error) {
+	clientID := ""
+	if client != nil {
+		clientID = client.ID
+	}
+	accessToken, expiresAt, err := h.tokens.IssueForClient(userID, clientID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	resp := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(expiresAt).Seconds()),
+	}
+	if client != nil {
+		resp["scope"] = strings.Join(scopes, " ")
+		if !client.AllowsGrant(database.GrantRefreshToken) {
+			return resp, nil
+		}
+	}
+
+	refreshToken, err := newToken(32)
+	if err != nil {
+		return nil, err
+	}
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+	now := time.Now()
+	err = h.refreshTokens.Create(ctx, &database.RefreshToken{
+		ID:        uuid.New().String(),
+		TokenHash: database.HashToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(RefreshTokenLifetime),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp["refresh_token"] = refreshToken
+	return resp, nil
+}
+
+// useRefreshToken marks a refresh token issued to the client as used and
+// returns it. An empty clientID stands for our own apps. A refresh token that
+// was already used means it leaked, so the whole family is revoked.
+func (h *Handlers) useRefreshToken(ctx context.Context, token, clientID string) (*database.RefreshToken, error) {
+	rt, err := h.refreshTokens.FindByToken(ctx, token)
+	if errors.Is(err, database.ErrRefreshTokenNotFound) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rt.RevokedAt != nil || rt.ClientID != clientID {
+		return nil, errInvalidRefreshToken
+	}
+
+	fresh, err := h.refreshTokens.MarkUsed(ctx, rt.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		if err := h.refreshTokens.RevokeFamily(ctx, rt.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errRefreshTokenReused
+	}
+
+	// The user may have been removed since the token was issued
+	if _, err := h.users.GetByID(ctx, rt.UserID); err != nil {
+		return nil, errInvalidRefreshToken
+	}
+	return rt, nil
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token and a
+// new refresh token. A refresh token that was already used means it leaked,
+// so the whole family is revoked.
+func (h *Handlers) RefreshTokenHandler(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBind(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token is required"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	// Tokens of OAuth clients are refreshed at /oauth/token, where the client
+	// has to authenticate
+	rt, err := h.useRefreshToken(ctx, req.RefreshToken, "")
+	if errors.Is(err, errInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if errors.Is(err, errRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, please log in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check refresh token"})
+		return
+	}
+
+	resp, err := h.issueTokens(ctx, rt.UserID, rt.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RevokeTokenHandler logs a token client out by revoking the refresh token
+// and every token rotated from the same login.
+func (h *Handlers) RevokeTokenHandler(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBind(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refresh token is required"})
+		return
+	}
+
+	rt, err := h.refreshTokens.FindByToken(c.Request.Context(), req.RefreshToken)
+	if err != nil && !errors.Is(err, database.ErrRefreshTokenNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+		return
+	}
+	if rt != nil {
+		if err := h.refreshTokens.RevokeFamily(c.Request.Context(), rt.FamilyID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+			return
+		}
+	}
+	// Unknown tokens are not an error, the outcome is the same
+	c.JSON(http.StatusOK, gin.H{"message": "Refresh token revoked"})
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/totp"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// LoginChallengeLifetime is how long a user has to enter the second factor
+	// after giving the right password.
+	LoginChallengeLifetime = 5 * time.Minute
+	// loginChallengeKey is the cookie session key holding the partial session
+	// of a login waiting for its second factor.
+	loginChallengeKey = "loginChallenge"
+	recoveryCodeCount = 10
+)
+
+// completeLogin logs the user in once all factors are checked, with tokens if
+// the client asked for them and with a session cookie otherwise.
+func (h *Handlers) completeLogin(c *gin.Context, userID string) {
+	h.audit(c, auditEvent{Type: database.AuditLoginSucceeded, UserID: userID})
+	if c.Query("tokens") == "true" {
+		resp, err := h.issueTokens(c.Request.Context(), userID, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+			return
+		}
+		resp["message"] = "Logged in successfully"
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	if _, err := h.startSession(c, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged in successfully"})
+}
+
+// startLoginChallenge gives a user who got the password right a partial
+// session, which LoginSecondFactorHandler turns into a real one. Browsers keep
+// it in the cookie, token clients send login_token back.
+func (h *Handlers) startLoginChallenge(c *gin.Context, userID string) {
+	token, err := h.issueOneTimeToken(c.Request.Context(), userID, database.PurposeLoginChallenge, LoginChallengeLifetime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	session := sessions.Default(c)
+	session.Clear()
+	session.Set(loginChallengeKey, token)
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":             "Enter the code from your authenticator app",
+		"two_factor_required": true,
+		"login_token":         token,
+	})
+}
+
+// verifySecondFactor checks a code from the authenticator app or one of the
+// recovery codes. Either can only be used once.
+func (h *Handlers) verifySecondFactor(ctx context.Context, user *database.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits && strings.Trim(code, "0123456789") == "" {
+		counter, ok := totp.Validate(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+		if !ok {
+			return false, nil
+		}
+		return h.users.UseTOTPCounter(ctx, user.ID, counter)
+	}
+
+	return h.users.UseRecoveryCode(ctx, user.ID, database.HashToken(normalizeRecoveryCode(code)))
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes returns new recovery codes to show to the user and
+// the hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = database.HashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+type loginSecondFactorRequest struct {
+	LoginToken string `json:"login_token"`
+	Code       string `json:"code"`
+}
+
+// LoginSecondFactorHandler finishes a login started by LoginHandler for a user
+// with two-factor authentication.
+func (h *Handlers) LoginSecondFactorHandler(c *gin.Context) {
+	var req loginSecondFactorRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if req.LoginToken == "" {
+		req.LoginToken, _ = sessions.Default(c).Get(loginChallengeKey).(string)
+	}
+	if req.LoginToken == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login token and code are required"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if !h.secondFactorAttempts.allow(database.HashToken(req.LoginToken)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, please log in again"})
+		return
+	}
+	challenge, err := h.oneTimeTokens.Find(ctx, database.PurposeLoginChallenge, req.LoginToken)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login has expired, please log in again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login"})
+		return
+	}
+	user, err := h.users.GetByID(ctx, challenge.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login has expired, please log in again"})
+		return
+	}
+
+	ok, err := h.verifySecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		h.audit(c, auditEvent{Type: database.AuditLoginFailed, UserID: user.ID, Email: user.Email, Details: map[string]string{"reason": "invalid_code"}})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	// Only one request may turn the challenge into a session
+	if _, err := h.oneTimeTokens.Consume(ctx, database.PurposeLoginChallenge, req.LoginToken); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login has expired, please log in again"})
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Delete(loginChallengeKey)
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+		return
+	}
+	h.completeLogin(c, user.ID)
+}
+
+// TwoFactorStatusHandler tells the user whether two-factor authentication is
+// on and how many recovery codes are left.
+func (h *Handlers) TwoFactorStatusHandler(c *gin.Context) {
+	user, err := h.users.GetByID(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": user.TOTPEnabled, "recovery_codes_left": len(user.RecoveryCodes)})
+}
+
+// SetupTwoFactorHandler creates a new secret for the user to add to their
+// authenticator app. It only takes effect once confirmed with a code.
+func (h *Handlers) SetupTwoFactorHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create secret"})
+		return
+	}
+	uri := totp.URI(h.cfg.TOTPIssuer, user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create QR code"})
+		return
+	}
+	user.TOTPPendingSecret = secret
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_url": uri,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+type twoFactorCodeRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// ConfirmTwoFactorHandler turns on two-factor authentication once the user
+// proved their app generates the right codes, and hands out recovery codes.
+func (h *Handlers) ConfirmTwoFactorHandler(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+
+	counter, ok := totp.Validate(user.TOTPPendingSecret, req.Code, time.Now(), 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	user.TOTPEnabled = true
+	user.TOTPSecret = user.TOTPPendingSecret
+	user.TOTPPendingSecret = ""
+	user.TOTPLastCounter = counter
+	user.RecoveryCodes = hashes
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled, store the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactorHandler turns two-factor authentication off. It asks for
+// the password and a code, so a stolen session alone can't do it.
+func (h *Handlers) DisableTwoFactorHandler(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.BindJSON(&req); err != nil || req.Code == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password and code are required"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !h.confirmPassword(c, user, req.Password, "Invalid credentials") {
+		return
+	}
+	ok, err := h.verifySecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPPendingSecret = ""
+	user.TOTPLastCounter = 0
+	user.RecoveryCodes = nil
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodesHandler replaces all recovery codes with new ones.
+func (h *Handlers) RegenerateRecoveryCodesHandler(c *gin.Context) {
+	var req twoFactorCodeRequest
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+	ctx := c.Request.Context()
+	user, err := h.users.GetByID(ctx, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	ok, err := h.verifySecondFactor(ctx, user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+	// Checking the code changed the stored user, which must not be undone
+	user, err = h.users.GetByID(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	user.RecoveryCodes = hashes
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
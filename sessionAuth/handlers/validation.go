@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fieldErrors collects what is wrong with each field of a request, keyed by
+// the JSON name of the field, so clients can show it next to the input.
+type fieldErrors map[string][]string
+
+func (f fieldErrors) add(field, message string) {
+	f[field] = append(f[field], message)
+}
+
+// respondInvalid rejects the request with the errors of each field.
+func respondInvalid(c *gin.Context, errs fieldErrors) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Some fields are invalid", "fields": errs})
+}
+
+// checkNewPassword adds what is wrong with a new password and its
+// confirmation to errs. Passwords are never trimmed, whitespace is part of
+// them like any other character.
+func (h *Handlers) checkNewPassword(errs fieldErrors, field, password, confirmField, confirm string) {
+	if password == "" {
+		errs.add(field, "Required")
+		return
+	}
+	problems, err := h.cfg.PasswordPolicy.Check(password)
+	if err != nil {
+		// A broken breached password list shouldn't stop everyone from
+		// registering, the other rules still apply
+		log.Printf("Failed to check the breached password list: %v", err)
+	}
+	for _, p := range problems {
+		errs.add(field, p)
+	}
+	if password != confirm {
+		errs.add(confirmField, "Passwords do not match")
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/my/module/database"
+	"example.com/my/module/mailer"
+	"github.com/gin-gonic/gin"
+)
+
+// EmailVerificationLifetime is how long a verification link works.
+const EmailVerificationLifetime = 24 * time.Hour
+
+// sendVerificationEmail emails the user a link to verify their address.
+func (h *Handlers) sendVerificationEmail(ctx context.Context, user *database.User) error {
+	token, err := h.issueOneTimeToken(ctx, user.ID, database.PurposeEmailVerification, EmailVerificationLifetime)
+	if err != nil {
+		return err
+	}
+	link := h.cfg.AppURL + "/verify-email?token=" + url.QueryEscape(token)
+	h.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening this link:\n\n%s\n\n"+
+			"The link works for 24 hours. If you didn't create an account, you can ignore this email.\n", user.Firstname, link),
+	})
+	return nil
+}
+
+// markEmailVerified records that the user proved the address is theirs. The
+// caller saves the user.
+func (h *Handlers) markEmailVerified(user *database.User) {
+	now := time.Now()
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	// Addresses listed in ADMIN_EMAILS become admins once proven to be theirs
+	if h.isAdminEmail(user.Email) {
+		user.Role = database.RoleAdmin
+	}
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// VerifyEmailHandler marks the address of the user the token was sent to as
+// verified.
+func (h *Handlers) VerifyEmailHandler(c *gin.Context) {
+	var req verifyEmailRequest
+	if err := c.ShouldBind(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	token, err := h.oneTimeTokens.Consume(ctx, database.PurposeEmailVerification, req.Token)
+	if errors.Is(err, database.ErrOneTimeTokenNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check verification token"})
+		return
+	}
+
+	user, err := h.users.GetByID(ctx, token.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+
+	h.markEmailVerified(user)
+	if err := h.users.Update(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+type resendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// ResendVerificationHandler sends a new verification link. Like the password
+// reset, it doesn't reveal whether the address has an account.
+func (h *Handlers) ResendVerificationHandler(c *gin.Context) {
+	var req resendVerificationRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validMailAddress(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		return
+	}
+	if !h.resendPerIP.allow(c.ClientIP()) || !h.resendPerEmail.allow(strings.ToLower(email)) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please try again later"})
+		return
+	}
+	ctx := c.Request.Context()
+	const message = "If an unverified account exists for this address, a verification link has been sent"
+
+	user, err := h.users.GetByEmail(ctx, email)
+	if err != nil || user.EmailVerified {
+		c.JSON(http.StatusOK, gin.H{"message": message})
+		return
+	}
+	if err := h.sendVerificationEmail(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create verification token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
@@ -0,0 +1,220 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is just enough of an SMTP server to receive mail from
+// net/smtp. It offers PLAIN authentication but no TLS.
+type smtpServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	auth     string
+	from     string
+	rcpts    []string
+	messages []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			conn.Write([]byte(l + "\r\n"))
+		}
+	}
+	reply("220 test ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		s.mu.Lock()
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250-test", "250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+			reply("235 OK")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.rcpts = append(s.rcpts, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					s.mu.Unlock()
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.messages = append(s.messages, data.String())
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("250 OK")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *smtpServer) received() (auth, from string, rcpts, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth, s.from, append([]string(nil), s.rcpts...), append([]string(nil), s.messages...)
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	s := newSMTPServer(t)
+	m := SMTPMailer{Addr: s.ln.Addr().String(), From: "noreply@example.com", Username: "user", Password: "secret"}
+	err := m.Send(context.Background(), Message{
+		To:      "anna@example.com",
+		Subject: "Reset your password",
+		Body:    "Hi Anna,\n\nhttp://app.test/reset-password?token=abc\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, from, rcpts, messages := s.received()
+	if want := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")); auth != want {
+		t.Errorf("got auth %q, want %q", auth, want)
+	}
+	if from != "MAIL FROM:<noreply@example.com>" && !strings.HasPrefix(from, "MAIL FROM:<noreply@example.com> ") {
+		t.Errorf("got %q", from)
+	}
+	if len(rcpts) != 1 || rcpts[0] != "RCPT TO:<anna@example.com>" {
+		t.Errorf("got recipients %q", rcpts)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	for _, want := range []string{
+		"From: noreply@example.com\r\n",
+		"To: anna@example.com\r\n",
+		"Subject: Reset your password\r\n",
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n",
+		"Hi Anna,\r\n\r\nhttp://app.test/reset-password?token=abc\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q doesn't contain %q", msg, want)
+		}
+	}
+}
+
+func TestSMTPMailerStripsLineBreaksFromHeaders(t *testing.T) {
+	s := newSMTPServer(t)
+	m := SMTPMailer{Addr: s.ln.Addr().String(), From: "noreply@example.com"}
+	err := m.Send(context.Background(), Message{
+		To:      "anna@example.com",
+		Subject: "Hello\r\nBcc: mallory@example.com",
+		Body:    "Hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, messages := s.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if strings.Contains(messages[0], "\r\nBcc:") || !strings.Contains(messages[0], "Subject: HelloBcc: mallory@example.com\r\n") {
+		t.Errorf("header was injected into %q", messages[0])
+	}
+}
+
+func TestSMTPMailerHonoursContext(t *testing.T) {
+	// A server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		case <-time.After(time.Second):
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = SMTPMailer{Addr: ln.Addr().String(), From: "noreply@example.com"}.Send(ctx, Message{To: "anna@example.com"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := &MemoryMailer{}
+	if _, ok := m.Last("anna@example.com"); ok {
+		t.Error("found a message before any was sent")
+	}
+	for _, msg := range []Message{
+		{To: "anna@example.com", Subject: "first"},
+		{To: "ben@example.com", Subject: "second"},
+		{To: "anna@example.com", Subject: "third"},
+	} {
+		if err := m.Send(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := m.Sent(); len(got) != 3 || got[0].Subject != "first" || got[2].Subject != "third" {
+		t.Errorf("got %v", got)
+	}
+	if msg, ok := m.Last("anna@example.com"); !ok || msg.Subject != "third" {
+		t.Errorf("got %v %v, want the third message", msg, ok)
+	}
+	if msg, ok := m.Last("ben@example.com"); !ok || msg.Subject != "second" {
+		t.Errorf("got %v %v, want the second message", msg, ok)
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"log"
       "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
 	"example.com/my/module/database"
 	"example.com/my/module/handlers"
+	"example.com/my/module/mailer"
 	"example.com/my/module/middleware"
+	"example.com/my/module/oidc"
+	"example.com/my/module/passwords"
+	"example.com/my/module/tokens"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
@@ -13,36 +24,309 @@ import (
 
 )
 func main(){
-	err:=database.ConnectDB()
+	var stores *database.Stores
+	var err error
+	// SESSION_STORE is the older name of the switch
+	if os.Getenv("STORE")=="memory"||os.Getenv("SESSION_STORE")=="memory"{
+		// Everything is lost on restart
+		stores=database.NewMemoryStores()
+	}else{
+		stores,err=database.ConnectDB(database.Config{
+			URI:getenv("MONGO_URI","mongodb://localhost:27017"),
+			Name:getenv("MONGO_DB","my_db"),
+			ChatName:getenv("CHAT_DB","chat_app"),
+		})
+		if err!=nil{
+			log.Fatal("Failed to connect to database",err)
+		}
+	}
+	issuer,err:=newTokenIssuer()
 	if err!=nil{
-		log.Fatal("Failed to connect to database",err)
+		log.Fatal("Failed to load the token signing key",err)
+	}
+	appURL:=strings.TrimRight(getenv("APP_URL","http://localhost:3000"),"/")
+	cookieOptions:=newCookieOptions()
+	h:=handlers.New(stores,newMailer(),issuer,handlers.Config{
+		AppURL:appURL,
+		RequireVerifiedEmail:os.Getenv("REQUIRE_VERIFIED_EMAIL")=="true",
+		AdminEmails:splitList(os.Getenv("ADMIN_EMAILS")),
+		TOTPIssuer:getenv("TOTP_ISSUER","Chatroom"),
+		IntrospectionSecret:newIntrospectionSecret(),
+		FileServiceURL:strings.TrimRight(getenv("FILE_SERVICE_URL","http://localhost:8070"),"/"),
+		ExportDir:getenv("EXPORT_DIR","./exports"),
+		OIDCProviders:newOIDCProviders(),
+		PasswordPolicy:newPasswordPolicy(),
+		Cookie:cookieOptions,
+	})
+	mw:=middleware.New(stores.Sessions,stores.Users,stores.APIKeys,issuer)
+	if err:=h.BootstrapAdmins(context.Background());err!=nil{
+		log.Fatal("Failed to set up admins",err)
 	}
+	go pruneExports(h)
 	router:=gin.Default();
-	store:=cookie.NewStore([]byte("secret"))
+	store:=cookie.NewStore(newSessionSecret())
+	store.Options(cookieOptions)
 	
+	router.Use(middleware.RequestID())
+	// Only our own apps may call the API from a browser
+	router.Use(middleware.CORS(splitList(getenv("CORS_ALLOWED_ORIGINS",appURL))))
 	router.Use(sessions.Sessions("mysession",store))
-	
-	// config := cors.DefaultConfig()
-    // config.AllowOrigins = []string{"http://127.0.0.1:8080"} 
-    // router.Use(cors.New(config))
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Content-Length, X-CSRF-Token, Token, session")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
-		}
-		c.Next()
-	})
+	// The token and introspection endpoints are called by other servers,
+	// which authenticate themselves in the request body. Registering, the
+	// emailed links and logins asking for tokens don't start a session, so
+	// apps without cookies can use them too. Login links stay browser only,
+	// they only work in the browser holding their cookie.
+	router.Use(middleware.CSRF(cookieOptions,"/oauth/token","/introspect","/token/refresh","/token/revoke",
+		"/register","/password/forgot","/password/reset","/email/verify","/email/verify/resend","/email/change/confirm",
+		"/login?tokens=true","/login/2fa?tokens=true"))
 
 
-	router.POST("/register",handlers.RegisterHandler)
-	router.POST("/login",handlers.LoginHandler)
-	router.GET("/profile",middleware.AuthMiddleware(), handlers.ProfileHandler)
-	router.GET("/logout", middleware.AuthMiddleware(), handlers.LogoutHandler)
-	router.GET("/users", handlers.GetAllUsers)
-	router.GET("/userspecific", handlers.GetSpecificUser)
+	router.GET("/csrf",h.CSRFTokenHandler)
+	router.POST("/register",h.RegisterHandler)
+	router.POST("/login",h.LoginHandler)
+	router.GET("/profile",mw.AnyAuthMiddleware(), h.ProfileHandler)
+	router.PATCH("/profile", mw.AnyAuthMiddleware(), h.UpdateProfileHandler)
+	router.PUT("/profile/avatar", mw.AnyAuthMiddleware(), h.UploadAvatarHandler)
+	router.DELETE("/profile/avatar", mw.AnyAuthMiddleware(), h.DeleteAvatarHandler)
+	router.GET("/users/:id/profile", h.PublicProfileHandler)
+	router.POST("/password/change", mw.AnyAuthMiddleware(), h.ChangePasswordHandler)
+	router.POST("/email/change", mw.AnyAuthMiddleware(), h.ChangeEmailHandler)
+	router.POST("/email/change/confirm", h.ConfirmEmailChangeHandler)
+	router.DELETE("/account", mw.AnyAuthMiddleware(), h.DeleteAccountHandler)
+	router.POST("/account/export", mw.AnyAuthMiddleware(), h.StartExportHandler)
+	router.GET("/account/export", mw.AnyAuthMiddleware(), h.ExportStatusHandler)
+	router.GET("/account/export/download", mw.AnyAuthMiddleware(), h.DownloadExportHandler)
+	router.POST("/logout", mw.AuthMiddleware(), h.LogoutHandler)
+	router.GET("/users", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.GetAllUsers)
+	router.GET("/userspecific", mw.AnyAuthMiddleware(), h.GetSpecificUser)
+	router.GET("/directory", mw.AnyAuthMiddleware(), h.DirectoryHandler)
+	router.PUT("/admin/users/:id/role", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.SetRoleHandler)
+	router.GET("/sessions", mw.AnyAuthMiddleware(), h.ListSessionsHandler)
+	router.DELETE("/sessions/:id", mw.AnyAuthMiddleware(), h.RevokeSessionHandler)
+	router.POST("/token/refresh", h.RefreshTokenHandler)
+	router.POST("/token/revoke", h.RevokeTokenHandler)
+	router.POST("/email/verify", h.VerifyEmailHandler)
+	router.POST("/email/verify/resend", h.ResendVerificationHandler)
+	router.POST("/login/2fa", h.LoginSecondFactorHandler)
+	router.POST("/login/magic", h.MagicLinkHandler)
+	router.POST("/login/magic/callback", h.MagicLinkCallbackHandler)
+	router.GET("/2fa", mw.AnyAuthMiddleware(), h.TwoFactorStatusHandler)
+	router.POST("/2fa/setup", mw.AnyAuthMiddleware(), h.SetupTwoFactorHandler)
+	router.POST("/2fa/confirm", mw.AnyAuthMiddleware(), h.ConfirmTwoFactorHandler)
+	router.POST("/2fa/disable", mw.AnyAuthMiddleware(), h.DisableTwoFactorHandler)
+	router.POST("/2fa/recovery-codes", mw.AnyAuthMiddleware(), h.RegenerateRecoveryCodesHandler)
+	router.POST("/password/forgot", h.ForgotPasswordHandler)
+	router.POST("/password/reset", h.ResetPasswordHandler)
+	router.GET("/admin/audit", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.ListAuditEventsHandler)
+	router.GET("/admin/lockouts", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.ListLockoutsHandler)
+	router.DELETE("/admin/lockouts/:key", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.ClearLockoutHandler)
+	router.GET("/.well-known/jwks.json", h.JWKSHandler)
+	router.POST("/introspect", h.IntrospectHandler)
+	router.GET("/oauth/authorize", h.AuthorizeHandler)
+	router.GET("/oauth/consent", mw.AuthMiddleware(), h.ConsentInfoHandler)
+	router.POST("/oauth/consent", mw.AuthMiddleware(), h.ConsentHandler)
+	router.POST("/oauth/token", h.OAuthTokenHandler)
+	router.GET("/oauth/consents", mw.AnyAuthMiddleware(), h.ListConsentsHandler)
+	router.DELETE("/oauth/consents/:client_id", mw.AnyAuthMiddleware(), h.RevokeConsentHandler)
+	router.GET("/apikeys", mw.AnyAuthMiddleware(), h.ListAPIKeysHandler)
+	router.POST("/apikeys", mw.AnyAuthMiddleware(), h.CreateAPIKeyHandler)
+	router.DELETE("/apikeys/:id", mw.AnyAuthMiddleware(), h.RevokeAPIKeyHandler)
+	router.GET("/userinfo", mw.ScopeMiddleware("profile"), h.UserInfoHandler)
+	router.POST("/admin/oauth/clients", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.CreateClientHandler)
+	router.GET("/admin/oauth/clients", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.ListClientsHandler)
+	router.DELETE("/admin/oauth/clients/:id", mw.AnyAuthMiddleware(), mw.RequireRole(database.RoleAdmin), h.DeleteClientHandler)
+	router.GET("/auth/providers", h.OIDCProvidersHandler)
+	router.GET("/auth/:provider/login", h.OIDCLoginHandler)
+	router.GET("/auth/:provider/callback", h.OIDCCallbackHandler)
+	router.GET("/auth/:provider/link", mw.AuthMiddleware(), h.OIDCLinkHandler)
+	router.DELETE("/auth/:provider/link", mw.AnyAuthMiddleware(), h.UnlinkIdentityHandler)
 	router.Run(":8080")
 
-}
\ No newline at end of file
+}
+
+// newTokenIssuer sets up access token signing from JWT_PRIVATE_KEY_FILE. Without
+// a key file a temporary key is generated, which is fine for development but
+// logs everyone out of token clients on restart.
+func newTokenIssuer() (*tokens.Issuer, error) {
+	issuer := getenv("JWT_ISSUER", "http://localhost:8080")
+	audience := getenv("JWT_AUDIENCE", "chatroom")
+
+	if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+		key, err := tokens.LoadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return tokens.NewIssuer(key, issuer, audience), nil
+	}
+
+	log.Println("JWT_PRIVATE_KEY_FILE is not set, using a temporary signing key")
+	key, err := tokens.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return tokens.NewIssuer(key, issuer, audience), nil
+}
+
+// newOIDCProviders sets up the login providers named in OIDC_PROVIDERS. Each
+// one is configured with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and optionally OIDC_<NAME>_SCOPES, and has to
+// accept PUBLIC_URL/auth/<name>/callback as redirect URL.
+func newOIDCProviders() []*oidc.Provider {
+	publicURL := strings.TrimRight(getenv("PUBLIC_URL", "http://localhost:8080"), "/")
+	var providers []*oidc.Provider
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := &oidc.Provider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  publicURL + "/auth/" + name + "/callback",
+			Scopes:       strings.Fields(getenv(prefix+"SCOPES", "email profile")),
+			HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Printf("%sISSUER or %sCLIENT_ID is not set, skipping login provider %s", prefix, prefix, name)
+			continue
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+// newCookieOptions reads COOKIE_DOMAIN, COOKIE_SECURE and COOKIE_SAMESITE.
+// Cookies are Secure by default when PUBLIC_URL is https, and SameSite=Lax,
+// which still sends them when the browser comes back from a login provider.
+func newCookieOptions() sessions.Options {
+	opts := sessions.Options{
+		Path:     "/",
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+		MaxAge:   int(handlers.SessionLifetime.Seconds()),
+		Secure:   strings.HasPrefix(getenv("PUBLIC_URL", "http://localhost:8080"), "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s := os.Getenv("COOKIE_SECURE"); s != "" {
+		secure, err := strconv.ParseBool(s)
+		if err != nil {
+			log.Fatal("COOKIE_SECURE must be true or false")
+		}
+		opts.Secure = secure
+	}
+	switch strings.ToLower(getenv("COOKIE_SAMESITE", "lax")) {
+	case "lax":
+	case "strict":
+		// Logins through OIDC providers break, their redirect back to us is
+		// a cross-site navigation that doesn't carry the cookie
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !opts.Secure {
+			log.Fatal("COOKIE_SAMESITE=none requires secure cookies")
+		}
+		opts.SameSite = http.SameSiteNoneMode
+	default:
+		log.Fatal("COOKIE_SAMESITE must be lax, strict or none")
+	}
+	if !opts.Secure {
+		log.Println("Cookies are not marked Secure, set COOKIE_SECURE=true when serving over https")
+	}
+	return opts
+}
+
+// newSessionSecret reads the key the session cookie is signed with from
+// SESSION_SECRET. Without it a random key is used, which logs everyone out
+// on restart.
+func newSessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			log.Fatal("SESSION_SECRET must be at least 32 characters")
+		}
+		return []byte(secret)
+	}
+	log.Println("SESSION_SECRET is not set, using a temporary key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("Failed to generate a session key", err)
+	}
+	return key
+}
+
+// newIntrospectionSecret reads the secret services present to /introspect
+// from INTROSPECTION_SECRET. Without it the endpoint answers anyone, so it
+// must not be reachable from outside.
+func newIntrospectionSecret() string {
+	secret := os.Getenv("INTROSPECTION_SECRET")
+	if secret == "" {
+		log.Println("INTROSPECTION_SECRET is not set, anyone who can reach /introspect can look up tokens")
+	}
+	return secret
+}
+// newPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MAX_BYTES and
+// BREACHED_PASSWORDS_DIR, a directory of Have I Been Pwned range files.
+func newPasswordPolicy() passwords.Policy {
+	var policy passwords.Policy
+	for key, value := range map[string]*int{"PASSWORD_MIN_LENGTH": &policy.MinLength, "PASSWORD_MAX_BYTES": &policy.MaxBytes} {
+		if s := os.Getenv(key); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				log.Fatalf("%s must be a positive number", key)
+			}
+			*value = n
+		}
+	}
+	if policy.MaxBytes > passwords.BcryptMaxBytes {
+		log.Printf("PASSWORD_MAX_BYTES is above bcrypt's limit, using %d", passwords.BcryptMaxBytes)
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		policy.Breached = &passwords.RangeDir{Path: dir}
+	} else {
+		log.Println("BREACHED_PASSWORDS_DIR is not set, passwords aren't checked against breaches")
+	}
+	return policy
+}
+
+// newMailer sends mail through SMTP_ADDR if it is set and logs it otherwise.
+func newMailer() mailer.Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Println("SMTP_ADDR is not set, emails are written to the log")
+		return mailer.LogMailer{}
+	}
+	return mailer.SMTPMailer{
+		Addr:     addr,
+		From:     getenv("SMTP_FROM", "no-reply@localhost"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// pruneExports deletes expired data exports every hour.
+func pruneExports(h *handlers.Handlers) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := h.PruneExports(ctx); err != nil {
+			log.Printf("Failed to prune data exports: %v", err)
+		}
+		cancel()
+		time.Sleep(time.Hour)
+	}
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma separated setting, ignoring blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
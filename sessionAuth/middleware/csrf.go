@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CSRFCookie holds the token that state-changing requests have to repeat
+	// in CSRFHeader. Another site can make the browser send the cookie, but
+	// can't read it, so it can't set the header.
+	CSRFCookie = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// CSRF protects state-changing requests with double-submit tokens. Every
+// client gets a token cookie, and POST, PUT, PATCH and DELETE requests must
+// send the same token in the X-CSRF-Token header. The cookie is set with
+// the given options, HttpOnly is ignored since scripts have to read it.
+//
+// Requests with an Authorization header don't rely on cookies and are let
+// through, as are the exempt paths, which don't act on cookies either. An
+// exempt path may carry a query, like /login?tokens=true, and is then only
+// exempt for requests with those query parameters.
+func CSRF(opts sessions.Options, exempt ...string) gin.HandlerFunc {
+	skip := make(map[string][]url.Values, len(exempt))
+	for _, e := range exempt {
+		path, query, _ := strings.Cut(e, "?")
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			panic("middleware: invalid CSRF exemption " + e)
+		}
+		skip[path] = append(skip[path], params)
+	}
+	exempted := func(c *gin.Context) bool {
+		query := c.Request.URL.Query()
+		for _, params := range skip[c.FullPath()] {
+			matches := true
+			for name := range params {
+				if query.Get(name) != params.Get(name) {
+					matches = false
+				}
+			}
+			if matches {
+				return true
+			}
+		}
+		return false
+	}
+	return func(c *gin.Context) {
+		token, err := c.Cookie(CSRFCookie)
+		if err != nil || token == "" {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to create CSRF token"})
+				return
+			}
+			token = base64.RawURLEncoding.EncodeToString(b)
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     CSRFCookie,
+				Value:    token,
+				Path:     "/",
+				Domain:   opts.Domain,
+				Secure:   opts.Secure,
+				SameSite: opts.SameSite,
+			})
+		}
+		c.Set("csrfToken", token)
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if exempted(c) || c.GetHeader("Authorization") != "" {
+			c.Next()
+			return
+		}
+		given := strings.TrimSpace(c.GetHeader(CSRFHeader))
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CORS lets the listed origins call the API from browsers, with cookies.
+// Requests from other origins get no CORS headers, so browsers don't let
+// scripts on those sites read the responses.
+func CORS(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.TrimRight(origin, "/")] = true
+	}
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		c.Writer.Header().Add("Vary", "Origin")
+		if origin == "" || !allowed[origin] {
+			if c.Request.Method == http.MethodOptions && origin != "" {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Set("Access-Control-Expose-Headers", RequestIDHeader)
+		if c.Request.Method == http.MethodOptions {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, "+CSRFHeader+", "+RequestIDHeader)
+			h.Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func newCSRFRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CSRF(sessions.Options{Path: "/"}, "/introspect", "/login?tokens=true"))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/csrf", ok)
+	r.POST("/introspect", ok)
+	r.POST("/login", ok)
+	r.POST("/account", ok)
+	return r
+}
+
+func csrfRequest(r *gin.Engine, method, target string, header ...string) int {
+	req := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestCSRFIssuesToken(t *testing.T) {
+	r := newCSRFRouter()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/csrf", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == CSRFCookie {
+			token = cookie.Value
+			if cookie.HttpOnly {
+				t.Error("scripts can't read the token cookie")
+			}
+		}
+	}
+	if token == "" {
+		t.Fatal("no token cookie")
+	}
+
+	// A client that already has a token keeps it
+	req := httptest.NewRequest(http.MethodGet, "/csrf", nil)
+	req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("token replaced with %v", cookies)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	r := newCSRFRouter()
+	const cookie = CSRFCookie + "=token"
+	for _, test := range []struct {
+		name   string
+		method string
+		target string
+		header []string
+		want   int
+	}{
+		{"safe method", http.MethodGet, "/csrf", nil, http.StatusOK},
+		{"no token", http.MethodPost, "/account", []string{"Cookie", cookie}, http.StatusForbidden},
+		{"wrong token", http.MethodPost, "/account", []string{"Cookie", cookie, CSRFHeader, "other"}, http.StatusForbidden},
+		{"header without cookie", http.MethodPost, "/account", []string{CSRFHeader, "token"}, http.StatusForbidden},
+		{"matching token", http.MethodPost, "/account", []string{"Cookie", cookie, CSRFHeader, "token"}, http.StatusOK},
+		{"bearer token", http.MethodPost, "/account", []string{"Authorization", "Bearer abc"}, http.StatusOK},
+		{"exempt path", http.MethodPost, "/introspect", nil, http.StatusOK},
+		{"session login", http.MethodPost, "/login", nil, http.StatusForbidden},
+		{"session login with other query", http.MethodPost, "/login?tokens=false", nil, http.StatusForbidden},
+		{"token login", http.MethodPost, "/login?tokens=true", nil, http.StatusOK},
+		{"token login with a cookie", http.MethodPost, "/login?tokens=true", []string{"Cookie", cookie}, http.StatusOK},
+		{"query on a path that isn't exempt", http.MethodPost, "/account?tokens=true", []string{"Cookie", cookie}, http.StatusForbidden},
+	} {
+		if got := csrfRequest(r, test.method, test.target, test.header...); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -1,21 +1,238 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
+	"example.com/my/module/database"
+	"example.com/my/module/tokens"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
-func AuthMiddleware() gin.HandlerFunc{
-	return func(c *gin.Context){
-		session:=sessions.Default(c)
-		userID := session.Get("userID")
-        if userID == nil {
+// touchInterval limits how often the last-used time of a session is written.
+const touchInterval = time.Minute
+
+// RequestIDHeader carries the ID that ties log lines and audit events to a
+// request.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID gives every request an ID, taking the one set by a proxy in front
+// of us if it looks sane, and echoes it in the response.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		c.Set("requestID", id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware authenticates requests against the session store, the access
+// token issuer and the API keys.
+type Middleware struct {
+	sessions database.SessionStore
+	users    database.UserRepository
+	apiKeys  database.APIKeyStore
+	tokens   *tokens.Issuer
+}
+
+func New(sessions database.SessionStore, users database.UserRepository, apiKeys database.APIKeyStore, issuer *tokens.Issuer) *Middleware {
+	return &Middleware{sessions: sessions, users: users, apiKeys: apiKeys, tokens: issuer}
+}
+
+func (m *Middleware) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		token, _ := session.Get(database.SessionTokenKey).(string)
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+			c.Abort()
+			return
+		}
+
+		// The cookie is only a reference, the session must still exist on the server
+		s, err := m.sessions.FindByToken(c.Request.Context(), token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+			c.Abort()
+			return
+		}
+		if now := time.Now(); now.Sub(s.LastUsedAt) > touchInterval {
+			m.sessions.Touch(c.Request.Context(), s.ID, now)
+		}
+
+		c.Set("userID", s.UserID)
+		c.Set("sessionID", s.ID)
+		c.Next()
+	}
+}
+
+// BearerAuthMiddleware accepts requests carrying a valid access token in the
+// Authorization header, for clients that don't keep the session cookie.
+func (m *Middleware) BearerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+			c.Abort()
+			return
+		}
+
+		claims, err := m.tokens.Verify(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+			c.Abort()
+			return
+		}
+		// Tokens issued to OAuth clients are for the other services, the
+		// account itself is only managed by our own apps
+		if claims.ClientID != "" {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			c.JSON(http.StatusForbidden, gin.H{"error": "This token can't be used here"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", claims.Subject)
+		c.Next()
+	}
+}
+
+// ScopeMiddleware accepts access tokens of our own logins, and tokens issued
+// to OAuth clients and API keys that were granted the scope.
+func (m *Middleware) ScopeMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
-            c.Abort()
-            return
-        }
-        c.Next()
+			c.Abort()
+			return
+		}
+		if strings.HasPrefix(token, database.APIKeyPrefix) {
+			m.apiKeyAuth(c, token, scope)
+			return
+		}
+		claims, err := m.tokens.Verify(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+			c.Abort()
+			return
+		}
+		if !claims.HasScope(scope) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", claims.Subject)
+		c.Set("clientID", claims.ClientID)
+		c.Next()
+	}
+}
+
+func (m *Middleware) apiKeyAuth(c *gin.Context, key, scope string) {
+	k, err := m.apiKeys.FindByKey(c.Request.Context(), key)
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+		return
+	}
+	granted := false
+	for _, s := range k.Scopes {
+		if s == scope {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+		c.Abort()
+		return
+	}
+	if now := time.Now(); k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > touchInterval {
+		m.apiKeys.Touch(c.Request.Context(), k.ID, now)
+	}
+
+	c.Set("userID", k.UserID)
+	c.Set("apiKeyID", k.ID)
+	c.Next()
+}
+
+// AnyAuthMiddleware uses the access token when the request has one and the
+// session cookie otherwise.
+func (m *Middleware) AnyAuthMiddleware() gin.HandlerFunc {
+	session, bearer := m.AuthMiddleware(), m.BearerAuthMiddleware()
+	return func(c *gin.Context) {
+		if _, ok := bearerToken(c); ok {
+			bearer(c)
+			return
+		}
+		session(c)
+	}
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// RequireRole only lets users with one of the roles through. It must come
+// after one of the authentication middlewares.
+func (m *Middleware) RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := m.users.GetByID(c.Request.Context(), c.GetString("userID"))
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+			return
+		}
+		role := user.Role
+		if role == "" {
+			role = database.RoleUser
+		}
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Set("role", role)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,106 @@
+// Package passwords decides which passwords users may choose.
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMinLength is the minimum length in characters when the policy
+	// doesn't set one.
+	DefaultMinLength = 8
+	// BcryptMaxBytes is how much of a password bcrypt looks at. Anything
+	// after it would be silently ignored, so longer passwords are refused.
+	BcryptMaxBytes = 72
+)
+
+// Policy is what a new password has to satisfy.
+type Policy struct {
+	MinLength int
+	// MaxBytes is capped at BcryptMaxBytes, which is also the default.
+	MaxBytes int
+	// Breached is checked for passwords known from data breaches. Leave it
+	// nil to skip the check.
+	Breached *RangeDir
+}
+
+// Check returns what is wrong with the password, in words that can be shown
+// to the user. It returns nothing if the password is acceptable. The password
+// is taken exactly as given, whitespace included.
+func (p Policy) Check(password string) ([]string, error) {
+	minLength := p.MinLength
+	if minLength <= 0 {
+		minLength = DefaultMinLength
+	}
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 || maxBytes > BcryptMaxBytes {
+		maxBytes = BcryptMaxBytes
+	}
+
+	var problems []string
+	if utf8.RuneCountInString(password) < minLength {
+		problems = append(problems, fmt.Sprintf("Must be at least %d characters long", minLength))
+	}
+	if len(password) > maxBytes {
+		problems = append(problems, fmt.Sprintf("Must be at most %d bytes long", maxBytes))
+	}
+	if problems != nil || p.Breached == nil {
+		return problems, nil
+	}
+	breached, err := p.Breached.Contains(password)
+	if err != nil {
+		return nil, err
+	}
+	if breached {
+		problems = append(problems, "This password has appeared in a data breach, please choose another one")
+	}
+	return problems, nil
+}
+
+// RangeDir is a local copy of a breached password list split by hash prefix,
+// the way the k-anonymity range API of Have I Been Pwned serves it. Each file
+// is named after the first five hex digits of the SHA-1 hashes it holds,
+// optionally with a .txt extension, and has one SUFFIX:COUNT line per hash.
+type RangeDir struct {
+	Path string
+}
+
+// Contains reports whether the password is on the list. Only the file for its
+// hash prefix is read.
+func (d *RangeDir) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(d.Path, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(d.Path, prefix+".txt"))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// A missing file means nothing with that prefix was breached
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padding entries, added so responses all look alike, have a count of 0
+		if strings.EqualFold(line, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
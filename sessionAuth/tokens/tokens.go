@@ -0,0 +1,175 @@
+// Package tokens issues and verifies the signed JWT access tokens handed to
+// clients that can't use the session cookie.
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// AccessTokenLifetime is how long an access token is valid. Clients use a
+// refresh token to get a new one.
+const AccessTokenLifetime = 15 * time.Minute
+
+// Claims are the claims of an access token. Tokens issued to OAuth clients
+// carry the client and the scopes it was granted, tokens of our own logins
+// have neither and may do everything the user can.
+type Claims struct {
+	jwt.RegisteredClaims
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// HasScope reports whether the token may be used for the scope.
+func (c *Claims) HasScope(scope string) bool {
+	if c.ClientID == "" {
+		return true
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Issuer signs access tokens with an RSA key and verifies them again.
+type Issuer struct {
+	key      *rsa.PrivateKey
+	keyID    string
+	issuer   string
+	audience string
+}
+
+// NewIssuer returns an issuer signing with key. The key ID is derived from the
+// public key so that it changes whenever the key does.
+func NewIssuer(key *rsa.PrivateKey, issuer, audience string) *Issuer {
+	der := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	sum := sha256.Sum256(der)
+	return &Issuer{
+		key:      key,
+		keyID:    base64.RawURLEncoding.EncodeToString(sum[:8]),
+		issuer:   issuer,
+		audience: audience,
+	}
+}
+
+// LoadKey reads a PEM encoded RSA private key in PKCS #1 or PKCS #8 form.
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return key, nil
+}
+
+// GenerateKey returns a new signing key. Tokens signed with it stop being
+// valid when the process exits, so it is only meant for development.
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// Issue returns a signed access token for the user and when it expires.
+func (i *Issuer) Issue(userID string) (string, time.Time, error) {
+	return i.IssueForClient(userID, "", nil)
+}
+
+// IssueForClient returns a signed access token limited to the scopes, issued
+// to an OAuth client on behalf of subject.
+func (i *Issuer) IssueForClient(subject, clientID string, scopes []string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenLifetime)
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.issuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{i.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        uuid.New().String(),
+		},
+		Scope:    strings.Join(scopes, " "),
+		ClientID: clientID,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = i.keyID
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// Verify checks the signature, issuer, audience and lifetime of an access
+// token and returns its claims.
+func (i *Issuer) Verify(tokenString string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		return &i.key.PublicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(i.issuer),
+		jwt.WithAudience(i.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+// JWK is an RSA public key in JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS returns the public signing key as a JSON Web Key Set, so that other
+// services can verify access tokens without calling back.
+func (i *Issuer) JWKS() map[string][]JWK {
+	pub := i.key.PublicKey
+	return map[string][]JWK{"keys": {{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwt.SigningMethodRS256.Alg(),
+		Kid: i.keyID,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+}
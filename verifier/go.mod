@@ -0,0 +1,5 @@
+module example.com/my/verifier
+
+go 1.22.1
+
+require github.com/golang-jwt/jwt/v5 v5.2.1
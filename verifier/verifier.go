@@ -0,0 +1,347 @@
+// Package verifier lets the chat services check who is calling them. Access
+// tokens issued by sessionAuth are verified locally against its published
+// signing keys; anything else is sent to its introspection endpoint.
+package verifier
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoToken      = errors.New("verifier: no token in request")
+	ErrInvalidToken = errors.New("verifier: token is invalid or expired")
+)
+
+const (
+	// keyRefreshInterval is how often the signing keys are fetched again.
+	keyRefreshInterval = time.Hour
+	// minKeyRefresh stops unknown key IDs from making us hammer the JWKS endpoint.
+	minKeyRefresh = time.Minute
+)
+
+// Config says where sessionAuth is and what its tokens look like.
+type Config struct {
+	// JWKSURL is sessionAuth's /.well-known/jwks.json.
+	JWKSURL string
+	// Issuer and Audience must match the iss and aud claims of access tokens.
+	Issuer   string
+	Audience string
+	// IntrospectURL is sessionAuth's /introspect. Leave it empty to accept
+	// only JWT access tokens.
+	IntrospectURL string
+	// IntrospectSecret authenticates this service to the introspection endpoint.
+	IntrospectSecret string
+	// HTTPClient defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// FromBaseURL returns the configuration for a sessionAuth instance running at
+// baseURL with the default endpoint paths.
+func FromBaseURL(baseURL, audience, introspectSecret string) Config {
+	baseURL = strings.TrimRight(baseURL, "/")
+	return Config{
+		JWKSURL:          baseURL + "/.well-known/jwks.json",
+		Issuer:           baseURL,
+		Audience:         audience,
+		IntrospectURL:    baseURL + "/introspect",
+		IntrospectSecret: introspectSecret,
+	}
+}
+
+// Identity is who a token belongs to.
+type Identity struct {
+	Subject  string
+	Scopes   []string
+	ClientID string
+	// TokenType is access_token or, for introspected tokens, whatever
+	// sessionAuth reports, such as api_key.
+	TokenType string
+	ExpiresAt time.Time
+}
+
+// HasScope reports whether the token was granted the scope. Like sessionAuth,
+// only access tokens of its own apps, which have no ClientID, have every
+// scope. Tokens of OAuth clients and API keys have just the scopes they were
+// granted, so granting none gives no access.
+func (i *Identity) HasScope(scope string) bool {
+	if i.ClientID == "" && i.TokenType == "access_token" {
+		return true
+	}
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier checks tokens. It is safe for concurrent use.
+type Verifier struct {
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the key set being fetched arrived. It is nil
+	// while no fetch is running.
+	fetching chan struct{}
+}
+
+func New(cfg Config) *Verifier {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Verifier{cfg: cfg, client: client}
+}
+
+// TokenFromRequest returns the bearer token of the request. WebSocket clients
+// in browsers can't set headers, so the access_token query parameter is
+// accepted as well.
+func TokenFromRequest(r *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") && token != "" {
+		return token, nil
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, nil
+	}
+	return "", ErrNoToken
+}
+
+// VerifyRequest verifies the bearer token of the request.
+func (v *Verifier) VerifyRequest(r *http.Request) (*Identity, error) {
+	token, err := TokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return v.Verify(r.Context(), token)
+}
+
+// Verify returns the identity behind a token. JWTs are checked locally, other
+// tokens are introspected if an introspection endpoint is configured.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	if strings.Count(token, ".") == 2 {
+		return v.verifyJWT(ctx, token)
+	}
+	if v.cfg.IntrospectURL == "" {
+		return nil, ErrInvalidToken
+	}
+	return v.Introspect(ctx, token)
+}
+
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+func (v *Verifier) verifyJWT(ctx context.Context, token string) (*Identity, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(v.cfg.Issuer),
+		jwt.WithAudience(v.cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return &Identity{
+		Subject:   claims.Subject,
+		Scopes:    strings.Fields(claims.Scope),
+		ClientID:  claims.ClientID,
+		TokenType: "access_token",
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// key returns the signing key with the given ID, fetching the key set again
+// if it is stale or doesn't know the ID. The lock isn't held while fetching,
+// and requests arriving meanwhile wait for that fetch instead of starting
+// their own.
+func (v *Verifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	fetchedAt := v.fetchedAt
+	age := time.Since(fetchedAt)
+	if (ok && age < keyRefreshInterval) || (!ok && age < minKeyRefresh) {
+		v.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("verifier: unknown key %q", kid)
+		}
+		return key, nil
+	}
+
+	var fetchErr error
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		done = make(chan struct{})
+		v.fetching = done
+		v.mu.Unlock()
+
+		var keys map[string]*rsa.PublicKey
+		keys, fetchErr = v.fetchKeys(ctx)
+
+		v.mu.Lock()
+		if fetchErr == nil {
+			v.keys, v.fetchedAt = keys, time.Now()
+		}
+		v.fetching = nil
+		v.mu.Unlock()
+		close(done)
+	}
+
+	v.mu.Lock()
+	fresh, found := v.keys[kid]
+	refreshed := v.fetchedAt != fetchedAt
+	v.mu.Unlock()
+	switch {
+	case found:
+		return fresh, nil
+	case refreshed:
+		return nil, fmt.Errorf("verifier: unknown key %q", kid)
+	case ok:
+		// Keep using the key we know until sessionAuth is back
+		return key, nil
+	case fetchErr != nil:
+		return nil, fetchErr
+	}
+	return nil, errors.New("verifier: fetching keys failed")
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("verifier: fetching keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("verifier: decoding keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// Introspect asks sessionAuth about a token, as described in RFC 7662.
+func (v *Verifier) Introspect(ctx context.Context, token string) (*Identity, error) {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.cfg.IntrospectURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if v.cfg.IntrospectSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+v.cfg.IntrospectSecret)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("verifier: introspection: %s", resp.Status)
+	}
+
+	var result struct {
+		Active    bool   `json:"active"`
+		TokenType string `json:"token_type"`
+		Sub       string `json:"sub"`
+		Scope     string `json:"scope"`
+		ClientID  string `json:"client_id"`
+		Exp       int64  `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("verifier: decoding introspection: %v", err)
+	}
+	// Refresh tokens identify a user too, but must not be used as credentials
+	if !result.Active || result.Sub == "" || result.TokenType == "refresh_token" {
+		return nil, ErrInvalidToken
+	}
+
+	identity := &Identity{Subject: result.Sub, Scopes: strings.Fields(result.Scope), ClientID: result.ClientID, TokenType: result.TokenType}
+	if result.Exp > 0 {
+		identity.ExpiresAt = time.Unix(result.Exp, 0)
+	}
+	return identity, nil
+}
+
+type contextKey struct{}
+
+// Middleware rejects requests without a valid token and makes the identity
+// available to the next handler through FromContext.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := v.VerifyRequest(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, identity)))
+	})
+}
+
+// FromContext returns the identity stored by Middleware.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok
+}
@@ -0,0 +1,321 @@
+package verifier
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authServer stands in for sessionAuth's JWKS and introspection endpoints.
+type authServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	down        bool
+	jwksFetches int
+	// tokens are the opaque tokens /introspect knows, with its answer for each.
+	tokens     map[string]map[string]any
+	authHeader string
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	t.Helper()
+	s := &authServer{keys: map[string]*rsa.PrivateKey{}, tokens: map[string]map[string]any{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jwksFetches++
+		if s.down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		var keys []jsonWebKey
+		for kid, k := range s.keys {
+			keys = append(keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.authHeader = r.Header.Get("Authorization")
+		answer, ok := s.tokens[r.PostFormValue("token")]
+		if !ok {
+			answer = map[string]any{"active": false}
+		}
+		json.NewEncoder(w).Encode(answer)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *authServer) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+}
+
+func (s *authServer) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *authServer) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksFetches
+}
+
+// claims are those of a valid first-party access token.
+func (s *authServer) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": s.URL,
+		"aud": "chatroom",
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (s *authServer) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	s.mu.Lock()
+	key := s.keys[kid]
+	s.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (s *authServer) verifier() *Verifier {
+	return New(FromBaseURL(s.URL, "chatroom", "introspection-secret"))
+}
+
+// age makes the verifier's key set look as if it was fetched d ago.
+func (v *Verifier) age(d time.Duration) {
+	v.mu.Lock()
+	v.fetchedAt = v.fetchedAt.Add(-d)
+	v.mu.Unlock()
+}
+
+func TestVerifyJWT(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	claims := s.claims()
+	claims["scope"] = "chat:read files:write"
+	claims["client_id"] = "client-1"
+
+	identity, err := s.verifier().Verify(context.Background(), s.sign(t, "k1", claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "user-1" || identity.ClientID != "client-1" || identity.TokenType != "access_token" {
+		t.Errorf("got %+v", identity)
+	}
+	if len(identity.Scopes) != 2 || identity.Scopes[0] != "chat:read" || identity.Scopes[1] != "files:write" {
+		t.Errorf("got scopes %q", identity.Scopes)
+	}
+	if identity.ExpiresAt.Unix() != claims["exp"].(int64) {
+		t.Errorf("got expiry %v, want %v", identity.ExpiresAt.Unix(), claims["exp"])
+	}
+}
+
+func TestVerifyJWTRejects(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	v := s.verifier()
+
+	with := func(name string, value any) string {
+		claims := s.claims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return s.sign(t, "k1", claims)
+	}
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, s.claims()).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, s.claims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := s.sign(t, "k1", s.claims())
+	s.addKey(t, "k1")
+
+	for name, token := range map[string]string{
+		"HS256":          hs256,
+		"alg none":       unsigned,
+		"other issuer":   with("iss", "https://evil.example.com"),
+		"other audience": with("aud", "billing"),
+		"expired":        with("exp", time.Now().Add(-time.Minute).Unix()),
+		"no expiry":      with("exp", nil),
+		"no subject":     with("sub", nil),
+		"wrong key":      forged,
+	} {
+		if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestUnknownKeyIsFetched(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	v := s.verifier()
+	if _, err := v.Verify(context.Background(), s.sign(t, "k1", s.claims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// sessionAuth rotated its key after we last fetched them
+	s.addKey(t, "k2")
+	v.age(minKeyRefresh)
+	if _, err := v.Verify(context.Background(), s.sign(t, "k2", s.claims())); err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	if n := s.fetches(); n != 2 {
+		t.Errorf("got %d fetches, want 2", n)
+	}
+}
+
+func TestUnknownKeysAreThrottled(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	v := s.verifier()
+	if _, err := v.Verify(context.Background(), s.sign(t, "k1", s.claims())); err != nil {
+		t.Fatal(err)
+	}
+	s.addKey(t, "k2")
+	unknown := s.sign(t, "k2", s.claims())
+	s.mu.Lock()
+	delete(s.keys, "k2")
+	s.mu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		if _, err := v.Verify(context.Background(), unknown); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("got %v, want %v", err, ErrInvalidToken)
+		}
+	}
+	if n := s.fetches(); n != 1 {
+		t.Errorf("got %d fetches within %v, want 1", n, minKeyRefresh)
+	}
+
+	v.age(minKeyRefresh)
+	v.Verify(context.Background(), unknown)
+	if n := s.fetches(); n != 2 {
+		t.Errorf("got %d fetches after %v, want 2", n, minKeyRefresh)
+	}
+}
+
+func TestKnownKeyIsKeptWhileJWKSIsDown(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	v := s.verifier()
+	token := s.sign(t, "k1", s.claims())
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	s.setDown(true)
+	v.age(keyRefreshInterval)
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Errorf("known key while sessionAuth is down: %v", err)
+	}
+	if n := s.fetches(); n != 2 {
+		t.Errorf("got %d fetches, want the stale key set to be fetched again", n)
+	}
+}
+
+func TestNoKeysWhileJWKSIsDown(t *testing.T) {
+	s := newAuthServer(t)
+	s.addKey(t, "k1")
+	s.setDown(true)
+	if _, err := s.verifier().Verify(context.Background(), s.sign(t, "k1", s.claims())); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	s := newAuthServer(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	s.tokens["cak_key"] = map[string]any{"active": true, "token_type": "api_key", "sub": "user-1", "scope": "chat:read", "exp": exp}
+	s.tokens["refresh"] = map[string]any{"active": true, "token_type": "refresh_token", "sub": "user-1"}
+	s.tokens["revoked"] = map[string]any{"active": false, "sub": "user-1"}
+	v := s.verifier()
+
+	identity, err := v.Verify(context.Background(), "cak_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "user-1" || identity.TokenType != "api_key" || len(identity.Scopes) != 1 || identity.Scopes[0] != "chat:read" || identity.ExpiresAt.Unix() != exp {
+		t.Errorf("got %+v", identity)
+	}
+	if s.authHeader != "Bearer introspection-secret" {
+		t.Errorf("got Authorization %q, want the introspection secret", s.authHeader)
+	}
+
+	for _, token := range []string{"refresh", "revoked", "unknown"} {
+		if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want %v", token, err, ErrInvalidToken)
+		}
+	}
+
+	s.authHeader = ""
+	v = New(Config{JWKSURL: s.URL + "/.well-known/jwks.json", Issuer: s.URL, Audience: "chatroom"})
+	if _, err := v.Verify(context.Background(), "cak_key"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("without an introspection endpoint: got %v, want %v", err, ErrInvalidToken)
+	}
+	if s.authHeader != "" {
+		t.Error("introspected without an introspection endpoint")
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		identity Identity
+		want     map[string]bool
+	}{
+		{"first-party app", Identity{TokenType: "access_token"}, map[string]bool{"chat:read": true, "files:write": true}},
+		{"OAuth client", Identity{TokenType: "access_token", ClientID: "client-1", Scopes: []string{"chat:read"}}, map[string]bool{"chat:read": true, "files:write": false}},
+		{"OAuth client without scopes", Identity{TokenType: "access_token", ClientID: "client-1"}, map[string]bool{"chat:read": false}},
+		{"API key", Identity{TokenType: "api_key", Scopes: []string{"files:write"}}, map[string]bool{"chat:read": false, "files:write": true}},
+		{"API key without scopes", Identity{TokenType: "api_key"}, map[string]bool{"chat:read": false}},
+	} {
+		for scope, want := range test.want {
+			if got := test.identity.HasScope(scope); got != want {
+				t.Errorf("%s: HasScope(%q) = %v, want %v", test.name, scope, got, want)
+			}
+		}
+	}
+}